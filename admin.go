@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"server/internal"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func GetProfanityWordsHandler(w http.ResponseWriter, r *http.Request, cfg *apiConfig) {
+	w.Header().Set("Content-Type", "application/json")
+	dat, _ := json.Marshal(cfg.profanity.Words())
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+// SetProfanityWordsHandler replaces the whole word list and saves it to the
+// word list file
+func SetProfanityWordsHandler(w http.ResponseWriter, r *http.Request, cfg *apiConfig) {
+	type retError struct {
+		Error string `json:"error"`
+	}
+	w.Header().Set("Content-Type", "application/json")
+	words := []internal.ProfanityWord{}
+	if err := json.NewDecoder(r.Body).Decode(&words); err != nil {
+		errMsg := retError{Error: err.Error()}
+		dat, _ := json.Marshal(errMsg)
+		w.WriteHeader(400)
+		w.Write(dat)
+		return
+	}
+	if err := cfg.profanity.SetWords(words); err != nil {
+		errMsg := retError{Error: err.Error()}
+		dat, _ := json.Marshal(errMsg)
+		internal.Logger(r.Context()).Info("cannot save profanity list", "error", err)
+		w.WriteHeader(400)
+		w.Write(dat)
+		return
+	}
+	dat, _ := json.Marshal(cfg.profanity.Words())
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+func GetFlaggedChirpsHandler(w http.ResponseWriter, r *http.Request, db internal.Store) {
+	type retError struct {
+		Error string `json:"error"`
+	}
+	w.Header().Set("Content-Type", "application/json")
+	flagged, err := db.GetFlaggedChirps(r.Context())
+	if err != nil {
+		errMsg := retError{Error: err.Error()}
+		dat, _ := json.Marshal(errMsg)
+		internal.Logger(r.Context()).Error("cannot load flagged chirps", "error", err)
+		w.WriteHeader(500)
+		w.Write(dat)
+		return
+	}
+	dat, _ := json.Marshal(flagged)
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+// ClearChirpFlagHandler marks a flagged chirp as reviewed
+func ClearChirpFlagHandler(w http.ResponseWriter, r *http.Request, db internal.Store, chirpID int) {
+	type retError struct {
+		Error string `json:"error"`
+	}
+	if err := db.ClearChirpFlag(r.Context(), chirpID); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		errMsg := retError{Error: err.Error()}
+		dat, _ := json.Marshal(errMsg)
+		if errors.Is(err, internal.ErrChirpNotFound) {
+			w.WriteHeader(404)
+		} else {
+			internal.Logger(r.Context()).Error("cannot clear chirp flag", "chirp_id", chirpID, "error", err)
+			w.WriteHeader(500)
+		}
+		w.Write(dat)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// SetUserRoleHandler changes another user's role. Admins can't change their
+// own, so the last admin can't lock everyone out by accident.
+func SetUserRoleHandler(w http.ResponseWriter, r *http.Request, db internal.Store, userID int) {
+	type parameters struct {
+		Role string `json:"role"`
+	}
+	type retError struct {
+		Error string `json:"error"`
+	}
+	w.Header().Set("Content-Type", "application/json")
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		errMsg := retError{Error: err.Error()}
+		dat, _ := json.Marshal(errMsg)
+		w.WriteHeader(400)
+		w.Write(dat)
+		return
+	}
+	role, err := internal.ParseRole(params.Role)
+	if err != nil {
+		errMsg := retError{Error: err.Error()}
+		dat, _ := json.Marshal(errMsg)
+		w.WriteHeader(400)
+		w.Write(dat)
+		return
+	}
+	if admin, _ := userFromContext(r.Context()); admin.ID == userID {
+		errMsg := retError{Error: "You cannot change your own role"}
+		dat, _ := json.Marshal(errMsg)
+		w.WriteHeader(400)
+		w.Write(dat)
+		return
+	}
+	if err := db.SetUserRole(r.Context(), userID, role); err != nil {
+		errMsg := retError{Error: err.Error()}
+		dat, _ := json.Marshal(errMsg)
+		if errors.Is(err, internal.ErrUserNotFound) {
+			w.WriteHeader(404)
+		} else {
+			internal.Logger(r.Context()).Error("cannot set user role", "user_id", userID, "error", err)
+			w.WriteHeader(500)
+		}
+		w.Write(dat)
+		return
+	}
+	internal.Logger(r.Context()).Info("changed user role", "target_user_id", userID, "role", role)
+	user, _ := db.GetSingleUser(r.Context(), userID)
+	dat, _ := json.Marshal(internal.DbUsertoUserX(user))
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+// UnlockUserHandler lifts a lockout or backoff on a user's account after
+// failed logins
+func UnlockUserHandler(w http.ResponseWriter, r *http.Request, db internal.Store, cfg *apiConfig, userID int) {
+	type retError struct {
+		Error string `json:"error"`
+	}
+	user, ok := db.GetSingleUser(r.Context(), userID)
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		errMsg := retError{Error: internal.ErrUserNotFound.Error()}
+		dat, _ := json.Marshal(errMsg)
+		w.WriteHeader(404)
+		w.Write(dat)
+		return
+	}
+	account := strings.ToLower(strings.TrimSpace(user.Email))
+	wasLocked := cfg.logins.Unlock(account)
+	admin, _ := userFromContext(r.Context())
+	_, err := db.AddAuditEntry(r.Context(), internal.AuditEntry{
+		Time: time.Now().UTC(), Action: internal.AuditAccountUnlocked, ActorID: admin.ID, UserID: user.ID, Email: account, IP: clientIP(r),
+	})
+	if err != nil {
+		internal.Logger(r.Context()).Error("cannot write audit entry", "error", err)
+	}
+	internal.Logger(r.Context()).Info("unlocked user", "target_user_id", userID, "was_locked", wasLocked)
+	w.WriteHeader(204)
+}
+
+// maxAuditPageSize caps how many entries GET /admin/audit returns. It is also
+// the number returned when the client doesn't ask for one.
+const maxAuditPageSize = 100
+
+// GetAuditLogHandler lists the newest audit log entries
+func GetAuditLogHandler(w http.ResponseWriter, r *http.Request, db internal.Store) {
+	type retError struct {
+		Error string `json:"error"`
+	}
+	w.Header().Set("Content-Type", "application/json")
+	limit := maxAuditPageSize
+	if s := r.URL.Query().Get("limit"); s != "" {
+		l, err := strconv.Atoi(s)
+		if err != nil || l < 1 {
+			errMsg := retError{Error: "limit must be a positive integer"}
+			dat, _ := json.Marshal(errMsg)
+			w.WriteHeader(400)
+			w.Write(dat)
+			return
+		}
+		limit = min(l, maxAuditPageSize)
+	}
+	entries, err := db.GetAuditEntries(r.Context(), limit)
+	if err != nil {
+		errMsg := retError{Error: err.Error()}
+		dat, _ := json.Marshal(errMsg)
+		internal.Logger(r.Context()).Error("cannot load audit log", "error", err)
+		w.WriteHeader(500)
+		w.Write(dat)
+		return
+	}
+	dat, _ := json.Marshal(entries)
+	w.WriteHeader(200)
+	w.Write(dat)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"server/internal"
+	"time"
+)
+
+const (
+	// accessTokenTTL is how long access tokens are valid unless the client
+	// asks for less at login
+	accessTokenTTL = 5000 * time.Second
+	// sessionTTL is how long a refresh token can be used after login
+	sessionTTL = 1440 * time.Hour
+)
+
+type userKey struct{}
+
+type claimsKey struct{}
+
+// userFromContext returns the user RequireAuth or OptionalAuth authenticated
+func userFromContext(ctx context.Context) (internal.User, bool) {
+	user, ok := ctx.Value(userKey{}).(internal.User)
+	return user, ok
+}
+
+// claimsFromContext returns the claims of the access token RequireAuth or
+// OptionalAuth accepted
+func claimsFromContext(ctx context.Context) (internal.Claims, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(internal.Claims)
+	return claims, ok
+}
+
+// authenticate checks the request's bearer token and returns its user and
+// claims. The error is internal.ErrNoAuthorization when no credentials were
+// sent at all.
+func (cfg *apiConfig) authenticate(r *http.Request, db internal.Store) (internal.User, internal.Claims, error) {
+	token, err := internal.AuthorizationCredentials(r.Header.Get("Authorization"), "Bearer")
+	if err != nil {
+		return internal.User{}, internal.Claims{}, err
+	}
+	claims, err := cfg.tokens.IsAuthenticated(r.Context(), token, db)
+	if errors.Is(err, internal.ErrTokenRevoked) {
+		return internal.User{}, internal.Claims{}, err
+	}
+	if err != nil {
+		internal.Logger(r.Context()).Debug("rejected access token", "error", err)
+		return internal.User{}, internal.Claims{}, errors.New("invalid or expired token")
+	}
+	userID, _ := claims.UserID()
+	user, ok := db.GetSingleUser(r.Context(), userID)
+	if !ok {
+		return internal.User{}, internal.Claims{}, errors.New("user no longer exists")
+	}
+	return user, claims, nil
+}
+
+// withAuth returns r with the authenticated user and token claims attached
+func withAuth(r *http.Request, user internal.User, claims internal.Claims) *http.Request {
+	setRequestUser(r, user.ID)
+	ctx := context.WithValue(r.Context(), userKey{}, user)
+	return r.WithContext(context.WithValue(ctx, claimsKey{}, claims))
+}
+
+// RequireAuth only lets requests with a valid access token through to next,
+// with the user available from userFromContext. Everything else gets a 401.
+func (cfg *apiConfig) RequireAuth(db internal.Store, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, claims, err := cfg.authenticate(r, db)
+		if err != nil {
+			internal.Logger(r.Context()).Info("authentication failed", "error", err)
+			writeUnauthorized(w, err)
+			return
+		}
+		next(w, withAuth(r, user, claims))
+	}
+}
+
+// OptionalAuth lets anonymous requests through to next but authenticates
+// requests that send credentials, rejecting invalid ones with a 401
+func (cfg *apiConfig) OptionalAuth(db internal.Store, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, claims, err := cfg.authenticate(r, db)
+		if errors.Is(err, internal.ErrNoAuthorization) {
+			next(w, r)
+			return
+		}
+		if err != nil {
+			internal.Logger(r.Context()).Info("authentication failed", "error", err)
+			writeUnauthorized(w, err)
+			return
+		}
+		next(w, withAuth(r, user, claims))
+	}
+}
+
+// writeUnauthorized sends a 401 with a WWW-Authenticate challenge as
+// described in RFC 6750. A request without credentials gets a bare
+// challenge, a malformed header is an invalid request and anything else an
+// invalid token.
+func writeUnauthorized(w http.ResponseWriter, err error) {
+	type retError struct {
+		Error string `json:"error"`
+	}
+	challenge := `Bearer realm="chirpy"`
+	switch {
+	case errors.Is(err, internal.ErrNoAuthorization):
+	case errors.Is(err, internal.ErrMalformedAuthorization):
+		challenge += fmt.Sprintf(`, error="invalid_request", error_description=%q`, err.Error())
+	default:
+		challenge += fmt.Sprintf(`, error="invalid_token", error_description=%q`, err.Error())
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	w.Header().Set("Content-Type", "application/json")
+	dat, _ := json.Marshal(retError{Error: "Log in again"})
+	w.WriteHeader(401)
+	w.Write(dat)
+}
+
+// RequirePermission is RequireAuth that also needs the user's role to grant
+// p. Authenticated users without it get a 403.
+func (cfg *apiConfig) RequirePermission(db internal.Store, p internal.Permission, next http.HandlerFunc) http.HandlerFunc {
+	return cfg.RequireAuth(db, func(w http.ResponseWriter, r *http.Request) {
+		type retError struct {
+			Error string `json:"error"`
+		}
+		user, _ := userFromContext(r.Context())
+		if !user.Role.Can(p) {
+			internal.Logger(r.Context()).Info("permission denied", "permission", p, "role", user.Role)
+			w.Header().Set("Content-Type", "application/json")
+			dat, _ := json.Marshal(retError{Error: "Forbidden"})
+			w.WriteHeader(403)
+			w.Write(dat)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// JWKSHandler publishes the public keys access tokens are signed with, so
+// other services can verify them. It is empty when only HMAC secrets are
+// configured.
+func JWKSHandler(w http.ResponseWriter, r *http.Request, cfg *apiConfig) {
+	dat, _ := json.Marshal(cfg.tokens.JWKS())
+	w.Header().Set("Content-Type", "application/jwk-set+json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.WriteHeader(200)
+	w.Write(dat)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"server/internal"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestAPI returns a config that signs tokens with an HMAC secret and a
+// JSON store holding one user of each role, by role
+func newTestAPI(t *testing.T) (*apiConfig, internal.Store, map[internal.Role]internal.UserExternal) {
+	t.Helper()
+	db, err := internal.NewDB(filepath.Join(t.TempDir(), "db.json"))
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	tokens, err := internal.NewKeyring("chirpy", "chirpy", internal.NewHMACKey("test secret"))
+	if err != nil {
+		t.Fatalf("NewKeyring: %v", err)
+	}
+	users := map[internal.Role]internal.UserExternal{}
+	for _, role := range []internal.Role{internal.RoleUser, internal.RoleModerator, internal.RoleAdmin} {
+		user, err := db.CreateUser(context.Background(), string(role)+"@example.com", "hash")
+		if err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+		if err := db.SetUserRole(context.Background(), user.ID, role); err != nil {
+			t.Fatalf("SetUserRole: %v", err)
+		}
+		users[role] = user
+	}
+	return &apiConfig{tokens: tokens}, db, users
+}
+
+func newTestToken(t *testing.T, tokens *internal.Keyring, userID int, ttl time.Duration) string {
+	t.Helper()
+	token, err := tokens.CreateJWT(userID, 1, ttl)
+	if err != nil {
+		t.Fatalf("CreateJWT: %v", err)
+	}
+	return token
+}
+
+// whoami answers with the email of the authenticated user, or "anonymous"
+func whoami(w http.ResponseWriter, r *http.Request) {
+	if user, ok := userFromContext(r.Context()); ok {
+		w.Write([]byte(user.Email))
+		return
+	}
+	w.Write([]byte("anonymous"))
+}
+
+func serveWithAuthorization(handler http.HandlerFunc, authorization string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/", nil)
+	if authorization != "" {
+		r.Header.Set("Authorization", authorization)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestRequireAuth(t *testing.T) {
+	cfg, db, users := newTestAPI(t)
+	user := users[internal.RoleUser]
+	valid := newTestToken(t, cfg.tokens, user.ID, time.Hour)
+
+	denied := newTestToken(t, cfg.tokens, user.ID, time.Hour)
+	claims, err := cfg.tokens.ParseJWT(denied)
+	if err != nil {
+		t.Fatalf("ParseJWT: %v", err)
+	}
+	if err := db.DenyToken(context.Background(), claims.ID, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("DenyToken: %v", err)
+	}
+	other, err := internal.NewKeyring("chirpy", "chirpy", internal.NewHMACKey("another secret"))
+	if err != nil {
+		t.Fatalf("NewKeyring: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		authorization string
+		wantChallenge string
+	}{
+		{"missing", "", `Bearer realm="chirpy"`},
+		{"wrong scheme", "Basic dXNlcjpwYXNz", `error="invalid_request"`},
+		{"garbage", "Bearer not.a.token", `error="invalid_token"`},
+		{"expired", "Bearer " + newTestToken(t, cfg.tokens, user.ID, -time.Minute), `error="invalid_token"`},
+		{"unknown key", "Bearer " + newTestToken(t, other, user.ID, time.Hour), `error="invalid_token"`},
+		{"denylisted", "Bearer " + denied, `error="invalid_token"`},
+		{"deleted user", "Bearer " + newTestToken(t, cfg.tokens, 999, time.Hour), `error="invalid_token"`},
+	}
+	handler := cfg.RequireAuth(db, whoami)
+	for _, tt := range tests {
+		w := serveWithAuthorization(handler, tt.authorization)
+		if w.Code != 401 {
+			t.Errorf("%s: status %d, want 401", tt.name, w.Code)
+		}
+		if got := w.Header().Get("WWW-Authenticate"); !strings.Contains(got, tt.wantChallenge) {
+			t.Errorf("%s: WWW-Authenticate = %q, want it to contain %q", tt.name, got, tt.wantChallenge)
+		}
+	}
+
+	w := serveWithAuthorization(handler, "Bearer "+valid)
+	if w.Code != 200 || w.Body.String() != user.Email {
+		t.Errorf("valid token: status %d body %q, want 200 %q", w.Code, w.Body.String(), user.Email)
+	}
+}
+
+func TestOptionalAuth(t *testing.T) {
+	cfg, db, users := newTestAPI(t)
+	user := users[internal.RoleUser]
+	handler := cfg.OptionalAuth(db, whoami)
+
+	if w := serveWithAuthorization(handler, ""); w.Code != 200 || w.Body.String() != "anonymous" {
+		t.Errorf("no token: status %d body %q, want 200 anonymous", w.Code, w.Body.String())
+	}
+	if w := serveWithAuthorization(handler, "Bearer "+newTestToken(t, cfg.tokens, user.ID, -time.Minute)); w.Code != 401 {
+		t.Errorf("expired token: status %d, want 401", w.Code)
+	}
+	if w := serveWithAuthorization(handler, "Bearer "+newTestToken(t, cfg.tokens, user.ID, time.Hour)); w.Code != 200 || w.Body.String() != user.Email {
+		t.Errorf("valid token: status %d body %q, want 200 %q", w.Code, w.Body.String(), user.Email)
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	cfg, db, users := newTestAPI(t)
+	handler := cfg.RequirePermission(db, internal.PermModerateChirps, whoami)
+
+	if w := serveWithAuthorization(handler, ""); w.Code != 401 {
+		t.Errorf("no token: status %d, want 401", w.Code)
+	}
+	for role, want := range map[internal.Role]int{
+		internal.RoleUser:      403,
+		internal.RoleModerator: 200,
+		internal.RoleAdmin:     200,
+	} {
+		token := newTestToken(t, cfg.tokens, users[role].ID, time.Hour)
+		if w := serveWithAuthorization(handler, "Bearer "+token); w.Code != want {
+			t.Errorf("%s: status %d, want %d", role, w.Code, want)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"server/internal"
+)
+
+// runCommand runs the subcommand named by args[0], if any, and returns its
+// exit code. ok is false when args don't name a subcommand, in which case the
+// server itself runs.
+func runCommand(args []string) (code int, ok bool) {
+	if len(args) == 0 {
+		return 0, false
+	}
+	switch args[0] {
+	case "migrate":
+		return migrateCommand(args[1:]), true
+	case "config":
+		return configCommand(args[1:]), true
+	case "promote":
+		return promoteCommand(args[1:]), true
+	}
+	return 0, false
+}
+
+// migrateCommand reports the migrations pending for the JSON database and,
+// with -apply, runs them. Applying fails while the server has the database
+// open.
+func migrateCommand(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dbPath := fs.String("db", "./db.json", "Path to the JSON database file")
+	apply := fs.Bool("apply", false, "Write the migrated file instead of only reporting changes. The server must be stopped.")
+	fs.Parse(args)
+
+	report, err := internal.Migrate(*dbPath, !*apply)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+		return 1
+	}
+	if len(report.Steps) == 0 {
+		fmt.Printf("%s is up to date (schema version %d)\n", *dbPath, report.FromVersion)
+		return 0
+	}
+	verb := "would migrate"
+	if *apply {
+		verb = "migrated"
+	}
+	fmt.Printf("%s %s from schema version %d to %d\n", verb, *dbPath, report.FromVersion, report.ToVersion)
+	for _, step := range report.Steps {
+		fmt.Printf("  %d: %s\n", step.Version, step.Description)
+		for _, change := range step.Changes {
+			fmt.Printf("      %s\n", change)
+		}
+	}
+	return 0
+}
+
+// configCommand prints the configuration the server would run with, given the
+// same flags, environment and files, with secrets redacted
+func configCommand(args []string) int {
+	if len(args) == 0 || args[0] != "print" {
+		fmt.Fprintln(os.Stderr, "usage: config print [server flags]")
+		return 2
+	}
+	conf, err := LoadConfig("config print", args[1:])
+	os.Stdout.Write(conf.Redacted())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config: invalid configuration:\n%v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// promoteCommand gives an existing user a role. It is how the first admin is
+// made; after that admins can change roles through the API. The server must
+// be stopped, since it keeps the JSON database in memory; NewDB refuses to
+// open a database the server has open.
+func promoteCommand(args []string) int {
+	fs := flag.NewFlagSet("promote", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: promote -email address [-role role] [-store json|sqlite] [-db path]")
+		fmt.Fprintln(fs.Output(), "Stop the server first: it would overwrite the change with its own copy of the database.")
+		fs.PrintDefaults()
+	}
+	storeKind := fs.String("store", "json", "Storage backend: json or sqlite")
+	dbPath := fs.String("db", "", "Path to the database file (default ./db.json or ./db.sqlite)")
+	email := fs.String("email", "", "Email of the user to promote")
+	roleName := fs.String("role", string(internal.RoleAdmin), "Role to give the user: user, moderator or admin")
+	fs.Parse(args)
+
+	role, err := internal.ParseRole(*roleName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "promote: %v\n", err)
+		return 2
+	}
+	if *email == "" {
+		fmt.Fprintln(os.Stderr, "promote: -email is required")
+		return 2
+	}
+	db, err := openStore(*storeKind, *dbPath, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "promote: %v\n", err)
+		return 1
+	}
+	defer db.Close()
+	ctx := context.Background()
+	user, ok := db.GetSingleUserByEmail(ctx, *email)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "promote: no user with email %s\n", *email)
+		return 1
+	}
+	if err := db.SetUserRole(ctx, user.ID, role); err != nil {
+		fmt.Fprintf(os.Stderr, "promote: %v\n", err)
+		return 1
+	}
+	fmt.Printf("%s (user %d) is now %s\n", user.Email, user.ID, role)
+	return 0
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"os"
+	"reflect"
+	"server/internal"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lpernett/godotenv"
+)
+
+// Config holds every server setting. Each field is filled from, in increasing
+// order of precedence: its default, the JSON config file (key from the json
+// tag), the .env file, the environment (env tag) and the command line (flag
+// tag). Fields tagged secret are redacted by `config print`.
+type Config struct {
+	Addr              string        `json:"addr" env:"ADDR" flag:"addr" usage:"Address to listen on"`
+	Port              string        `json:"port" env:"PORT" flag:"port" usage:"Port to listen on"`
+	ReadHeaderTimeout time.Duration `json:"read_header_timeout" env:"READ_HEADER_TIMEOUT" flag:"read-header-timeout" usage:"Maximum time to read request headers"`
+	ReadTimeout       time.Duration `json:"read_timeout" env:"READ_TIMEOUT" flag:"read-timeout" usage:"Maximum time to read a whole request"`
+	WriteTimeout      time.Duration `json:"write_timeout" env:"WRITE_TIMEOUT" flag:"write-timeout" usage:"Maximum time to write a response"`
+	IdleTimeout       time.Duration `json:"idle_timeout" env:"IDLE_TIMEOUT" flag:"idle-timeout" usage:"Maximum time to keep an idle connection open"`
+	ShutdownTimeout   time.Duration `json:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" flag:"shutdown-timeout" usage:"Time to let in-flight requests finish on shutdown"`
+
+	TLSCert          string        `json:"tls_cert" env:"TLS_CERT" flag:"tls-cert" usage:"TLS certificate file; serves HTTPS when set together with -tls-key"`
+	TLSKey           string        `json:"tls_key" env:"TLS_KEY" flag:"tls-key" usage:"TLS private key file"`
+	HTTPRedirectPort string        `json:"http_redirect_port" env:"HTTP_REDIRECT_PORT" flag:"http-redirect-port" usage:"With TLS, also listen for plain HTTP on this port and redirect it to HTTPS"`
+	HSTSMaxAge       time.Duration `json:"hsts_max_age" env:"HSTS_MAX_AGE" flag:"hsts-max-age" usage:"With TLS, max-age of the Strict-Transport-Security header; 0 disables it"`
+
+	Store            string        `json:"store" env:"STORE" flag:"store" usage:"Storage backend: json or sqlite"`
+	DBPath           string        `json:"db" env:"DB_PATH" flag:"db" usage:"Path to the database file (default ./db.json or ./db.sqlite)"`
+	SnapshotInterval time.Duration `json:"snapshot_interval" env:"SNAPSHOT_INTERVAL" flag:"snapshot-interval" usage:"Persist the JSON database on this interval instead of on every write"`
+	StaticDir        string        `json:"static_dir" env:"STATIC_DIR" flag:"static-dir" usage:"Directory served under /app/"`
+
+	ProfanityWords    string `json:"profanity_words" env:"PROFANITY_WORDS" flag:"profanity-words" usage:"Path to the profanity word list"`
+	ChirpMaxLength    int    `json:"chirp_max_length" env:"CHIRP_MAX_LENGTH" flag:"chirp-max-length" usage:"Maximum chirp length in characters"`
+	ChirpMaxLengthRed int    `json:"chirp_max_length_red" env:"CHIRP_MAX_LENGTH_RED" flag:"chirp-max-length-red" usage:"Maximum chirp length in characters for Chirpy Red members"`
+
+	JWTSecret          string   `json:"jwt_secret" env:"JWT_SECRET" secret:"true"`
+	JWTPreviousSecrets []string `json:"jwt_previous_secrets" env:"JWT_PREVIOUS_SECRETS" secret:"true"`
+	JWTPrivateKey      string   `json:"jwt_private_key" env:"JWT_PRIVATE_KEY" flag:"jwt-private-key" usage:"PEM Ed25519 or RSA private key file; signs access tokens with EdDSA or RS256 instead of jwt_secret"`
+	JWTPublicKeys      []string `json:"jwt_public_keys" env:"JWT_PUBLIC_KEYS" flag:"jwt-public-keys" usage:"Comma-separated PEM public key files of rotated-out private keys whose tokens are still accepted"`
+	JWTIssuer          string   `json:"jwt_issuer" env:"JWT_ISSUER" flag:"jwt-issuer" usage:"Issuer (iss) of access tokens"`
+	JWTAudience        string   `json:"jwt_audience" env:"JWT_AUDIENCE" flag:"jwt-audience" usage:"Audience (aud) of access tokens"`
+	PolkaKey           string   `json:"polka_key" env:"POLKA_KEY" secret:"true"`
+
+	TrustedProxies []string `json:"trusted_proxies" env:"TRUSTED_PROXIES" flag:"trusted-proxies" usage:"Comma-separated addresses or CIDR ranges of reverse proxies whose X-Forwarded-For is believed"`
+	RateLimits     []string `json:"rate_limits" env:"RATE_LIMITS" flag:"rate-limits" usage:"Comma-separated per-route request limits such as \"POST /api/chirps=30/1m\""`
+
+	PasswordMinLength  int    `json:"password_min_length" env:"PASSWORD_MIN_LENGTH" flag:"password-min-length" usage:"Minimum password length in characters"`
+	PasswordBreachList string `json:"password_breach_list" env:"PASSWORD_BREACH_LIST" flag:"password-breach-list" usage:"File of leaked passwords, one per line, that can't be chosen"`
+	PasswordHash       string `json:"password_hash" env:"PASSWORD_HASH" flag:"password-hash" usage:"Algorithm for new password hashes: bcrypt or argon2id; older hashes are replaced on login"`
+	BcryptCost         int    `json:"bcrypt_cost" env:"BCRYPT_COST" flag:"bcrypt-cost" usage:"Cost of bcrypt password hashes"`
+	Argon2Time         int    `json:"argon2_time" env:"ARGON2_TIME" flag:"argon2-time" usage:"Passes over memory of argon2id password hashes"`
+	Argon2Memory       int    `json:"argon2_memory" env:"ARGON2_MEMORY" flag:"argon2-memory" usage:"Memory in KiB of argon2id password hashes"`
+	Argon2Threads      int    `json:"argon2_threads" env:"ARGON2_THREADS" flag:"argon2-threads" usage:"Parallelism of argon2id password hashes"`
+
+	Mailer           string `json:"mailer" env:"MAILER" flag:"mailer" usage:"How to send email: smtp, or file or log to only write it down for testing; empty disables password reset"`
+	MailFrom         string `json:"mail_from" env:"MAIL_FROM" flag:"mail-from" usage:"Sender address of email"`
+	MailFile         string `json:"mail_file" env:"MAIL_FILE" flag:"mail-file" usage:"File the file mailer appends email to"`
+	SMTPAddr         string `json:"smtp_addr" env:"SMTP_ADDR" flag:"smtp-addr" usage:"host:port of the SMTP server"`
+	SMTPUsername     string `json:"smtp_username" env:"SMTP_USERNAME" flag:"smtp-username" usage:"SMTP username; leave empty to send without logging in"`
+	SMTPPassword     string `json:"smtp_password" env:"SMTP_PASSWORD" secret:"true"`
+	PasswordResetURL string `json:"password_reset_url" env:"PASSWORD_RESET_URL" flag:"password-reset-url" usage:"Page password reset email links to, with the reset token added as the token query parameter"`
+
+	LoginLockoutFailures int           `json:"login_lockout_failures" env:"LOGIN_LOCKOUT_FAILURES" flag:"login-lockout-failures" usage:"Failed logins that lock an account; 0 never locks"`
+	LoginLockoutDuration time.Duration `json:"login_lockout_duration" env:"LOGIN_LOCKOUT_DURATION" flag:"login-lockout-duration" usage:"How long a locked account stays locked"`
+
+	LogLevel string `json:"log_level" env:"LOG_LEVEL" flag:"log-level" usage:"Minimum level to log: debug, info, warn or error"`
+	Debug    bool   `json:"debug" env:"DEBUG" flag:"debug" usage:"Reset the database on startup"`
+}
+
+// defaultConfigPath is read when it exists and no other file is named
+const defaultConfigPath = "./chirpy.json"
+
+// DefaultConfig returns the settings used when nothing overrides them
+func DefaultConfig() Config {
+	return Config{
+		Addr:              "localhost",
+		Port:              "8080",
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       15 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       60 * time.Second,
+		ShutdownTimeout:   15 * time.Second,
+		HSTSMaxAge:        365 * 24 * time.Hour,
+		Store:             "json",
+		StaticDir:         "./static",
+		ProfanityWords:    "./profanity.txt",
+		ChirpMaxLength:    internal.DefaultChirpRules.MaxLength,
+		ChirpMaxLengthRed: internal.DefaultChirpRules.MaxLengthRed,
+		JWTIssuer:         "chirpy",
+		JWTAudience:       "chirpy",
+		LogLevel:          "info",
+
+		RateLimits: []string{
+			"POST /api/chirps=30/1m",
+			"POST /api/users=10/1h",
+			"POST /api/polka/webhooks=60/1m",
+			"POST /api/password/forgot=5/1h",
+		},
+
+		MailFrom:         "chirpy@localhost",
+		MailFile:         "./mail.log",
+		PasswordResetURL: "http://localhost:8080/app/reset-password",
+
+		PasswordMinLength: 8,
+		PasswordHash:      string(internal.PasswordBcrypt),
+		BcryptCost:        internal.DefaultBcryptCost,
+		Argon2Time:        int(internal.DefaultArgon2Params.Time),
+		Argon2Memory:      int(internal.DefaultArgon2Params.Memory),
+		Argon2Threads:     int(internal.DefaultArgon2Params.Threads),
+
+		LoginLockoutFailures: internal.DefaultAccountLimits.LockoutFailures,
+		LoginLockoutDuration: internal.DefaultAccountLimits.LockoutDuration,
+	}
+}
+
+// LoadConfig builds the configuration from every source, with args being the
+// command line flags, and validates it. A config file can be named with
+// -config or CHIRPY_CONFIG.
+func LoadConfig(name string, args []string) (Config, error) {
+	c := DefaultConfig()
+
+	// Flags are parsed first so that -config is known, into a separate copy
+	// that is only applied once every other source has been read
+	flagged := DefaultConfig()
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	configPath := flags.String("config", "", "Path to a JSON config file (default "+defaultConfigPath+" if it exists) (env CHIRPY_CONFIG)")
+	fieldByFlag := map[string]int{}
+	fv := reflect.ValueOf(&flagged).Elem()
+	for i := 0; i < fv.NumField(); i++ {
+		field := fv.Type().Field(i)
+		name := field.Tag.Get("flag")
+		if name == "" {
+			continue
+		}
+		usage := field.Tag.Get("usage")
+		if env := field.Tag.Get("env"); env != "" {
+			usage += " (env " + env + ")"
+		}
+		fieldByFlag[name] = i
+		flags.Var(configFlag{fv.Field(i)}, name, usage)
+	}
+	flags.Parse(args)
+
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return c, fmt.Errorf(".env: %w", err)
+	}
+
+	path, required := *configPath, true
+	if path == "" {
+		path = os.Getenv("CHIRPY_CONFIG")
+	}
+	if path == "" {
+		path, required = defaultConfigPath, false
+	}
+	if err := c.loadFile(path, required); err != nil {
+		return c, err
+	}
+
+	rv := reflect.ValueOf(&c).Elem()
+	for i := 0; i < rv.NumField(); i++ {
+		env := rv.Type().Field(i).Tag.Get("env")
+		if env == "" {
+			continue
+		}
+		if value := os.Getenv(env); value != "" {
+			if err := setConfigField(rv.Field(i), value); err != nil {
+				return c, fmt.Errorf("%s: %w", env, err)
+			}
+		}
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		if i, ok := fieldByFlag[f.Name]; ok {
+			rv.Field(i).Set(fv.Field(i))
+		}
+	})
+	return c, c.Validate()
+}
+
+// loadFile merges the JSON object in path into c. Keys are the fields' json
+// tags; unknown keys are an error so typos don't go unnoticed.
+func (c *Config) loadFile(path string, required bool) error {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && !required {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	values := map[string]json.RawMessage{}
+	if err := json.Unmarshal(content, &values); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	rv := reflect.ValueOf(c).Elem()
+	for i := 0; i < rv.NumField(); i++ {
+		key := rv.Type().Field(i).Tag.Get("json")
+		raw, ok := values[key]
+		if !ok {
+			continue
+		}
+		delete(values, key)
+		if err := setConfigJSON(rv.Field(i), raw); err != nil {
+			return fmt.Errorf("%s: %s: %w", path, key, err)
+		}
+	}
+	if len(values) > 0 {
+		unknown := make([]string, 0, len(values))
+		for key := range values {
+			unknown = append(unknown, key)
+		}
+		sort.Strings(unknown)
+		return fmt.Errorf("%s: unknown settings %q", path, unknown)
+	}
+	return nil
+}
+
+// Validate reports every setting that would stop the server from working
+func (c Config) Validate() error {
+	var errs []error
+	if c.JWTSecret == "" && c.JWTPrivateKey == "" {
+		errs = append(errs, errors.New("jwt_secret (JWT_SECRET) or jwt_private_key must be set, or no token would ever validate"))
+	}
+	if c.JWTIssuer == "" || c.JWTAudience == "" {
+		errs = append(errs, errors.New("jwt_issuer and jwt_audience must not be empty"))
+	}
+	if c.Store != "json" && c.Store != "sqlite" {
+		errs = append(errs, fmt.Errorf("store must be json or sqlite, not %q", c.Store))
+	}
+	if !validPort(c.Port) {
+		errs = append(errs, fmt.Errorf("port must be a port number, not %q", c.Port))
+	}
+	if c.HTTPRedirectPort != "" && !validPort(c.HTTPRedirectPort) {
+		errs = append(errs, fmt.Errorf("http_redirect_port must be a port number, not %q", c.HTTPRedirectPort))
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		errs = append(errs, errors.New("tls_cert and tls_key must be set together"))
+	}
+	if c.HTTPRedirectPort != "" && c.TLSCert == "" {
+		errs = append(errs, errors.New("http_redirect_port needs tls_cert and tls_key"))
+	}
+	if c.ChirpMaxLength <= 0 || c.ChirpMaxLengthRed <= 0 {
+		errs = append(errs, errors.New("chirp_max_length and chirp_max_length_red must be positive"))
+	}
+	if _, err := internal.ParseTrustedProxies(c.TrustedProxies); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := c.RatePolicies(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.PasswordMinLength < 1 {
+		errs = append(errs, errors.New("password_min_length must be at least 1"))
+	}
+	if _, err := c.PasswordHasher(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := c.NewMailer(); err != nil {
+		errs = append(errs, err)
+	}
+	if u, err := url.Parse(c.PasswordResetURL); err != nil || !u.IsAbs() {
+		errs = append(errs, fmt.Errorf("password_reset_url must be an absolute URL, not %q", c.PasswordResetURL))
+	}
+	if c.LoginLockoutFailures < 0 {
+		errs = append(errs, errors.New("login_lockout_failures must not be negative"))
+	}
+	if c.LoginLockoutFailures > 0 && c.LoginLockoutDuration <= 0 {
+		errs = append(errs, errors.New("login_lockout_duration must be positive when login_lockout_failures is set"))
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		errs = append(errs, fmt.Errorf("log_level must be debug, info, warn or error, not %q", c.LogLevel))
+	}
+	rv := reflect.ValueOf(c)
+	for i := 0; i < rv.NumField(); i++ {
+		if d, ok := rv.Field(i).Interface().(time.Duration); ok && d < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative", rv.Type().Field(i).Tag.Get("json")))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// RatePolicies returns the request limit of each route listed in
+// rate_limits, by route pattern
+func (c Config) RatePolicies() (map[string]internal.RatePolicy, error) {
+	policies := map[string]internal.RatePolicy{}
+	for _, s := range c.RateLimits {
+		i := strings.LastIndexByte(s, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("rate_limits: %q is not <route>=<limit>/<period>", s)
+		}
+		route := strings.Join(strings.Fields(s[:i]), " ")
+		policy, err := internal.ParseRatePolicy(s[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("rate_limits: %s: %w", route, err)
+		}
+		policies[route] = policy
+	}
+	return policies, nil
+}
+
+// PasswordHasher returns the hasher for new passwords
+func (c Config) PasswordHasher() (*internal.PasswordHasher, error) {
+	if c.Argon2Time < 0 || c.Argon2Memory < 0 || c.Argon2Threads < 0 || c.Argon2Threads > 255 {
+		return nil, errors.New("argon2_time and argon2_memory must not be negative, and argon2_threads must be between 1 and 255")
+	}
+	return internal.NewPasswordHasher(internal.PasswordAlgorithm(c.PasswordHash), c.BcryptCost, internal.Argon2Params{
+		Time:    uint32(c.Argon2Time),
+		Memory:  uint32(c.Argon2Memory),
+		Threads: uint8(c.Argon2Threads),
+	})
+}
+
+// NewMailer returns the mailer email is sent with, or nil if no mailer is
+// set and no email can be sent
+func (c Config) NewMailer() (internal.Mailer, error) {
+	switch c.Mailer {
+	case "":
+		return nil, nil
+	case "smtp":
+		if c.SMTPAddr == "" {
+			return nil, errors.New("the smtp mailer needs smtp_addr")
+		}
+		return internal.NewSMTPMailer(c.SMTPAddr, c.MailFrom, c.SMTPUsername, c.SMTPPassword)
+	case "file":
+		return internal.NewFileMailer(c.MailFile, c.MailFrom), nil
+	case "log":
+		return internal.LogMailer{}, nil
+	}
+	return nil, fmt.Errorf("mailer must be smtp, file or log, not %q", c.Mailer)
+}
+
+// LoginThrottle returns the throttle for failed logins, locking accounts as
+// configured
+func (c Config) LoginThrottle() *internal.LoginThrottle {
+	account := internal.DefaultAccountLimits
+	account.LockoutFailures = c.LoginLockoutFailures
+	account.LockoutDuration = c.LoginLockoutDuration
+	return internal.NewLoginThrottle(account, internal.DefaultIPLimits)
+}
+
+// Keyring loads the keys access tokens are signed and verified with. The
+// private key signs when set, otherwise the secret; previous secrets and
+// public keys are only used to verify tokens issued before a rotation.
+func (c Config) Keyring() (*internal.Keyring, error) {
+	var keys []internal.SigningKey
+	if c.JWTPrivateKey != "" {
+		data, err := os.ReadFile(c.JWTPrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		key, err := internal.ParsePrivateKeyPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", c.JWTPrivateKey, err)
+		}
+		keys = append(keys, key)
+	}
+	if c.JWTSecret != "" {
+		keys = append(keys, internal.NewHMACKey(c.JWTSecret))
+	}
+	for _, secret := range c.JWTPreviousSecrets {
+		keys = append(keys, internal.NewHMACKey(secret))
+	}
+	for _, path := range c.JWTPublicKeys {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		key, err := internal.ParsePublicKeyPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no signing key configured")
+	}
+	return internal.NewKeyring(c.JWTIssuer, c.JWTAudience, keys[0], keys[1:]...)
+}
+
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n >= 0 && n <= 65535
+}
+
+// Redacted returns the configuration as an indented JSON object in the
+// config file format, with secrets replaced
+func (c Config) Redacted() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("{")
+	rv := reflect.ValueOf(c)
+	for i := 0; i < rv.NumField(); i++ {
+		field := rv.Type().Field(i)
+		var value []byte
+		if field.Tag.Get("secret") != "" {
+			redacted := ""
+			if !rv.Field(i).IsZero() {
+				redacted = "REDACTED"
+			}
+			value, _ = json.Marshal(redacted)
+		} else if d, ok := rv.Field(i).Interface().(time.Duration); ok {
+			value, _ = json.Marshal(d.String())
+		} else {
+			value, _ = json.Marshal(rv.Field(i).Interface())
+		}
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		key, _ := json.Marshal(field.Tag.Get("json"))
+		fmt.Fprintf(&buf, "%s:%s", key, value)
+	}
+	buf.WriteString("}")
+	var out bytes.Buffer
+	json.Indent(&out, buf.Bytes(), "", "  ")
+	out.WriteString("\n")
+	return out.Bytes()
+}
+
+// configFlag lets a Config field be set with flag.FlagSet.Var
+type configFlag struct {
+	v reflect.Value
+}
+
+func (f configFlag) String() string {
+	if !f.v.IsValid() {
+		return ""
+	}
+	return fmt.Sprint(f.v.Interface())
+}
+
+func (f configFlag) Set(s string) error {
+	return setConfigField(f.v, s)
+}
+
+// IsBoolFlag lets boolean settings be given as a bare -name
+func (f configFlag) IsBoolFlag() bool {
+	return f.v.IsValid() && f.v.Kind() == reflect.Bool
+}
+
+// setConfigField parses s into the Config field v
+func setConfigField(v reflect.Value, s string) error {
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return json.Unmarshal([]byte(s), v.Addr().Interface())
+		}
+		var items []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return json.Unmarshal([]byte(s), v.Addr().Interface())
+	}
+	return nil
+}
+
+// setConfigJSON sets the Config field v from a config file value. Durations
+// are written as strings like "15s"; everything else as its JSON form.
+func setConfigJSON(v reflect.Value, raw json.RawMessage) error {
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return fmt.Errorf("expected a duration like \"15s\"")
+		}
+		return setConfigField(v, s)
+	}
+	return json.Unmarshal(raw, v.Addr().Interface())
+}
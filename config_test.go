@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateLoginLockout(t *testing.T) {
+	tests := []struct {
+		failures int
+		duration time.Duration
+		wantErr  string
+	}{
+		{5, 15 * time.Minute, ""},
+		{0, 0, ""},
+		{-1, 15 * time.Minute, "login_lockout_failures"},
+		{5, 0, "login_lockout_duration"},
+	}
+	for _, tt := range tests {
+		c := DefaultConfig()
+		c.JWTSecret = "test secret"
+		c.LoginLockoutFailures = tt.failures
+		c.LoginLockoutDuration = tt.duration
+		err := c.Validate()
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("failures %d, duration %v: %v", tt.failures, tt.duration, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("failures %d, duration %v: error %v, want one about %s", tt.failures, tt.duration, err, tt.wantErr)
+		}
+	}
+}
@@ -2,9 +2,12 @@ module server
 
 go 1.22.2
 
-require golang.org/x/crypto v0.26.0
-
 require (
-	github.com/golang-jwt/jwt/v5 v5.2.1 // indirect
-	github.com/lpernett/godotenv v0.0.0-20230527005122-0de1d4c5ef5e // indirect
+	github.com/golang-jwt/jwt/v5 v5.2.1
+	github.com/lpernett/godotenv v0.0.0-20230527005122-0de1d4c5ef5e
+	github.com/mattn/go-sqlite3 v1.14.22
+	github.com/rivo/uniseg v0.4.7
+	golang.org/x/crypto v0.26.0
 )
+
+require golang.org/x/sys v0.23.0 // indirect
@@ -0,0 +1,30 @@
+package internal
+
+import "time"
+
+// AuditAction names a security-relevant event kept in the audit log
+type AuditAction string
+
+const (
+	// AuditAccountLocked is logged when too many failed logins lock an
+	// account
+	AuditAccountLocked AuditAction = "account_locked"
+	// AuditAccountUnlocked is logged when an admin lifts a lockout
+	AuditAccountUnlocked AuditAction = "account_unlocked"
+	// AuditPasswordReset is logged when a user sets a new password with a
+	// password reset token
+	AuditPasswordReset AuditAction = "password_reset"
+)
+
+// AuditEntry is one event in the audit log. UserID is the account the event
+// is about, if it exists, and ActorID the user who caused it, zero when the
+// server acted on its own.
+type AuditEntry struct {
+	ID      int         `json:"id"`
+	Time    time.Time   `json:"time"`
+	Action  AuditAction `json:"action"`
+	ActorID int         `json:"actor_id,omitempty"`
+	UserID  int         `json:"user_id,omitempty"`
+	Email   string      `json:"email,omitempty"`
+	IP      string      `json:"ip,omitempty"`
+}
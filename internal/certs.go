@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertReloader serves a TLS certificate from a certificate and key file pair
+// and picks up new files, e.g. after a renewal, without a restart. Use its
+// GetCertificate method as tls.Config.GetCertificate.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	mux      sync.RWMutex
+	cert     *tls.Certificate
+	certMod  time.Time
+	keyMod   time.Time
+}
+
+// NewCertReloader loads the certificate and key at certFile and keyFile
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload rereads the certificate and key files. On error the previously
+// loaded certificate stays in use.
+func (c *CertReloader) Reload() error {
+	certMod, keyMod, err := c.modTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.mux.Lock()
+	c.cert = &cert
+	c.certMod = certMod
+	c.keyMod = keyMod
+	c.mux.Unlock()
+	return nil
+}
+
+// Watch reloads the certificate whenever either file's modification time
+// changes, checking every interval until stop is closed. A half-written pair
+// fails to load and is retried on the next tick.
+func (c *CertReloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			certMod, keyMod, err := c.modTimes()
+			if err != nil {
+				slog.Error("cannot check TLS certificate", "cert", c.certFile, "error", err)
+				continue
+			}
+			c.mux.RLock()
+			unchanged := certMod.Equal(c.certMod) && keyMod.Equal(c.keyMod)
+			c.mux.RUnlock()
+			if unchanged {
+				continue
+			}
+			if err := c.Reload(); err != nil {
+				slog.Error("cannot reload TLS certificate", "cert", c.certFile, "error", err)
+				continue
+			}
+			slog.Info("reloaded TLS certificate", "cert", c.certFile)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// GetCertificate returns the current certificate
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.cert, nil
+}
+
+func (c *CertReloader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
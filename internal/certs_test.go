@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for localhost with the given
+// common name to certFile and keyFile and returns it
+func writeTestCert(t *testing.T, certFile, keyFile, commonName string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestCertReloaderServesNewCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	first := writeTestCert(t, certFile, keyFile, "first")
+
+	c, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("NewCertReloader: %v", err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go c.Watch(10*time.Millisecond, stop)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{GetCertificate: c.GetCertificate}
+	srv.StartTLS()
+	defer srv.Close()
+
+	peerName := func(roots *x509.CertPool) (string, error) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "localhost"},
+		}}
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+		return resp.TLS.PeerCertificates[0].Subject.CommonName, nil
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(first)
+	if name, err := peerName(roots); err != nil || name != "first" {
+		t.Fatalf("before reload got %q, %v; want first", name, err)
+	}
+
+	// make sure the new files get a different modification time
+	time.Sleep(20 * time.Millisecond)
+	second := writeTestCert(t, certFile, keyFile, "second")
+	later := time.Now().Add(time.Second)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	roots = x509.NewCertPool()
+	roots.AddCert(second)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		name, err := peerName(roots)
+		if err == nil && name == "second" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("certificate not reloaded: got %q, %v", name, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestCertReloaderKeepsCertificateOnBadFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, "first")
+
+	c, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("NewCertReloader: %v", err)
+	}
+	if err := os.WriteFile(keyFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Reload(); err == nil {
+		t.Fatal("Reload succeeded with a broken key file")
+	}
+	cert, _ := c.GetCertificate(nil)
+	if cert == nil || len(cert.Certificate) == 0 {
+		t.Fatal("lost the previous certificate")
+	}
+}
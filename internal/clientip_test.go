@@ -0,0 +1,37 @@
+package internal
+
+import "testing"
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8", " 192.0.2.1", "::1"})
+	if err != nil {
+		t.Fatalf("ParseTrustedProxies: %v", err)
+	}
+	for _, tc := range []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		want         string
+	}{
+		{"direct", "203.0.113.7:4000", nil, "203.0.113.7"},
+		{"untrusted peer's header ignored", "203.0.113.7:4000", []string{"1.1.1.1"}, "203.0.113.7"},
+		{"trusted proxy", "10.1.2.3:4000", []string{"198.51.100.2"}, "198.51.100.2"},
+		{"chain of proxies", "10.1.2.3:4000", []string{"198.51.100.2, 192.0.2.1", "10.9.9.9"}, "198.51.100.2"},
+		{"spoofed hop left of the client", "10.1.2.3:4000", []string{"1.1.1.1, 198.51.100.2"}, "198.51.100.2"},
+		{"only proxies", "10.1.2.3:4000", []string{"10.0.0.1"}, "10.0.0.1"},
+		{"garbage hop", "10.1.2.3:4000", []string{"198.51.100.2, nonsense"}, "10.1.2.3"},
+		{"ipv6 proxy", "[::1]:4000", []string{"2001:db8::1"}, "2001:db8::1"},
+		{"mapped ipv4", "[::ffff:10.1.2.3]:4000", []string{"198.51.100.2"}, "198.51.100.2"},
+	} {
+		if got := proxies.ClientIP(tc.remoteAddr, tc.forwardedFor); got != tc.want {
+			t.Errorf("%s: ClientIP = %s, want %s", tc.name, got, tc.want)
+		}
+	}
+
+	if _, err := ParseTrustedProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("bad prefix accepted")
+	}
+	if _, err := ParseTrustedProxies([]string{"proxy.example.com"}); err == nil {
+		t.Error("hostname accepted")
+	}
+}
@@ -1,231 +1,577 @@
 package internal
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"slices"
 	"sort"
-	"strconv"
 	"sync"
 	"time"
 )
 
+// DB is a Store that keeps the whole database in memory and persists it as a
+// single JSON file. Reads are served from memory. Writes are saved to disk
+// immediately, or, when a snapshot interval is set, marked dirty and flushed
+// by a background loop and on Close.
 type DB struct {
 	path string
 	mux  *sync.RWMutex
+	data DBStructure
+	// chirps indexes data.Chirps by ID for paging and search indexes their
+	// bodies. Both are guarded by mux, kept in sync by Update and rebuilt
+	// from the file at startup.
+	chirps *chirpIndex
+	search *searchIndex
+
+	// version counts committed Updates not yet written to disk. It is
+	// guarded by mux; savedVersion is guarded by flushMux.
+	version      uint64
+	savedVersion uint64
+	flushMux     sync.Mutex
+
+	snapshotInterval time.Duration
+	stop             chan struct{}
+	done             chan struct{}
+
+	// lock is held open for as long as the database is, so that a second
+	// process can't load the file and overwrite the first one's changes
+	lock *os.File
+}
+
+// ErrDBLocked is returned by NewDB when another process has the JSON
+// database open
+var ErrDBLocked = errors.New("database is in use by another process")
+
+// lockDB takes the lock of the JSON database at path, held for as long as
+// the returned file is open
+func lockDB(path string) (*os.File, error) {
+	lock, err := lockFile(path + ".lock")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return lock, nil
+}
+
+// DBOption configures optional DB behaviour in NewDB
+type DBOption func(*DB)
+
+// WithSnapshotInterval keeps writes in memory and persists them every
+// interval instead of on each change. Changes made since the last snapshot
+// are lost if the process dies without calling Close. A zero interval keeps
+// the default write-through behaviour.
+func WithSnapshotInterval(interval time.Duration) DBOption {
+	return func(db *DB) {
+		db.snapshotInterval = interval
+	}
 }
 
 type DBStructure struct {
-	Chirps map[int]Chirp `json:"chirps"`
-	Users map[int]User `json:"users"`
+	SchemaVersion int           `json:"schema_version"`
+	Chirps        map[int]Chirp `json:"chirps"`
+	Users         map[int]User  `json:"users"`
+	// ChirpHistory holds the previous bodies of edited chirps, oldest first
+	ChirpHistory map[int][]ChirpRevision `json:"chirp_history"`
+	// ChirpFlags holds the chirps awaiting moderator review
+	ChirpFlags map[int]ChirpFlag `json:"chirp_flags"`
+	// Sessions holds every logged-in device
+	Sessions map[int]Session `json:"sessions"`
+	// DeniedTokens maps the jti of each revoked access token to its expiry
+	DeniedTokens map[string]time.Time `json:"denied_tokens"`
+	// AuditLog holds security-relevant events such as account lockouts
+	AuditLog map[int]AuditEntry `json:"audit_log"`
+	// PasswordResets holds outstanding password resets by token hash
+	PasswordResets map[string]PasswordReset `json:"password_resets"`
 }
 
 type Chirp struct {
-	Body string `json:"body"`
-	ID int `json:"id"`
-	AuthorID int `json:"author_id"`
+	Body      string    `json:"body"`
+	ID        int       `json:"id"`
+	AuthorID  int       `json:"author_id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ChirpRevision is a body a chirp had before it was edited
+type ChirpRevision struct {
+	Body       string    `json:"body"`
+	PostedAt   time.Time `json:"posted_at"`
+	ReplacedAt time.Time `json:"replaced_at"`
+}
+
+// ChirpFlag records why a chirp was queued for review
+type ChirpFlag struct {
+	Words     []string  `json:"words"`
+	FlaggedAt time.Time `json:"flagged_at"`
 }
 
+// FlaggedChirp is a chirp awaiting review together with its flag
+type FlaggedChirp struct {
+	Chirp     Chirp     `json:"chirp"`
+	Words     []string  `json:"words"`
+	FlaggedAt time.Time `json:"flagged_at"`
+}
 
 type User struct {
-	Email string `json:"email"`
-	ID int `json:"id"`
-	Password string `json:"password"`
-	RefreshToken string `json:"refresh_token"`
-	RefreshExpiry time.Time `json:"refresh_expiry"`
-	IsChirpyRed bool `json:"is_chirpy_red"`
+	Email       string `json:"email"`
+	ID          int    `json:"id"`
+	Password    string `json:"password"`
+	IsChirpyRed bool   `json:"is_chirpy_red"`
+	Role        Role   `json:"role"`
 }
 
 type UpdateUserParams struct {
-    Email        string
-    Password     string
-    RefreshToken string
-	RefreshExpiry time.Time
-} 
+	Email string
+	// Password is the hash of the new password
+	Password string
+}
 
-type UserExternal struct {
-	Email string `json:"email"`
-	ID int `json:"id"`
-	IsChirpyRed bool `json:"is_chirpy_red"`
+// Session is a device a user is logged in on. It is looked up by the hash
+// of its current refresh token; the token itself is never stored. Every
+// refresh replaces the token, and the hashes of the last few replaced tokens
+// are kept so their reuse can be detected.
+type Session struct {
+	ID            int       `json:"id"`
+	UserID        int       `json:"user_id"`
+	TokenHash     string    `json:"token_hash"`
+	RetiredHashes []string  `json:"retired_hashes,omitempty"`
+	UserAgent     string    `json:"user_agent"`
+	IP            string    `json:"ip"`
+	CreatedAt     time.Time `json:"created_at"`
+	LastUsedAt    time.Time `json:"last_used_at"`
+	ExpiresAt     time.Time `json:"expires_at"`
 }
 
+// PasswordReset lets a user who forgot their password set a new one. It is
+// looked up by the hash of the token mailed to them.
+type PasswordReset struct {
+	TokenHash string    `json:"token_hash"`
+	UserID    int       `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type UserExternal struct {
+	Email       string `json:"email"`
+	ID          int    `json:"id"`
+	IsChirpyRed bool   `json:"is_chirpy_red"`
+	Role        Role   `json:"role"`
+}
 
 func DbUsertoUserX(dbUser User) UserExternal {
-    return UserExternal{
-        ID:       dbUser.ID,
-        Email:    dbUser.Email,
+	return UserExternal{
+		ID:          dbUser.ID,
+		Email:       dbUser.Email,
 		IsChirpyRed: dbUser.IsChirpyRed,
-    }
+		Role:        dbUser.Role,
+	}
 }
 
 // NewDB creates a new database connection
-// and creates the database file if it doesn't exist
-func NewDB(path string) (*DB, error){
+// and creates the database file if it doesn't exist. Only one process can
+// have the file open at a time; NewDB fails with ErrDBLocked while another
+// one does.
+func NewDB(path string, opts ...DBOption) (_ *DB, err error) {
 	db := &DB{
-        path: path,
-        mux:  &sync.RWMutex{},
-    }
-	db.ensureDB()
-	return db, nil
-}	
-
-// CreateChirp creates a new chirp and saves it to disk
-func (db *DB) CreateChirp(body string, userId int) (Chirp, error) {
-	chirps, err := db.GetChirps()
+		path: path,
+		mux:  &sync.RWMutex{},
+	}
+	for _, opt := range opts {
+		opt(db)
+	}
+	db.lock, err = lockDB(path)
 	if err != nil {
-		return Chirp{}, errors.New("an error occurred getting chirps")
+		return nil, err
 	}
-	users, err := db.GetUsers()
+	defer func() {
+		if err != nil {
+			db.lock.Close()
+		}
+	}()
+	if err := replayJournal(path); err != nil {
+		return nil, err
+	}
+	if err := db.ensureDB(); err != nil {
+		return nil, err
+	}
+	report, err := migrate(path, false)
 	if err != nil {
-		return Chirp{}, errors.New("an error occurred getting users")
+		return nil, err
 	}
-	sort.Slice(chirps, func(i, j int) bool{
-		return chirps[i].ID < chirps[j].ID
-	})
-	lastIndex := 0
-	if len(chirps) > 0 {
-		lastIndex = chirps[len(chirps)-1].ID
+	if len(report.Steps) > 0 {
+		slog.Info("migrated database", "path", path, "from_version", report.FromVersion, "to_version", report.ToVersion)
 	}
-	newChirp := Chirp{
-		ID: lastIndex+1,
-		Body: body,
-		AuthorID: userId,
+	data, err := db.loadDB()
+	if err != nil {
+		return nil, err
 	}
-	chirps = append(chirps, newChirp)
-	dbContent := DBStructure{}
-	dbContent.Chirps = make(map[int]Chirp)
-	dbContent.Users = make(map[int]User)
-	for _,chirp := range chirps{
-		dbContent.Chirps[chirp.ID] = chirp
+	db.data = data
+	db.chirps = newChirpIndex(data.Chirps)
+	db.search = newSearchIndex(data.Chirps)
+	if db.snapshotInterval > 0 {
+		db.stop = make(chan struct{})
+		db.done = make(chan struct{})
+		go db.snapshotLoop()
 	}
-	for _,user := range users{
-		dbContent.Users[user.ID] = user
+	return db, nil
+}
+
+// Close stops the snapshot loop, if any, flushes pending changes and lets
+// other processes open the database
+func (db *DB) Close() error {
+	if db.stop != nil {
+		close(db.stop)
+		<-db.done
+		db.stop = nil
 	}
-	db.writeDB(dbContent)
-	return newChirp, nil
+	err := db.Flush()
+	if db.lock != nil {
+		db.lock.Close()
+		db.lock = nil
+	}
+	return err
 }
 
-// GetChirps returns all chirps in the database
-func (db *DB) GetChirps() ([]Chirp, error) {
-	dbContent, err := db.loadDB()
+func (db *DB) snapshotLoop() {
+	defer close(db.done)
+	ticker := time.NewTicker(db.snapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := db.Flush(); err != nil {
+				slog.Error("cannot save database snapshot", "path", db.path, "error", err)
+			}
+		case <-db.stop:
+			return
+		}
+	}
+}
+
+// Flush writes the in-memory database to disk if it has changed since the
+// last snapshot. Readers are only blocked while the contents are encoded.
+func (db *DB) Flush() error {
+	db.flushMux.Lock()
+	defer db.flushMux.Unlock()
+
+	db.mux.RLock()
+	version := db.version
+	if version == db.savedVersion {
+		db.mux.RUnlock()
+		return nil
+	}
+	data, err := json.Marshal(db.data)
+	db.mux.RUnlock()
 	if err != nil {
-		return []Chirp{},err
+		return errors.New("cannot Marshal file")
 	}
-	chirpSlice := []Chirp{}
-	for _, chirp := range dbContent.Chirps{
-		chirpSlice = append(chirpSlice, chirp)
+	if err := db.saveSnapshot(data); err != nil {
+		return err
 	}
-	return chirpSlice, nil
+	db.savedVersion = version
+	return nil
 }
 
-// GetChirps returns all chirps in the database
-func (db *DB) GetUsers() ([]User, error) {
-	dbContent, err := db.loadDB()
-	if err != nil {
-		return []User{},err
+// View runs fn against the in-memory database while holding the read lock.
+// fn must not modify the structure it is given.
+func (db *DB) View(fn func(*DBStructure) error) error {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return fn(&db.data)
+}
+
+// Update runs fn against the database while holding the write lock for the
+// whole read-modify-write. fn changes the database in place, and the changes
+// are undone if fn returns an error or the write to disk fails, so that
+// nothing changes. Failures are logged with the logger carried by ctx.
+func (db *DB) Update(ctx context.Context, fn func(*dbTx) error) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	tx := &dbTx{DBStructure: &db.data}
+	if err := fn(tx); err != nil {
+		tx.rollback()
+		return err
 	}
-	chirpSlice := []User{}
-	for _, user := range dbContent.Users{
-		chirpSlice = append(chirpSlice, user)
+	if db.snapshotInterval == 0 {
+		if err := db.writeDB(db.data); err != nil {
+			tx.rollback()
+			Logger(ctx).Error("cannot write database", "path", db.path, "error", err)
+			return err
+		}
+		Logger(ctx).Debug("database written", "path", db.path)
+	} else {
+		db.version++
 	}
-	return chirpSlice, nil
+	if len(tx.chirpsBefore) > 0 {
+		before, after := map[int]Chirp{}, map[int]Chirp{}
+		for id, old := range tx.chirpsBefore {
+			if old != nil {
+				before[id] = *old
+			}
+			if chirp, ok := tx.Chirps[id]; ok {
+				after[id] = chirp
+			}
+		}
+		db.chirps.apply(before, after)
+		db.search.apply(before, after)
+	}
+	return nil
+}
+
+// dbTx is the database as an Update sees it. fn may read the maps directly
+// but must make every change through put and remove, which record how to
+// undo it, and change chirps through putChirp and removeChirp, which also
+// note the chirps changed so that only those are reindexed.
+type dbTx struct {
+	*DBStructure
+	undo []func()
+	// chirpsBefore holds each changed chirp as it was before the Update,
+	// nil if it didn't exist
+	chirpsBefore map[int]*Chirp
+}
+
+// put sets m[k] to v
+func put[K comparable, V any](tx *dbTx, m map[K]V, k K, v V) {
+	old, ok := m[k]
+	tx.undo = append(tx.undo, func() {
+		if ok {
+			m[k] = old
+		} else {
+			delete(m, k)
+		}
+	})
+	m[k] = v
+}
+
+// remove deletes k from m
+func remove[K comparable, V any](tx *dbTx, m map[K]V, k K) {
+	old, ok := m[k]
+	if !ok {
+		return
+	}
+	tx.undo = append(tx.undo, func() { m[k] = old })
+	delete(m, k)
+}
+
+// rollback undoes every change, newest first
+func (tx *dbTx) rollback() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i]()
+	}
+	tx.undo = nil
+}
+
+func (tx *dbTx) putChirp(chirp Chirp) {
+	tx.noteChirp(chirp.ID)
+	put(tx, tx.Chirps, chirp.ID, chirp)
+}
+
+func (tx *dbTx) removeChirp(id int) {
+	tx.noteChirp(id)
+	remove(tx, tx.Chirps, id)
 }
 
+func (tx *dbTx) noteChirp(id int) {
+	if tx.chirpsBefore == nil {
+		tx.chirpsBefore = map[int]*Chirp{}
+	}
+	if _, ok := tx.chirpsBefore[id]; ok {
+		return
+	}
+	var old *Chirp
+	if chirp, ok := tx.Chirps[id]; ok {
+		old = &chirp
+	}
+	tx.chirpsBefore[id] = old
+}
 
 // CreateChirp creates a new chirp and saves it to disk
-func (db *DB) CreateUser(email, password string) (UserExternal, error) {
-	users, err := db.GetUsers()
+func (db *DB) CreateChirp(ctx context.Context, body string, userId int) (Chirp, error) {
+	var newChirp Chirp
+	err := db.Update(ctx, func(dbs *dbTx) error {
+		now := time.Now().UTC()
+		newChirp = Chirp{
+			ID:        lastID(dbs.Chirps) + 1,
+			Body:      body,
+			AuthorID:  userId,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		dbs.putChirp(newChirp)
+		return nil
+	})
 	if err != nil {
-		return UserExternal{}, errors.New("an error occurred getting users")
+		return Chirp{}, err
 	}
-	chirps, err := db.GetChirps()
+	return newChirp, nil
+}
+
+// GetChirps returns all chirps in the database
+func (db *DB) GetChirps(ctx context.Context) ([]Chirp, error) {
+	chirpSlice := []Chirp{}
+	err := db.View(func(dbs *DBStructure) error {
+		for _, chirp := range dbs.Chirps {
+			chirpSlice = append(chirpSlice, chirp)
+		}
+		return nil
+	})
 	if err != nil {
-		return UserExternal{}, errors.New("an error occurred getting chirps")
+		return []Chirp{}, err
 	}
-	sort.Slice(users, func(i, j int) bool{
-		return users[i].ID < users[j].ID
+	return chirpSlice, nil
+}
+
+// CountChirps returns the number of chirps in the database
+func (db *DB) CountChirps(ctx context.Context) (int, error) {
+	var n int
+	err := db.View(func(dbs *DBStructure) error {
+		n = len(dbs.Chirps)
+		return nil
 	})
-	lastIndex := 0
-	if len(users) > 0 {
-		lastIndex = users[len(users)-1].ID
-		if _,ok := db.GetSingleUserByEmail(email); ok{
-			return UserExternal{}, errors.New("User already exists")
+	return n, err
+}
+
+// GetChirpsPage returns one page of chirps using the resident ID index, so
+// only the chirps on the page are looked at
+func (db *DB) GetChirpsPage(ctx context.Context, q ChirpQuery) (ChirpPage, error) {
+	page := ChirpPage{Chirps: []Chirp{}}
+	err := db.View(func(dbs *DBStructure) error {
+		ids, more := db.chirps.page(q)
+		for _, id := range ids {
+			page.Chirps = append(page.Chirps, dbs.Chirps[id])
 		}
+		if more && len(ids) > 0 {
+			page.NextAfterID = ids[len(ids)-1]
+		}
+		return nil
+	})
+	return page, err
+}
+
+// SearchChirps returns up to limit chirps matching query, most relevant
+// first. Bare words must all appear; "quoted phrases" must appear verbatim.
+func (db *DB) SearchChirps(ctx context.Context, query string, limit int) ([]Chirp, error) {
+	chirps := []Chirp{}
+	err := db.View(func(dbs *DBStructure) error {
+		for _, id := range db.search.search(query) {
+			if len(chirps) == limit {
+				break
+			}
+			chirps = append(chirps, dbs.Chirps[id])
+		}
+		return nil
+	})
+	return chirps, err
+}
+
+// GetUsers returns all users in the database
+func (db *DB) GetUsers(ctx context.Context) ([]User, error) {
+	userSlice := []User{}
+	err := db.View(func(dbs *DBStructure) error {
+		for _, user := range dbs.Users {
+			userSlice = append(userSlice, user)
+		}
+		return nil
+	})
+	if err != nil {
+		return []User{}, err
 	}
-	pass, _ := HashPassword(password)
-	newUser := User{
-		ID: lastIndex+1,
-		Email: email,
-		Password: pass,
-	}
-	users = append(users, newUser)
-	dbContent := DBStructure{}
-	dbContent.Users = make(map[int]User)
-	dbContent.Chirps = make(map[int]Chirp)
-	for _,user := range users{
-		dbContent.Users[user.ID] = user
-	}
-	for _,chirp := range chirps{
-		dbContent.Chirps[chirp.ID] = chirp
+	return userSlice, nil
+}
+
+// CountUsers returns the number of users in the database
+func (db *DB) CountUsers(ctx context.Context) (int, error) {
+	var n int
+	err := db.View(func(dbs *DBStructure) error {
+		n = len(dbs.Users)
+		return nil
+	})
+	return n, err
+}
+
+// CreateUser creates a new user and saves it to disk
+func (db *DB) CreateUser(ctx context.Context, email, passwordHash string) (UserExternal, error) {
+	var newUser User
+	err := db.Update(ctx, func(dbs *dbTx) error {
+		for _, user := range dbs.Users {
+			if user.Email == email {
+				return errors.New("User already exists")
+			}
+		}
+		newUser = User{
+			ID:       lastID(dbs.Users) + 1,
+			Email:    email,
+			Password: passwordHash,
+			Role:     RoleUser,
+		}
+		put(dbs, dbs.Users, newUser.ID, newUser)
+		return nil
+	})
+	if err != nil {
+		return UserExternal{}, err
 	}
-	db.writeDB(dbContent)
 	return DbUsertoUserX(newUser), nil
 }
 
-func (db *DB) GetSingleUserByEmail(email string) (User, bool) {
-	dbstructure,err := db.loadDB()
-	if err != nil{
-		return  User{},false
-	}
-	
-	for _,user := range dbstructure.Users{
-		if user.Email == email{
-			return user, true
+func (db *DB) GetSingleUserByEmail(ctx context.Context, email string) (User, bool) {
+	var found User
+	ok := false
+	db.View(func(dbs *DBStructure) error {
+		for _, user := range dbs.Users {
+			if user.Email == email {
+				found, ok = user, true
+				return nil
+			}
 		}
-	}
-	return User{},false
+		return nil
+	})
+	return found, ok
 }
 
 // ensureDB creates a new database file if it doesn't exist
 func (db *DB) ensureDB() error {
 	if _, err := os.Stat(db.path); errors.Is(err, os.ErrNotExist) {
-		initialContent := []byte("{\"chirps\":{}, \"users\":{}}")
-		err := os.WriteFile(db.path, initialContent, 0666)
-		if err != nil {
-			log.Fatalf("%v", err)
-		}
+		initialContent := fmt.Sprintf(`{"schema_version":%d, "chirps":{}, "users":{}, "chirp_history":{}, "chirp_flags":{}, "sessions":{}, "denied_tokens":{}, "audit_log":{}, "password_resets":{}}`, CurrentSchemaVersion)
+		return writeFileAtomic(db.path, []byte(initialContent))
 	}
 	return nil
 }
 
 func (db *DB) deleteDB() error {
-	if _, err := os.Stat(db.path); err == nil {
-		err := os.Remove(db.path)
-		if err != nil {
-			log.Fatalf("%v", err)
-		}
+	if err := os.Remove(db.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
 	}
-	return nil
+	return clearJournal(db.path)
 }
 
-func (db *DB) ResetDB() error {
-	err := db.deleteDB()
-	if err != nil {
-		log.Fatalf("%v", err)
+// ResetDB deletes the database file and recreates it empty
+func (db *DB) ResetDB(ctx context.Context) error {
+	db.flushMux.Lock()
+	defer db.flushMux.Unlock()
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	if err := db.deleteDB(); err != nil {
+		return err
 	}
-	err = db.ensureDB()
+	if err := db.ensureDB(); err != nil {
+		return err
+	}
+	data, err := db.loadDB()
 	if err != nil {
-		log.Fatalf("%v", err)
+		return err
 	}
+	db.data = data
+	db.chirps = newChirpIndex(data.Chirps)
+	db.search = newSearchIndex(data.Chirps)
+	db.savedVersion = db.version
 	return nil
 }
 
-// loadDB reads the database file into memory
-func (db *DB) loadDB() (DBStructure, error){
-	db.mux.Lock()
-	defer db.mux.Unlock()
+// loadDB reads and parses the database file
+func (db *DB) loadDB() (DBStructure, error) {
 	dbContent := DBStructure{}
 	content, err := os.ReadFile(db.path)
 	if err != nil {
@@ -235,150 +581,460 @@ func (db *DB) loadDB() (DBStructure, error){
 	if jerr != nil {
 		return dbContent, jerr
 	}
+	if dbContent.Chirps == nil {
+		dbContent.Chirps = make(map[int]Chirp)
+	}
+	if dbContent.Users == nil {
+		dbContent.Users = make(map[int]User)
+	}
+	if dbContent.ChirpHistory == nil {
+		dbContent.ChirpHistory = make(map[int][]ChirpRevision)
+	}
+	if dbContent.ChirpFlags == nil {
+		dbContent.ChirpFlags = make(map[int]ChirpFlag)
+	}
+	if dbContent.Sessions == nil {
+		dbContent.Sessions = make(map[int]Session)
+	}
+	if dbContent.DeniedTokens == nil {
+		dbContent.DeniedTokens = make(map[string]time.Time)
+	}
+	if dbContent.AuditLog == nil {
+		dbContent.AuditLog = make(map[int]AuditEntry)
+	}
+	if dbContent.PasswordResets == nil {
+		dbContent.PasswordResets = make(map[string]PasswordReset)
+	}
 	return dbContent, nil
 }
 
 // writeDB writes the database file to disk
 func (db *DB) writeDB(dbStructure DBStructure) error {
-	db.mux.Lock()
-	defer db.mux.Unlock()
 	data, err := json.Marshal(dbStructure)
 	if err != nil {
 		return errors.New("cannot Marshal file")
 	}
-	err = os.WriteFile(db.path, data, 0666)
-	if err != nil {
-		return errors.New("cannot save new chirp to file")
-	}
-	return nil
+	return db.saveSnapshot(data)
 }
 
-func (db *DB) GetSingleChirp(id int) (Chirp, bool) {
-	dbstructure,err := db.loadDB()
-	if err != nil{
-		return  Chirp{},false
+// saveSnapshot replaces the database file with data via the journal
+func (db *DB) saveSnapshot(data []byte) error {
+	if err := writeJournal(db.path, data); err != nil {
+		return err
 	}
-	chirp, ok := dbstructure.Chirps[id]
-	if !ok {
-		return Chirp{},false
+	if err := writeFileAtomic(db.path, data); err != nil {
+		return err
 	}
-	return chirp, true
+	return clearJournal(db.path)
 }
-func (db *DB) GetSingleUser(id int) (User, bool) {
-	dbstructure,err := db.loadDB()
-	if err != nil{
-		return  User{},false
+
+// lastID returns the highest key in m, or 0 if m is empty
+func lastID[T any](m map[int]T) int {
+	last := 0
+	for id := range m {
+		if id > last {
+			last = id
+		}
 	}
-	user, ok := dbstructure.Users[id]
-	if !ok {
-		return User{},false
+	return last
+}
+
+func (db *DB) GetSingleChirp(ctx context.Context, id int) (Chirp, bool) {
+	var chirp Chirp
+	ok := false
+	db.View(func(dbs *DBStructure) error {
+		chirp, ok = dbs.Chirps[id]
+		return nil
+	})
+	return chirp, ok
+}
+func (db *DB) GetSingleUser(ctx context.Context, id int) (User, bool) {
+	var user User
+	ok := false
+	db.View(func(dbs *DBStructure) error {
+		user, ok = dbs.Users[id]
+		return nil
+	})
+	return user, ok
+}
+func (db *DB) UpdateSingleUser(ctx context.Context, id int, params UpdateUserParams) (UserExternal, error) {
+	var updated User
+	err := db.Update(ctx, func(dbs *dbTx) error {
+		usr, ok := dbs.Users[id]
+		if !ok {
+			return ErrUserNotFound
+		}
+		usr.Email = params.Email
+		usr.Password = params.Password
+		put(dbs, dbs.Users, id, usr)
+		updated = usr
+		return nil
+	})
+	if err != nil {
+		return UserExternal{}, err
 	}
-	return user, true
+	return DbUsertoUserX(updated), nil
 }
-func (db *DB) UpdateSingleUser(id int, params UpdateUserParams, hash bool) (UserExternal,bool) {
-	dbstructure,err := db.loadDB()
-	if err != nil{
-		return  UserExternal{},false
+
+// CreateSession stores a new session and returns it with its ID. Expired
+// sessions are pruned at the same time.
+func (db *DB) CreateSession(ctx context.Context, session Session) (Session, error) {
+	err := db.Update(ctx, func(dbs *dbTx) error {
+		now := time.Now()
+		for id, s := range dbs.Sessions {
+			if s.ExpiresAt.Before(now) {
+				remove(dbs, dbs.Sessions, id)
+			}
+		}
+		session.ID = lastID(dbs.Sessions) + 1
+		put(dbs, dbs.Sessions, session.ID, session)
+		return nil
+	})
+	if err != nil {
+		return Session{}, err
 	}
-	usr, ok := dbstructure.Users[id]
-	if !ok {
-		return UserExternal{},false
+	return session, nil
+}
+
+// RotateSession replaces the refresh token hash of the unexpired session
+// holding tokenHash with newHash and records that it was used. If tokenHash
+// was already rotated out the session is revoked and returned together with
+// ErrRefreshTokenReused.
+func (db *DB) RotateSession(ctx context.Context, tokenHash, newHash string) (Session, error) {
+	var session Session
+	var reused bool
+	err := db.Update(ctx, func(dbs *dbTx) error {
+		for id, s := range dbs.Sessions {
+			if s.TokenHash == tokenHash && !s.ExpiresAt.Before(time.Now()) {
+				s.RetiredHashes = append(slices.Clip(s.RetiredHashes), s.TokenHash)
+				if n := len(s.RetiredHashes); n > maxRetiredTokens {
+					s.RetiredHashes = s.RetiredHashes[n-maxRetiredTokens:]
+				}
+				s.TokenHash = newHash
+				s.LastUsedAt = time.Now().UTC()
+				put(dbs, dbs.Sessions, id, s)
+				session = s
+				return nil
+			}
+			if slices.Contains(s.RetiredHashes, tokenHash) {
+				remove(dbs, dbs.Sessions, id)
+				session, reused = s, true
+				return nil
+			}
+		}
+		return ErrSessionNotFound
+	})
+	if err == nil && reused {
+		err = ErrRefreshTokenReused
 	}
+	return session, err
+}
 
-	pass := params.Password
+// GetUserSessions returns a user's unexpired sessions, oldest first
+func (db *DB) GetUserSessions(ctx context.Context, userid int) ([]Session, error) {
+	sessions := []Session{}
+	err := db.View(func(dbs *DBStructure) error {
+		now := time.Now()
+		for _, s := range dbs.Sessions {
+			if s.UserID == userid && !s.ExpiresAt.Before(now) {
+				sessions = append(sessions, s)
+			}
+		}
+		return nil
+	})
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+	return sessions, err
+}
 
-	if hash{
-		pass, _ = HashPassword(params.Password)
-	}
+// RevokeSession ends one of a user's sessions
+func (db *DB) RevokeSession(ctx context.Context, userid, id int) error {
+	return db.Update(ctx, func(dbs *dbTx) error {
+		s, ok := dbs.Sessions[id]
+		if !ok || s.UserID != userid {
+			return ErrSessionNotFound
+		}
+		remove(dbs, dbs.Sessions, id)
+		return nil
+	})
+}
 
-	refreshToken := params.RefreshToken
-	if refreshToken == ""{
-		refreshToken = usr.RefreshToken
-	}
-	refreshExpiry := params.RefreshExpiry
-	if refreshExpiry.IsZero() {
-		refreshExpiry = usr.RefreshExpiry
-	}
+// RevokeSessionByToken ends the session a refresh token hash belongs to
+func (db *DB) RevokeSessionByToken(ctx context.Context, tokenHash string) error {
+	return db.Update(ctx, func(dbs *dbTx) error {
+		for id, s := range dbs.Sessions {
+			if s.TokenHash == tokenHash {
+				remove(dbs, dbs.Sessions, id)
+				return nil
+			}
+		}
+		return ErrSessionNotFound
+	})
+}
 
-	dbstructure.Users[id] = User{
-		Email: params.Email,
-		Password: pass,
-		ID: id,
-		RefreshToken: refreshToken,
-		RefreshExpiry: refreshExpiry,
-	}
-	db.writeDB(dbstructure)
-	return UserExternal{
-		Email: params.Email,
-		ID: id,
-	},true
+// RevokeUserSessions ends every session of a user
+func (db *DB) RevokeUserSessions(ctx context.Context, userid int) error {
+	return db.Update(ctx, func(dbs *dbTx) error {
+		for id, s := range dbs.Sessions {
+			if s.UserID == userid {
+				remove(dbs, dbs.Sessions, id)
+			}
+		}
+		return nil
+	})
+}
+
+// DenyToken rejects the access token with ID jti until it expires at
+// expiresAt. Entries for tokens that have since expired are pruned at the
+// same time.
+func (db *DB) DenyToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	return db.Update(ctx, func(dbs *dbTx) error {
+		now := time.Now()
+		for id, expiry := range dbs.DeniedTokens {
+			if expiry.Before(now) {
+				remove(dbs, dbs.DeniedTokens, id)
+			}
+		}
+		put(dbs, dbs.DeniedTokens, jti, expiresAt.UTC())
+		return nil
+	})
+}
+
+// IsTokenDenied reports whether the access token with ID jti was revoked
+func (db *DB) IsTokenDenied(ctx context.Context, jti string) (bool, error) {
+	denied := false
+	err := db.View(func(dbs *DBStructure) error {
+		_, denied = dbs.DeniedTokens[jti]
+		return nil
+	})
+	return denied, err
 }
 
-func (db *DB) RefreshToken(token string, secret string) (string, error){
-	dbstructure,err := db.loadDB()
-	if err != nil{
-		return  "",errors.New("failed to read db")
+// CreatePasswordReset stores a password reset, replacing any the user
+// already had. Expired resets are pruned at the same time.
+func (db *DB) CreatePasswordReset(ctx context.Context, reset PasswordReset) error {
+	return db.Update(ctx, func(dbs *dbTx) error {
+		now := time.Now()
+		for hash, r := range dbs.PasswordResets {
+			if r.UserID == reset.UserID || r.ExpiresAt.Before(now) {
+				remove(dbs, dbs.PasswordResets, hash)
+			}
+		}
+		put(dbs, dbs.PasswordResets, reset.TokenHash, reset)
+		return nil
+	})
+}
+
+// GetPasswordReset returns the unexpired password reset with tokenHash
+func (db *DB) GetPasswordReset(ctx context.Context, tokenHash string) (PasswordReset, error) {
+	var reset PasswordReset
+	ok := false
+	db.View(func(dbs *DBStructure) error {
+		reset, ok = dbs.PasswordResets[tokenHash]
+		return nil
+	})
+	if !ok || reset.ExpiresAt.Before(time.Now()) {
+		return PasswordReset{}, ErrResetTokenInvalid
 	}
-	
-	for _,user := range dbstructure.Users{
-		if user.RefreshToken == token && !user.RefreshExpiry.Before(time.Now())  {
-			tokenString, err := CreateJWT(secret,map[string]interface{}{
-				"Expires": 5000, "Subject": strconv.Itoa(user.ID),
-			})
-			if err != nil{
-				return "",errors.New("failed to generate token")
-			}	
-			return tokenString, nil
-		}
-	}
-	return "",errors.New("unexpected error")
-}
-func (db *DB) RevokeToken(token string) (error){
-	dbstructure,err := db.loadDB()
-	if err != nil{
-		return  errors.New("failed to read db")
-	}
-	
-	for _,user := range dbstructure.Users{
-		if user.RefreshToken == token{
-			_, ok := db.UpdateSingleUser(user.ID, UpdateUserParams{
-				Email: user.Email,
-				Password: user.Password,
-				RefreshToken: "0",
-				RefreshExpiry: time.Unix(1,1),
-			}, false)
-			if ok {
-				return nil
+	return reset, nil
+}
+
+// ResetPassword uses up the unexpired password reset with tokenHash to set
+// the user's password hash to passwordHash, and ends all of their sessions.
+// It returns the user's ID.
+func (db *DB) ResetPassword(ctx context.Context, tokenHash, passwordHash string) (int, error) {
+	var userID int
+	err := db.Update(ctx, func(dbs *dbTx) error {
+		reset, ok := dbs.PasswordResets[tokenHash]
+		if !ok || reset.ExpiresAt.Before(time.Now()) {
+			return ErrResetTokenInvalid
+		}
+		user, ok := dbs.Users[reset.UserID]
+		if !ok {
+			return ErrResetTokenInvalid
+		}
+		user.Password = passwordHash
+		put(dbs, dbs.Users, user.ID, user)
+		for hash, r := range dbs.PasswordResets {
+			if r.UserID == user.ID {
+				remove(dbs, dbs.PasswordResets, hash)
 			}
 		}
+		for id, s := range dbs.Sessions {
+			if s.UserID == user.ID {
+				remove(dbs, dbs.Sessions, id)
+			}
+		}
+		userID = user.ID
+		return nil
+	})
+	return userID, err
+}
+
+// AddAuditEntry appends an entry to the audit log and returns it with its ID
+func (db *DB) AddAuditEntry(ctx context.Context, entry AuditEntry) (AuditEntry, error) {
+	err := db.Update(ctx, func(dbs *dbTx) error {
+		entry.ID = lastID(dbs.AuditLog) + 1
+		put(dbs, dbs.AuditLog, entry.ID, entry)
+		return nil
+	})
+	if err != nil {
+		return AuditEntry{}, err
 	}
-	return errors.New("unexpected error")
+	return entry, nil
 }
 
-func (db *DB) DeleteChirp(id, userid int) error {
-	dbstructure,err := db.loadDB()
-	if err != nil{
-		return  errors.New("cannot load db");
+// GetAuditEntries returns up to limit audit log entries, newest first
+func (db *DB) GetAuditEntries(ctx context.Context, limit int) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+	err := db.View(func(dbs *DBStructure) error {
+		for _, entry := range dbs.AuditLog {
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID > entries[j].ID })
+	if len(entries) > limit {
+		entries = entries[:limit]
 	}
-	chirp, ok := dbstructure.Chirps[id]
-	fmt.Println(chirp, userid)
-	if ok && chirp.AuthorID == userid {
-		delete(dbstructure.Chirps, id)
-		db.writeDB(dbstructure)
+	return entries, err
+}
+
+func (db *DB) DeleteChirp(ctx context.Context, id, userid int) error {
+	return db.Update(ctx, func(dbs *dbTx) error {
+		chirp, ok := dbs.Chirps[id]
+		if !ok || chirp.AuthorID != userid {
+			return ErrNotChirpAuthor
+		}
+		dbs.removeChirp(id)
+		remove(dbs, dbs.ChirpHistory, id)
+		remove(dbs, dbs.ChirpFlags, id)
+		return nil
+	})
+}
+
+// DeleteAnyChirp deletes a chirp regardless of its author
+func (db *DB) DeleteAnyChirp(ctx context.Context, id int) error {
+	return db.Update(ctx, func(dbs *dbTx) error {
+		if _, ok := dbs.Chirps[id]; !ok {
+			return ErrChirpNotFound
+		}
+		dbs.removeChirp(id)
+		remove(dbs, dbs.ChirpHistory, id)
+		remove(dbs, dbs.ChirpFlags, id)
+		return nil
+	})
+}
+
+// FlagChirp queues a chirp for review because it contains words
+func (db *DB) FlagChirp(ctx context.Context, id int, words []string) error {
+	return db.Update(ctx, func(dbs *dbTx) error {
+		if _, ok := dbs.Chirps[id]; !ok {
+			return ErrChirpNotFound
+		}
+		put(dbs, dbs.ChirpFlags, id, ChirpFlag{Words: words, FlaggedAt: time.Now().UTC()})
+		return nil
+	})
+}
+
+// GetFlaggedChirps returns the chirps awaiting review, oldest flag first
+func (db *DB) GetFlaggedChirps(ctx context.Context) ([]FlaggedChirp, error) {
+	flagged := []FlaggedChirp{}
+	err := db.View(func(dbs *DBStructure) error {
+		for id, flag := range dbs.ChirpFlags {
+			flagged = append(flagged, FlaggedChirp{
+				Chirp:     dbs.Chirps[id],
+				Words:     flag.Words,
+				FlaggedAt: flag.FlaggedAt,
+			})
+		}
+		return nil
+	})
+	sort.Slice(flagged, func(i, j int) bool {
+		return flagged[i].FlaggedAt.Before(flagged[j].FlaggedAt)
+	})
+	return flagged, err
+}
+
+// ClearChirpFlag removes a chirp from the review queue
+func (db *DB) ClearChirpFlag(ctx context.Context, id int) error {
+	return db.Update(ctx, func(dbs *dbTx) error {
+		if _, ok := dbs.ChirpFlags[id]; !ok {
+			return ErrChirpNotFound
+		}
+		remove(dbs, dbs.ChirpFlags, id)
+		return nil
+	})
+}
+
+// UpdateChirp replaces the body of a chirp owned by userid, keeping the old
+// body in the chirp's history
+func (db *DB) UpdateChirp(ctx context.Context, id, userid int, body string) (Chirp, error) {
+	var updated Chirp
+	err := db.Update(ctx, func(dbs *dbTx) error {
+		chirp, ok := dbs.Chirps[id]
+		if !ok {
+			return ErrChirpNotFound
+		}
+		if chirp.AuthorID != userid {
+			return ErrNotChirpAuthor
+		}
+		now := time.Now().UTC()
+		revision := ChirpRevision{
+			Body:       chirp.Body,
+			PostedAt:   chirp.UpdatedAt,
+			ReplacedAt: now,
+		}
+		// Clip so the append never writes into the committed slice
+		put(dbs, dbs.ChirpHistory, id, append(slices.Clip(dbs.ChirpHistory[id]), revision))
+		chirp.Body = body
+		chirp.UpdatedAt = now
+		dbs.putChirp(chirp)
+		updated = chirp
 		return nil
+	})
+	if err != nil {
+		return Chirp{}, err
 	}
-	return errors.New("cannot find matching user")
+	return updated, nil
 }
 
-func(db *DB) UpgradeUser(userid int) error {
-	dbstructure,err := db.loadDB()
-	if err != nil{
-		return  errors.New("cannot load db");
+// GetChirpHistory returns the previous bodies of a chirp, oldest first
+func (db *DB) GetChirpHistory(ctx context.Context, id int) ([]ChirpRevision, error) {
+	history := []ChirpRevision{}
+	err := db.View(func(dbs *DBStructure) error {
+		if _, ok := dbs.Chirps[id]; !ok {
+			return ErrChirpNotFound
+		}
+		history = append(history, dbs.ChirpHistory[id]...)
+		return nil
+	})
+	if err != nil {
+		return []ChirpRevision{}, err
 	}
-	user, ok := dbstructure.Users[userid]
-	if ok {
+	return history, nil
+}
+
+func (db *DB) UpgradeUser(ctx context.Context, userid int) error {
+	return db.Update(ctx, func(dbs *dbTx) error {
+		user, ok := dbs.Users[userid]
+		if !ok {
+			return ErrUserNotFound
+		}
 		user.IsChirpyRed = true
-		dbstructure.Users[userid] = user // Re-assign the modified user back to the map
-	}
-	return db.writeDB(dbstructure)
-}
\ No newline at end of file
+		put(dbs, dbs.Users, userid, user) // Re-assign the modified user back to the map
+		return nil
+	})
+}
+
+// SetUserRole changes a user's role
+func (db *DB) SetUserRole(ctx context.Context, userid int, role Role) error {
+	return db.Update(ctx, func(dbs *dbTx) error {
+		user, ok := dbs.Users[userid]
+		if !ok {
+			return ErrUserNotFound
+		}
+		user.Role = role
+		put(dbs, dbs.Users, userid, user)
+		return nil
+	})
+}
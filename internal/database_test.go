@@ -0,0 +1,720 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ctx is used for every Store call in the tests
+var ctx = context.Background()
+
+func newTestDB(t *testing.T) *DB {
+	t.Helper()
+	db, err := NewDB(filepath.Join(t.TempDir(), "db.json"))
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	return db
+}
+
+// forEachStore runs test as a subtest against a new JSON database and a new
+// SQLite database
+func forEachStore(t *testing.T, test func(t *testing.T, db Store)) {
+	t.Run("json", func(t *testing.T) {
+		test(t, newTestDB(t))
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		db, err := NewSQLiteDB(filepath.Join(t.TempDir(), "db.sqlite"))
+		if err != nil {
+			t.Fatalf("NewSQLiteDB: %v", err)
+		}
+		defer db.Close()
+		test(t, db)
+	})
+}
+
+func newTestUser(t *testing.T, db Store, email, passwordHash string) UserExternal {
+	t.Helper()
+	user, err := db.CreateUser(ctx, email, passwordHash)
+	if err != nil {
+		t.Fatalf("CreateUser(%s): %v", email, err)
+	}
+	return user
+}
+
+func TestConcurrentCreateChirp(t *testing.T) {
+	db := newTestDB(t)
+	const n = 300
+
+	var wg sync.WaitGroup
+	ids := make(chan int, n)
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			chirp, err := db.CreateChirp(ctx, "hello", 1)
+			if err != nil {
+				errs <- err
+				return
+			}
+			ids <- chirp.ID
+		}()
+	}
+	wg.Wait()
+	close(ids)
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("CreateChirp: %v", err)
+	}
+	seen := map[int]bool{}
+	for id := range ids {
+		if seen[id] {
+			t.Errorf("chirp ID %d handed out twice", id)
+		}
+		seen[id] = true
+	}
+
+	chirps, err := db.GetChirps(ctx)
+	if err != nil {
+		t.Fatalf("GetChirps: %v", err)
+	}
+	if len(chirps) != n {
+		t.Fatalf("got %d chirps on disk, want %d", len(chirps), n)
+	}
+}
+
+func TestConcurrentCreateAndDelete(t *testing.T) {
+	db := newTestDB(t)
+	const n = 200
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			chirp, err := db.CreateChirp(ctx, "short lived", 1)
+			if err != nil {
+				t.Errorf("CreateChirp: %v", err)
+				return
+			}
+			if err := db.DeleteChirp(ctx, chirp.ID, 1); err != nil {
+				t.Errorf("DeleteChirp(%d): %v", chirp.ID, err)
+			}
+		}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := db.GetChirps(ctx); err != nil {
+				t.Errorf("GetChirps: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	chirps, err := db.GetChirps(ctx)
+	if err != nil {
+		t.Fatalf("GetChirps: %v", err)
+	}
+	if len(chirps) != 0 {
+		t.Fatalf("got %d chirps left, want 0", len(chirps))
+	}
+}
+
+func TestUpdateRollsBackOnError(t *testing.T) {
+	db := newTestDB(t)
+	if _, err := db.CreateChirp(ctx, "keep me", 1); err != nil {
+		t.Fatalf("CreateChirp: %v", err)
+	}
+
+	err := db.Update(ctx, func(dbs *dbTx) error {
+		dbs.removeChirp(1)
+		return ErrNotChirpAuthor
+	})
+	if err != ErrNotChirpAuthor {
+		t.Fatalf("Update returned %v, want %v", err, ErrNotChirpAuthor)
+	}
+	if _, ok := db.GetSingleChirp(ctx, 1); !ok {
+		t.Fatal("failed Update was persisted")
+	}
+
+	// Several changes to one key are undone back to the first value
+	err = db.Update(ctx, func(dbs *dbTx) error {
+		dbs.putChirp(Chirp{ID: 1, Body: "first", AuthorID: 1})
+		dbs.putChirp(Chirp{ID: 1, Body: "second", AuthorID: 1})
+		put(dbs, dbs.Users, 1, User{ID: 1, Email: "a@example.com"})
+		return ErrNotChirpAuthor
+	})
+	if err != ErrNotChirpAuthor {
+		t.Fatalf("Update returned %v, want %v", err, ErrNotChirpAuthor)
+	}
+	if chirp, _ := db.GetSingleChirp(ctx, 1); chirp.Body != "keep me" {
+		t.Errorf("chirp body = %q after rollback, want %q", chirp.Body, "keep me")
+	}
+	if _, ok := db.GetSingleUser(ctx, 1); ok {
+		t.Error("user created by a failed Update")
+	}
+}
+
+func TestUpdateRollsBackOnWriteError(t *testing.T) {
+	db := newTestDB(t)
+	if _, err := db.CreateChirp(ctx, "keep me", 1); err != nil {
+		t.Fatalf("CreateChirp: %v", err)
+	}
+	path := db.path
+	db.path = filepath.Join(t.TempDir(), "missing", "db.json")
+	if _, err := db.UpdateChirp(ctx, 1, 1, "lost"); err == nil {
+		t.Fatal("UpdateChirp succeeded without a directory to write to")
+	}
+	db.path = path
+
+	if chirp, _ := db.GetSingleChirp(ctx, 1); chirp.Body != "keep me" {
+		t.Errorf("chirp body = %q after a failed write, want %q", chirp.Body, "keep me")
+	}
+	if history, _ := db.GetChirpHistory(ctx, 1); len(history) != 0 {
+		t.Errorf("history = %v after a failed write, want none", history)
+	}
+	if found, _ := db.SearchChirps(ctx, "lost", 10); len(found) != 0 {
+		t.Errorf("search index has the body of a failed write")
+	}
+}
+
+func TestSnapshotPersistsOnClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.json")
+	db, err := NewDB(path, WithSnapshotInterval(time.Hour))
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	if _, err := db.CreateChirp(ctx, "buffered", 1); err != nil {
+		t.Fatalf("CreateChirp: %v", err)
+	}
+
+	onDisk, err := db.loadDB()
+	if err != nil {
+		t.Fatalf("loadDB: %v", err)
+	}
+	if len(onDisk.Chirps) != 0 {
+		t.Fatalf("chirp written before snapshot")
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	reopened, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	if _, ok := reopened.GetSingleChirp(ctx, 1); !ok {
+		t.Fatal("chirp missing after Close")
+	}
+}
+
+func TestNewDBLocksFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the database is only locked on Unix")
+	}
+	path := filepath.Join(t.TempDir(), "db.json")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	if _, err := NewDB(path); !errors.Is(err, ErrDBLocked) {
+		t.Fatalf("second NewDB = %v, want ErrDBLocked", err)
+	}
+	if _, err := Migrate(path, false); !errors.Is(err, ErrDBLocked) {
+		t.Fatalf("Migrate = %v, want ErrDBLocked", err)
+	}
+	if _, err := Migrate(path, true); err != nil {
+		t.Fatalf("Migrate dry run: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	reopened, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("NewDB after Close: %v", err)
+	}
+	reopened.Close()
+}
+
+func seedChirps(b *testing.B, db *DB, n int) {
+	b.Helper()
+	err := db.Update(ctx, func(dbs *dbTx) error {
+		for i := 1; i <= n; i++ {
+			dbs.putChirp(Chirp{ID: i, Body: "benchmark chirp body", AuthorID: i%10 + 1})
+		}
+		return nil
+	})
+	if err != nil {
+		b.Fatalf("seed: %v", err)
+	}
+}
+
+// BenchmarkGetChirpsFromDisk measures the previous behaviour of re-reading and
+// parsing db.json on every request
+func BenchmarkGetChirpsFromDisk(b *testing.B) {
+	db, err := NewDB(filepath.Join(b.TempDir(), "db.json"))
+	if err != nil {
+		b.Fatalf("NewDB: %v", err)
+	}
+	seedChirps(b, db, 1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dbs, err := db.loadDB()
+		if err != nil {
+			b.Fatal(err)
+		}
+		chirps := []Chirp{}
+		for _, chirp := range dbs.Chirps {
+			chirps = append(chirps, chirp)
+		}
+	}
+}
+
+func BenchmarkGetChirpsCached(b *testing.B) {
+	db, err := NewDB(filepath.Join(b.TempDir(), "db.json"))
+	if err != nil {
+		b.Fatalf("NewDB: %v", err)
+	}
+	seedChirps(b, db, 1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.GetChirps(ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestUpdateChirpKeepsHistory(t *testing.T) {
+	db := newTestDB(t)
+	chirp, err := db.CreateChirp(ctx, "first", 1)
+	if err != nil {
+		t.Fatalf("CreateChirp: %v", err)
+	}
+	if _, err := db.UpdateChirp(ctx, chirp.ID, 2, "hijacked"); err != ErrNotChirpAuthor {
+		t.Fatalf("UpdateChirp by another user returned %v, want %v", err, ErrNotChirpAuthor)
+	}
+	if _, err := db.UpdateChirp(ctx, chirp.ID, 1, "second"); err != nil {
+		t.Fatalf("UpdateChirp: %v", err)
+	}
+	updated, err := db.UpdateChirp(ctx, chirp.ID, 1, "third")
+	if err != nil {
+		t.Fatalf("UpdateChirp: %v", err)
+	}
+	if updated.Body != "third" || !updated.CreatedAt.Equal(chirp.CreatedAt) || !updated.UpdatedAt.After(chirp.CreatedAt) {
+		t.Fatalf("unexpected updated chirp %+v", updated)
+	}
+
+	history, err := db.GetChirpHistory(ctx, chirp.ID)
+	if err != nil {
+		t.Fatalf("GetChirpHistory: %v", err)
+	}
+	if len(history) != 2 || history[0].Body != "first" || history[1].Body != "second" {
+		t.Fatalf("unexpected history %+v", history)
+	}
+	if _, err := db.GetChirpHistory(ctx, chirp.ID+1); err != ErrChirpNotFound {
+		t.Fatalf("GetChirpHistory of missing chirp returned %v, want %v", err, ErrChirpNotFound)
+	}
+}
+
+func TestGetChirpsPage(t *testing.T) {
+	db := newTestDB(t)
+	for i := 0; i < 10; i++ {
+		if _, err := db.CreateChirp(ctx, "chirp", i%2+1); err != nil {
+			t.Fatalf("CreateChirp: %v", err)
+		}
+	}
+	if err := db.DeleteChirp(ctx, 3, 1); err != nil {
+		t.Fatalf("DeleteChirp: %v", err)
+	}
+
+	pageIDs := func(q ChirpQuery) ([]int, int) {
+		t.Helper()
+		page, err := db.GetChirpsPage(ctx, q)
+		if err != nil {
+			t.Fatalf("GetChirpsPage(%+v): %v", q, err)
+		}
+		ids := []int{}
+		for _, c := range page.Chirps {
+			ids = append(ids, c.ID)
+		}
+		return ids, page.NextAfterID
+	}
+
+	tests := []struct {
+		q        ChirpQuery
+		wantIDs  []int
+		wantNext int
+	}{
+		{ChirpQuery{Limit: 4}, []int{1, 2, 4, 5}, 5},
+		{ChirpQuery{Limit: 4, AfterID: 5}, []int{6, 7, 8, 9}, 9},
+		{ChirpQuery{Limit: 4, AfterID: 9}, []int{10}, 0},
+		{ChirpQuery{Limit: 3, Desc: true}, []int{10, 9, 8}, 8},
+		{ChirpQuery{Limit: 3, Desc: true, AfterID: 4}, []int{2, 1}, 0},
+		{ChirpQuery{Limit: 2, AuthorID: 1}, []int{1, 5}, 5},
+		{ChirpQuery{Limit: 10, AuthorID: 1, AfterID: 5}, []int{7, 9}, 0},
+	}
+	for _, tt := range tests {
+		ids, next := pageIDs(tt.q)
+		if !slices.Equal(ids, tt.wantIDs) || next != tt.wantNext {
+			t.Errorf("GetChirpsPage(%+v) = %v next %d, want %v next %d", tt.q, ids, next, tt.wantIDs, tt.wantNext)
+		}
+	}
+}
+
+func TestSessions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		alice := newTestUser(t, db, "alice@example.com", "pw")
+		bob := newTestUser(t, db, "bob@example.com", "pw")
+		now := time.Now().UTC()
+		newSession := func(userID int, hash string, expires time.Time) Session {
+			t.Helper()
+			s, err := db.CreateSession(ctx, Session{
+				UserID: userID, TokenHash: hash, UserAgent: "test", IP: "127.0.0.1",
+				CreatedAt: now, LastUsedAt: now, ExpiresAt: expires,
+			})
+			if err != nil {
+				t.Fatalf("CreateSession: %v", err)
+			}
+			return s
+		}
+		phone := newSession(alice.ID, "phone", now.Add(time.Hour))
+		laptop := newSession(alice.ID, "laptop", now.Add(time.Hour))
+		newSession(alice.ID, "expired", now.Add(-time.Hour))
+		newSession(bob.ID, "bob", now.Add(time.Hour))
+
+		if s, err := db.RotateSession(ctx, "phone", "phone2"); err != nil || s.ID != phone.ID || s.UserID != alice.ID {
+			t.Errorf("RotateSession(phone) = %+v, %v", s, err)
+		}
+		if _, err := db.RotateSession(ctx, "expired", "expired2"); err != ErrSessionNotFound {
+			t.Errorf("RotateSession(expired) = %v, want ErrSessionNotFound", err)
+		}
+		sessions, err := db.GetUserSessions(ctx, alice.ID)
+		if err != nil || len(sessions) != 2 || sessions[0].ID != phone.ID || sessions[1].ID != laptop.ID {
+			t.Fatalf("GetUserSessions = %+v, %v; want phone and laptop", sessions, err)
+		}
+
+		if err := db.RevokeSession(ctx, bob.ID, phone.ID); err != ErrSessionNotFound {
+			t.Errorf("revoking someone else's session = %v, want ErrSessionNotFound", err)
+		}
+		if err := db.RevokeSession(ctx, alice.ID, phone.ID); err != nil {
+			t.Errorf("RevokeSession: %v", err)
+		}
+		if _, err := db.RotateSession(ctx, "phone2", "phone3"); err != ErrSessionNotFound {
+			t.Errorf("revoked session still usable: %v", err)
+		}
+		if _, err := db.RotateSession(ctx, "laptop", "laptop2"); err != nil {
+			t.Errorf("revoking the phone ended the laptop session: %v", err)
+		}
+
+		if err := db.RevokeUserSessions(ctx, alice.ID); err != nil {
+			t.Fatalf("RevokeUserSessions: %v", err)
+		}
+		if sessions, _ := db.GetUserSessions(ctx, alice.ID); len(sessions) != 0 {
+			t.Errorf("sessions left after logging out everywhere: %+v", sessions)
+		}
+		if _, err := db.RotateSession(ctx, "bob", "bob2"); err != nil {
+			t.Errorf("logging alice out everywhere ended bob's session: %v", err)
+		}
+		if err := db.RevokeSessionByToken(ctx, "bob2"); err != nil {
+			t.Errorf("RevokeSessionByToken: %v", err)
+		}
+	})
+}
+
+func TestRotateSessionDetectsReuse(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		user := newTestUser(t, db, "alice@example.com", "pw")
+		now := time.Now().UTC()
+		session, err := db.CreateSession(ctx, Session{
+			UserID: user.ID, TokenHash: "t1", CreatedAt: now, LastUsedAt: now, ExpiresAt: now.Add(time.Hour),
+		})
+		if err != nil {
+			t.Fatalf("CreateSession: %v", err)
+		}
+		for _, step := range [][2]string{{"t1", "t2"}, {"t2", "t3"}} {
+			if _, err := db.RotateSession(ctx, step[0], step[1]); err != nil {
+				t.Fatalf("RotateSession(%s): %v", step[0], err)
+			}
+		}
+		// t1 was stolen and replayed: the whole session goes, so the
+		// legitimate client holding t3 has to log in again too
+		got, err := db.RotateSession(ctx, "t1", "x")
+		if err != ErrRefreshTokenReused || got.ID != session.ID || got.UserID != user.ID {
+			t.Fatalf("reusing t1 = %+v, %v; want the session and ErrRefreshTokenReused", got, err)
+		}
+		if _, err := db.RotateSession(ctx, "t3", "t4"); err != ErrSessionNotFound {
+			t.Errorf("current token after reuse = %v, want ErrSessionNotFound", err)
+		}
+		if _, err := db.RotateSession(ctx, "t2", "x"); err != ErrSessionNotFound {
+			t.Errorf("second reuse = %v, want ErrSessionNotFound", err)
+		}
+	})
+}
+
+func TestRotateSessionKeepsRecentRetiredTokens(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		user := newTestUser(t, db, "alice@example.com", "pw")
+		now := time.Now().UTC()
+		_, err := db.CreateSession(ctx, Session{
+			UserID: user.ID, TokenHash: "t0", CreatedAt: now, LastUsedAt: now, ExpiresAt: now.Add(time.Hour),
+		})
+		if err != nil {
+			t.Fatalf("CreateSession: %v", err)
+		}
+		last := maxRetiredTokens + 5
+		for i := 0; i < last; i++ {
+			if _, err := db.RotateSession(ctx, fmt.Sprintf("t%d", i), fmt.Sprintf("t%d", i+1)); err != nil {
+				t.Fatalf("RotateSession(t%d): %v", i, err)
+			}
+		}
+		// Too old to be remembered: rejected, but the session lives on
+		if _, err := db.RotateSession(ctx, "t0", "x"); err != ErrSessionNotFound {
+			t.Errorf("replaying a forgotten token = %v, want ErrSessionNotFound", err)
+		}
+		if sessions, _ := db.GetUserSessions(ctx, user.ID); len(sessions) != 1 {
+			t.Fatalf("replaying a forgotten token revoked the session")
+		}
+		recent := fmt.Sprintf("t%d", last-maxRetiredTokens)
+		if _, err := db.RotateSession(ctx, recent, "x"); err != ErrRefreshTokenReused {
+			t.Errorf("replaying %s = %v, want ErrRefreshTokenReused", recent, err)
+		}
+	})
+}
+
+func TestDenyToken(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		now := time.Now()
+		if err := db.DenyToken(ctx, "expired", now.Add(-time.Minute)); err != nil {
+			t.Fatalf("DenyToken: %v", err)
+		}
+		if err := db.DenyToken(ctx, "live", now.Add(time.Minute)); err != nil {
+			t.Fatalf("DenyToken: %v", err)
+		}
+		for jti, want := range map[string]bool{"live": true, "other": false, "expired": false} {
+			if denied, err := db.IsTokenDenied(ctx, jti); err != nil || denied != want {
+				t.Errorf("IsTokenDenied(%s) = %v, %v; want %v", jti, denied, err, want)
+			}
+		}
+	})
+}
+
+func TestAuditLog(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		now := time.Now().Truncate(time.Second)
+		for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+			entry, err := db.AddAuditEntry(ctx, AuditEntry{Time: now, Action: AuditAccountLocked, Email: email, IP: "1.2.3.4"})
+			if err != nil {
+				t.Fatalf("AddAuditEntry: %v", err)
+			}
+			if entry.ID == 0 {
+				t.Errorf("AddAuditEntry(%s) returned no ID", email)
+			}
+		}
+		entries, err := db.GetAuditEntries(ctx, 2)
+		if err != nil {
+			t.Fatalf("GetAuditEntries: %v", err)
+		}
+		if len(entries) != 2 || entries[0].Email != "c@example.com" || entries[1].Email != "b@example.com" {
+			t.Fatalf("GetAuditEntries(2) = %+v, want the two newest", entries)
+		}
+		if got := entries[0]; got.Action != AuditAccountLocked || got.IP != "1.2.3.4" || !got.Time.Equal(now) {
+			t.Errorf("entry not stored as added: %+v", got)
+		}
+	})
+}
+
+func TestPasswordReset(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		alice := newTestUser(t, db, "alice@example.com", "old hash")
+		bob := newTestUser(t, db, "bob@example.com", "bob's hash")
+		now := time.Now().UTC()
+		for _, s := range []Session{
+			{UserID: alice.ID, TokenHash: "alice", CreatedAt: now, LastUsedAt: now, ExpiresAt: now.Add(time.Hour)},
+			{UserID: bob.ID, TokenHash: "bob", CreatedAt: now, LastUsedAt: now, ExpiresAt: now.Add(time.Hour)},
+		} {
+			if _, err := db.CreateSession(ctx, s); err != nil {
+				t.Fatalf("CreateSession: %v", err)
+			}
+		}
+
+		for _, reset := range []PasswordReset{
+			{TokenHash: "first", UserID: alice.ID, CreatedAt: now, ExpiresAt: now.Add(time.Hour)},
+			{TokenHash: "second", UserID: alice.ID, CreatedAt: now, ExpiresAt: now.Add(time.Hour)},
+			{TokenHash: "expired", UserID: bob.ID, CreatedAt: now, ExpiresAt: now.Add(-time.Minute)},
+		} {
+			if err := db.CreatePasswordReset(ctx, reset); err != nil {
+				t.Fatalf("CreatePasswordReset: %v", err)
+			}
+		}
+		for hash, want := range map[string]error{"second": nil, "first": ErrResetTokenInvalid, "expired": ErrResetTokenInvalid, "unknown": ErrResetTokenInvalid} {
+			if reset, err := db.GetPasswordReset(ctx, hash); err != want || (err == nil && reset.UserID != alice.ID) {
+				t.Errorf("GetPasswordReset(%s) = %+v, %v; want %v", hash, reset, err, want)
+			}
+		}
+
+		if _, err := db.ResetPassword(ctx, "expired", "new hash"); err != ErrResetTokenInvalid {
+			t.Errorf("ResetPassword(expired) = %v", err)
+		}
+		id, err := db.ResetPassword(ctx, "second", "new hash")
+		if err != nil || id != alice.ID {
+			t.Fatalf("ResetPassword = %d, %v; want %d", id, err, alice.ID)
+		}
+		if user, _ := db.GetSingleUser(ctx, alice.ID); user.Password != "new hash" {
+			t.Errorf("password hash = %q after reset", user.Password)
+		}
+		if _, err := db.ResetPassword(ctx, "second", "newer hash"); err != ErrResetTokenInvalid {
+			t.Errorf("reset token used twice: %v", err)
+		}
+		if sessions, _ := db.GetUserSessions(ctx, alice.ID); len(sessions) != 0 {
+			t.Errorf("%d sessions left after reset", len(sessions))
+		}
+		if sessions, _ := db.GetUserSessions(ctx, bob.ID); len(sessions) != 1 {
+			t.Error("another user's sessions were revoked")
+		}
+		if user, _ := db.GetSingleUser(ctx, bob.ID); user.Password != "bob's hash" {
+			t.Error("another user's password changed")
+		}
+	})
+}
+
+func TestUserResponsesMatchAcrossStores(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		created, err := db.CreateUser(ctx, "alice@example.com", "hash")
+		if err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+		if want := (UserExternal{ID: created.ID, Email: "alice@example.com", Role: RoleUser}); created != want {
+			t.Errorf("CreateUser = %+v, want %+v", created, want)
+		}
+		if err := db.SetUserRole(ctx, created.ID, RoleModerator); err != nil {
+			t.Fatalf("SetUserRole: %v", err)
+		}
+		updated, err := db.UpdateSingleUser(ctx, created.ID, UpdateUserParams{Email: "alice@example.org", Password: "new hash"})
+		if err != nil {
+			t.Fatalf("UpdateSingleUser: %v", err)
+		}
+		if want := (UserExternal{ID: created.ID, Email: "alice@example.org", Role: RoleModerator}); updated != want {
+			t.Errorf("UpdateSingleUser = %+v, want %+v", updated, want)
+		}
+	})
+}
+
+func TestCounts(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		user, err := db.CreateUser(ctx, "alice@example.com", "hash")
+		if err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+		for _, body := range []string{"one", "two", "three"} {
+			if _, err := db.CreateChirp(ctx, body, user.ID); err != nil {
+				t.Fatalf("CreateChirp: %v", err)
+			}
+		}
+		if n, err := db.CountChirps(ctx); n != 3 || err != nil {
+			t.Errorf("CountChirps = %d, %v, want 3", n, err)
+		}
+		if n, err := db.CountUsers(ctx); n != 1 || err != nil {
+			t.Errorf("CountUsers = %d, %v, want 1", n, err)
+		}
+	})
+}
+
+func TestUpdateReindexesChangedChirps(t *testing.T) {
+	db := newTestDB(t)
+	for _, body := range []string{"red fox", "blue fox", "green fox"} {
+		if _, err := db.CreateChirp(ctx, body, 1); err != nil {
+			t.Fatalf("CreateChirp: %v", err)
+		}
+	}
+	if _, err := db.UpdateChirp(ctx, 1, 1, "red dog"); err != nil {
+		t.Fatalf("UpdateChirp: %v", err)
+	}
+	if err := db.DeleteChirp(ctx, 2, 1); err != nil {
+		t.Fatalf("DeleteChirp: %v", err)
+	}
+	if _, err := db.AddAuditEntry(ctx, AuditEntry{Action: AuditAccountLocked}); err != nil {
+		t.Fatalf("AddAuditEntry: %v", err)
+	}
+
+	ids := func(chirps []Chirp) []int {
+		var out []int
+		for _, c := range chirps {
+			out = append(out, c.ID)
+		}
+		return out
+	}
+	for query, want := range map[string][]int{"fox": {3}, "dog": {1}, "blue": nil} {
+		got, err := db.SearchChirps(ctx, query, 10)
+		if err != nil {
+			t.Fatalf("SearchChirps: %v", err)
+		}
+		if !slices.Equal(ids(got), want) {
+			t.Errorf("SearchChirps(%q) = %v, want %v", query, ids(got), want)
+		}
+	}
+	page, err := db.GetChirpsPage(ctx, ChirpQuery{AuthorID: 1, Limit: 10})
+	if err != nil {
+		t.Fatalf("GetChirpsPage: %v", err)
+	}
+	if !slices.Equal(ids(page.Chirps), []int{1, 3}) {
+		t.Errorf("GetChirpsPage = %v, want [1 3]", ids(page.Chirps))
+	}
+}
+
+func TestSQLiteSearch(t *testing.T) {
+	db, err := NewSQLiteDB(filepath.Join(t.TempDir(), "db.sqlite"))
+	if err != nil {
+		t.Fatalf("NewSQLiteDB: %v", err)
+	}
+	defer db.Close()
+	user, err := db.CreateUser(ctx, "alice@example.com", "hash")
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	for _, body := range []string{"a fox", "fox fox fox", "a dog"} {
+		if _, err := db.CreateChirp(ctx, body, user.ID); err != nil {
+			t.Fatalf("CreateChirp: %v", err)
+		}
+	}
+	found, err := db.SearchChirps(ctx, "fox", 1)
+	if err != nil {
+		t.Fatalf("SearchChirps: %v", err)
+	}
+	if len(found) != 1 || found[0].ID != 2 {
+		t.Errorf("SearchChirps(fox, 1) = %+v, want chirp 2", found)
+	}
+
+	// Whatever order concurrent edits commit in, the index ends up with the
+	// body that was committed last
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := db.UpdateChirp(ctx, 3, user.ID, fmt.Sprintf("edit%d", i)); err != nil {
+				t.Errorf("UpdateChirp: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	chirp, _ := db.GetSingleChirp(ctx, 3)
+	for i := 0; i < 20; i++ {
+		body := fmt.Sprintf("edit%d", i)
+		found, err := db.SearchChirps(ctx, body, 10)
+		if err != nil {
+			t.Fatalf("SearchChirps: %v", err)
+		}
+		if want := body == chirp.Body; (len(found) == 1) != want {
+			t.Errorf("SearchChirps(%s) = %+v with stored body %q", body, found, chirp.Body)
+		}
+	}
+}
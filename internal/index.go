@@ -0,0 +1,100 @@
+package internal
+
+import "slices"
+
+// chirpIndex keeps the IDs of the resident chirps sorted, overall and per
+// author, so the JSON database can serve a page of chirps without sorting or
+// filtering the whole collection. DB refreshes it on every commit that
+// changes chirps.
+type chirpIndex struct {
+	ids      []int
+	byAuthor map[int][]int
+}
+
+func newChirpIndex(chirps map[int]Chirp) *chirpIndex {
+	idx := &chirpIndex{byAuthor: make(map[int][]int)}
+	for id, chirp := range chirps {
+		idx.ids = append(idx.ids, id)
+		idx.byAuthor[chirp.AuthorID] = append(idx.byAuthor[chirp.AuthorID], id)
+	}
+	slices.Sort(idx.ids)
+	for _, ids := range idx.byAuthor {
+		slices.Sort(ids)
+	}
+	return idx
+}
+
+// apply brings the index in line with a commit. before and after hold the
+// chirps the commit changed as they were and as they are; one missing from
+// after was deleted, one missing from before was created.
+func (idx *chirpIndex) apply(before, after map[int]Chirp) {
+	for id, old := range before {
+		if cur, ok := after[id]; !ok || cur.AuthorID != old.AuthorID {
+			idx.remove(old)
+		}
+	}
+	for id, cur := range after {
+		if old, ok := before[id]; !ok || cur.AuthorID != old.AuthorID {
+			idx.add(cur)
+		}
+	}
+}
+
+func (idx *chirpIndex) add(chirp Chirp) {
+	idx.ids = insertSorted(idx.ids, chirp.ID)
+	idx.byAuthor[chirp.AuthorID] = insertSorted(idx.byAuthor[chirp.AuthorID], chirp.ID)
+}
+
+func (idx *chirpIndex) remove(chirp Chirp) {
+	idx.ids = removeSorted(idx.ids, chirp.ID)
+	ids := removeSorted(idx.byAuthor[chirp.AuthorID], chirp.ID)
+	if len(ids) == 0 {
+		delete(idx.byAuthor, chirp.AuthorID)
+	} else {
+		idx.byAuthor[chirp.AuthorID] = ids
+	}
+}
+
+// page returns the IDs matching q, at most q.Limit of them, and whether more
+// follow
+func (idx *chirpIndex) page(q ChirpQuery) ([]int, bool) {
+	ids := idx.ids
+	if q.AuthorID != 0 {
+		ids = idx.byAuthor[q.AuthorID]
+	}
+	var out []int
+	if q.Desc {
+		end := len(ids)
+		if q.AfterID != 0 {
+			end, _ = slices.BinarySearch(ids, q.AfterID)
+		}
+		for i := end - 1; i >= 0 && len(out) < q.Limit; i-- {
+			out = append(out, ids[i])
+		}
+		return out, end-len(out) > 0
+	}
+	start := 0
+	if q.AfterID != 0 {
+		start, _ = slices.BinarySearch(ids, q.AfterID+1)
+	}
+	for i := start; i < len(ids) && len(out) < q.Limit; i++ {
+		out = append(out, ids[i])
+	}
+	return out, start+len(out) < len(ids)
+}
+
+func insertSorted(ids []int, id int) []int {
+	i, found := slices.BinarySearch(ids, id)
+	if found {
+		return ids
+	}
+	return slices.Insert(ids, i, id)
+}
+
+func removeSorted(ids []int, id int) []int {
+	i, found := slices.BinarySearch(ids, id)
+	if !found {
+		return ids
+	}
+	return slices.Delete(ids, i, i+1)
+}
@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// The JSON database is rewritten in full on every change. To survive a crash
+// half way through, each write first truncates the journal next to the
+// database file, writes the complete new contents to it and fsyncs it. It
+// then writes the same contents to a temp file, fsyncs that, renames it over
+// the database file and fsyncs the directory, and finally removes the
+// journal. If the process dies before the rename, NewDB finds the journal on
+// startup and replays it; if it dies while writing the journal itself, the
+// journal does not parse and is discarded, leaving the old file untouched.
+
+func journalPath(path string) string {
+	return path + ".journal"
+}
+
+// writeJournal durably records data as the next intended database contents
+func writeJournal(path string, data []byte) error {
+	f, err := os.OpenFile(journalPath(path), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return fmt.Errorf("cannot open journal: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("cannot write journal: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("cannot sync journal: %w", err)
+	}
+	return f.Close()
+}
+
+// clearJournal removes the journal once its contents are safely on disk
+func clearJournal(path string) error {
+	err := os.Remove(journalPath(path))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("cannot remove journal: %w", err)
+	}
+	return nil
+}
+
+// replayJournal applies a journal left behind by an interrupted write. A
+// journal that is not valid JSON was itself torn and is dropped.
+func replayJournal(path string) error {
+	data, err := os.ReadFile(journalPath(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read journal: %w", err)
+	}
+	if json.Valid(data) {
+		if err := writeFileAtomic(path, data); err != nil {
+			return err
+		}
+	}
+	return clearJournal(path)
+}
+
+// writeFileAtomic replaces path with data so that readers see either the old
+// or the new contents, never a partial file
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("cannot create temp file: %w", err)
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("cannot write temp file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("cannot sync temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("cannot close temp file: %w", err)
+	}
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := os.Chmod(tmpName, mode); err != nil {
+		return fmt.Errorf("cannot chmod temp file: %w", err)
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		return fmt.Errorf("cannot replace db file: %w", err)
+	}
+	return syncDir(dir)
+}
+
+// syncDir flushes the directory entry so the rename itself is durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) {
+		return fmt.Errorf("cannot sync db directory: %w", err)
+	}
+	return nil
+}
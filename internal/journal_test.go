@@ -0,0 +1,70 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newDBWithChirps returns the contents of a database file holding the given
+// chirps
+func newDBWithChirps(t *testing.T, bodies ...string) []byte {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "db.json")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	for _, body := range bodies {
+		if _, err := db.CreateChirp(ctx, body, 1); err != nil {
+			t.Fatalf("CreateChirp: %v", err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestNewDBReplaysJournal(t *testing.T) {
+	for name, tc := range map[string]struct {
+		journal []byte
+		want    int
+	}{
+		// the process died after writing the journal but before the rename
+		"complete journal": {newDBWithChirps(t, "old", "new"), 2},
+		// the process died while writing the journal itself
+		"torn journal": {[]byte(`{"schema_version":`), 1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "db.json")
+			if err := os.WriteFile(path, newDBWithChirps(t, "old"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(journalPath(path), tc.journal, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			db, err := NewDB(path)
+			if err != nil {
+				t.Fatalf("NewDB: %v", err)
+			}
+			defer db.Close()
+			chirps, err := db.GetChirps(ctx)
+			if err != nil {
+				t.Fatalf("GetChirps: %v", err)
+			}
+			if len(chirps) != tc.want {
+				t.Errorf("%d chirps after startup, want %d", len(chirps), tc.want)
+			}
+			if _, err := os.Stat(journalPath(path)); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("journal left behind: %v", err)
+			}
+		})
+	}
+}
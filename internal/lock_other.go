@@ -0,0 +1,12 @@
+//go:build !unix
+
+package internal
+
+import "os"
+
+// lockFile opens the file at path without locking it. Only Unix systems get
+// the exclusive lock, so elsewhere nothing stops two processes from opening
+// the same database.
+func lockFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+}
@@ -0,0 +1,22 @@
+package internal
+
+import (
+	"context"
+	"log/slog"
+)
+
+type loggerKey struct{}
+
+// ContextWithLogger returns a copy of ctx carrying logger, so that code
+// handling one request logs with that request's attributes
+func ContextWithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// Logger returns the logger carried by ctx, or the default logger
+func Logger(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,164 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mail is a plain text email
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends email
+type Mailer interface {
+	Send(ctx context.Context, mail Mail) error
+}
+
+// message renders mail as an RFC 5322 message from from. Line breaks are
+// dropped from header values so they can't add headers of their own.
+func (m Mail) message(from string, now time.Time) []byte {
+	header := strings.NewReplacer("\r", "", "\n", "")
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", header.Replace(from))
+	fmt.Fprintf(&b, "To: %s\r\n", header.Replace(m.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", header.Replace(m.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(m.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return b.Bytes()
+}
+
+// smtpTimeout bounds sending one email, so a server that stops answering
+// can't hold up the sender forever
+const smtpTimeout = 30 * time.Second
+
+// SMTPMailer sends email through an SMTP server, with STARTTLS when the
+// server offers it
+type SMTPMailer struct {
+	addr string
+	host string
+	from string
+	auth smtp.Auth
+}
+
+// NewSMTPMailer returns a mailer sending from from through the server at
+// addr ("host:port"). Without a username it doesn't authenticate; with one,
+// net/smtp refuses to send the password unencrypted to anything but
+// localhost.
+func NewSMTPMailer(addr, from, username, password string) (*SMTPMailer, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("smtp address %q: %w", addr, err)
+	}
+	m := &SMTPMailer{addr: addr, host: host, from: from}
+	if username != "" {
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m, nil
+}
+
+// Send delivers mail, giving up when ctx is done or after smtpTimeout
+func (m *SMTPMailer) Send(ctx context.Context, mail Mail) error {
+	ctx, cancel := context.WithTimeout(ctx, smtpTimeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", m.addr)
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	// The deadline doesn't notice ctx being cancelled, closing the
+	// connection does
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: m.host}); err != nil {
+			return err
+		}
+	}
+	if m.auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("smtp: server doesn't support AUTH")
+		}
+		if err := c.Auth(m.auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(m.from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(mail.To); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(mail.message(m.from, time.Now())); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// FileMailer appends each email to a file instead of sending it, for local
+// testing
+type FileMailer struct {
+	path string
+	from string
+	mux  sync.Mutex
+}
+
+func NewFileMailer(path, from string) *FileMailer {
+	return &FileMailer{path: path, from: from}
+}
+
+func (m *FileMailer) Send(ctx context.Context, mail Mail) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	f, err := os.OpenFile(m.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	msg := append(mail.message(m.from, time.Now()), "\r\n\r\n"...)
+	if _, err := f.Write(msg); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// LogMailer logs who each email is to and its subject instead of sending it,
+// for local testing. The body isn't logged, as it can hold secrets such as
+// password reset tokens.
+type LogMailer struct{}
+
+func (LogMailer) Send(ctx context.Context, mail Mail) error {
+	Logger(ctx).Info("mail not sent, logged instead", slog.String("to", mail.To), slog.String("subject", mail.Subject))
+	return nil
+}
@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMailMessage(t *testing.T) {
+	mail := Mail{
+		To:      "alice@example.com\r\nBcc: eve@example.com",
+		Subject: "Hello",
+		Body:    "line one\nline two\r\n",
+	}
+	msg := string(mail.message("chirpy@example.com", time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)))
+	want := "From: chirpy@example.com\r\n" +
+		"To: alice@example.comBcc: eve@example.com\r\n" +
+		"Subject: Hello\r\n" +
+		"Date: Tue, 02 Jan 2024 03:04:05 +0000\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" +
+		"line one\r\nline two\r\n"
+	if msg != want {
+		t.Errorf("message =\n%q\nwant\n%q", msg, want)
+	}
+}
+
+func TestFileMailer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mail.log")
+	m := NewFileMailer(path, "chirpy@example.com")
+	for _, to := range []string{"alice@example.com", "bob@example.com"} {
+		if err := m.Send(ctx, Mail{To: to, Subject: "Hi", Body: "Hello"}); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, to := range []string{"To: alice@example.com", "To: bob@example.com"} {
+		if !strings.Contains(string(content), to) {
+			t.Errorf("mail file lacks %q:\n%s", to, content)
+		}
+	}
+}
+
+// fakeSMTPServer accepts one message on a local port and sends what it
+// received, from MAIL FROM to the end of DATA, on the returned channel
+func fakeSMTPServer(t *testing.T) (string, <-chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	received := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		var b strings.Builder
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+		reply("220 localhost ESMTP")
+		inData := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				received <- b.String()
+				return
+			}
+			switch {
+			case inData && line == ".\r\n":
+				inData = false
+				reply("250 OK")
+			case inData:
+				b.WriteString(line)
+			case strings.HasPrefix(line, "EHLO"), strings.HasPrefix(line, "HELO"):
+				reply("250 localhost")
+			case strings.HasPrefix(line, "DATA"):
+				inData = true
+				reply("354 go ahead")
+			case strings.HasPrefix(line, "QUIT"):
+				reply("221 bye")
+				received <- b.String()
+				return
+			default:
+				b.WriteString(line)
+				reply("250 OK")
+			}
+		}
+	}()
+	return l.Addr().String(), received
+}
+
+func TestSMTPMailer(t *testing.T) {
+	addr, received := fakeSMTPServer(t)
+	m, err := NewSMTPMailer(addr, "chirpy@example.com", "", "")
+	if err != nil {
+		t.Fatalf("NewSMTPMailer: %v", err)
+	}
+	if err := m.Send(ctx, Mail{To: "alice@example.com", Subject: "Hi", Body: "Hello"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	got := <-received
+	for _, want := range []string{"MAIL FROM:<chirpy@example.com>", "RCPT TO:<alice@example.com>", "Subject: Hi\r\n", "\r\n\r\nHello"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("server received %q, missing %q", got, want)
+		}
+	}
+
+	if _, err := NewSMTPMailer("no-port", "chirpy@example.com", "", ""); err == nil {
+		t.Error("address without a port accepted")
+	}
+}
+
+func TestSMTPMailerGivesUp(t *testing.T) {
+	// A server that accepts connections and never says a word
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		var conns []net.Conn
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				for _, conn := range conns {
+					conn.Close()
+				}
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	m, err := NewSMTPMailer(l.Addr().String(), "chirpy@example.com", "", "")
+	if err != nil {
+		t.Fatalf("NewSMTPMailer: %v", err)
+	}
+	mail := Mail{To: "alice@example.com", Subject: "Hi", Body: "Hello"}
+
+	timeout, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := m.Send(timeout, mail); err == nil {
+		t.Error("Send to a silent server succeeded")
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("Send took %v past a 100ms deadline", took)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start = time.Now()
+	if err := m.Send(cancelled, mail); err == nil {
+		t.Error("Send to a silent server succeeded")
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("Send took %v after being cancelled", took)
+	}
+}
@@ -0,0 +1,247 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultLatencyBuckets are histogram buckets, in seconds, suited to request
+// and database operation latencies
+var DefaultLatencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// DefaultSizeBuckets are histogram buckets, in bytes, suited to response sizes
+var DefaultSizeBuckets = []float64{64, 256, 1024, 4096, 16384, 65536, 262144, 1048576}
+
+// Metrics is a registry of counters, histograms and gauges that can be
+// written in the Prometheus text exposition format. Recording a value only
+// takes a lock the first time a label combination is seen.
+type Metrics struct {
+	mux      sync.Mutex
+	families []metricFamily
+}
+
+type metricFamily interface {
+	write(w *bufio.Writer)
+}
+
+// NewMetrics returns an empty registry
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+func (m *Metrics) register(f metricFamily) {
+	m.mux.Lock()
+	m.families = append(m.families, f)
+	m.mux.Unlock()
+}
+
+// WriteTo writes every metric in the Prometheus text format, in the order
+// they were registered
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mux.Lock()
+	families := append([]metricFamily(nil), m.families...)
+	m.mux.Unlock()
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, f := range families {
+		f.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// labeled holds one series per combination of label values
+type labeled[T any] struct {
+	name   string
+	help   string
+	labels []string
+	series sync.Map // joined label values -> *T
+	mux    sync.Mutex
+	make   func() *T
+}
+
+func (l *labeled[T]) get(values []string) *T {
+	if len(values) != len(l.labels) {
+		panic(fmt.Sprintf("metric %s: got %d label values, want %d", l.name, len(values), len(l.labels)))
+	}
+	key := strings.Join(values, "\xff")
+	if s, ok := l.series.Load(key); ok {
+		return s.(*T)
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	s, _ := l.series.LoadOrStore(key, l.make())
+	return s.(*T)
+}
+
+// each calls fn for every series, sorted by label values
+func (l *labeled[T]) each(fn func(values []string, s *T)) {
+	var keys []string
+	l.series.Range(func(k, _ any) bool {
+		keys = append(keys, k.(string))
+		return true
+	})
+	sort.Strings(keys)
+	for _, k := range keys {
+		s, _ := l.series.Load(k)
+		var values []string
+		if len(l.labels) > 0 {
+			values = strings.Split(k, "\xff")
+		}
+		fn(values, s.(*T))
+	}
+}
+
+func (l *labeled[T]) header(w *bufio.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", l.name, escapeHelp(l.help), l.name, kind)
+}
+
+// Counter is a monotonically increasing count, one per label combination
+type Counter struct {
+	labeled[atomic.Uint64]
+}
+
+// NewCounter registers a counter with the given label names
+func (m *Metrics) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{labeled[atomic.Uint64]{name: name, help: help, labels: labels, make: func() *atomic.Uint64 { return new(atomic.Uint64) }}}
+	m.register(c)
+	return c
+}
+
+// Inc adds one to the series with the given label values
+func (c *Counter) Inc(values ...string) {
+	c.get(values).Add(1)
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.header(w, "counter")
+	c.each(func(values []string, v *atomic.Uint64) {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, formatLabels(c.labels, values, "", ""), v.Load())
+	})
+}
+
+// Histogram counts observations into cumulative buckets, one set per label
+// combination
+type Histogram struct {
+	labeled[histogramSeries]
+	buckets []float64
+}
+
+type histogramSeries struct {
+	counts []atomic.Uint64 // per bucket, plus +Inf, not cumulative
+	count  atomic.Uint64
+	sum    atomic.Uint64 // float64 bits
+}
+
+// NewHistogram registers a histogram with the given upper bucket bounds,
+// which must be sorted, and label names
+func (m *Metrics) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{buckets: buckets}
+	h.labeled = labeled[histogramSeries]{name: name, help: help, labels: labels, make: func() *histogramSeries {
+		return &histogramSeries{counts: make([]atomic.Uint64, len(buckets)+1)}
+	}}
+	m.register(h)
+	return h
+}
+
+// Observe records v in the series with the given label values
+func (h *Histogram) Observe(v float64, values ...string) {
+	s := h.get(values)
+	s.counts[sort.SearchFloat64s(h.buckets, v)].Add(1)
+	s.count.Add(1)
+	for {
+		old := s.sum.Load()
+		if s.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.header(w, "histogram")
+	h.each(func(values []string, s *histogramSeries) {
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i].Load()
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, values, "le", formatFloat(bound)), cumulative)
+		}
+		cumulative += s.counts[len(h.buckets)].Load()
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, values, "le", "+Inf"), cumulative)
+		labels := formatLabels(h.labels, values, "", "")
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, formatFloat(math.Float64frombits(s.sum.Load())))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, s.count.Load())
+	})
+}
+
+// gaugeFunc is a gauge whose value is computed when metrics are written
+type gaugeFunc struct {
+	name string
+	help string
+	fn   func() (float64, error)
+}
+
+// NewGaugeFunc registers a gauge whose value is read from fn on every
+// scrape. If fn fails the gauge is left out of that scrape.
+func (m *Metrics) NewGaugeFunc(name, help string, fn func() (float64, error)) {
+	m.register(&gaugeFunc{name: name, help: help, fn: fn})
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer) {
+	v, err := g.fn()
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, escapeHelp(g.help), g.name, g.name, formatFloat(v))
+}
+
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", name, escapeLabel(values[i]))
+	}
+	if extraName != "" {
+		if len(names) > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", extraName, extraValue)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMetricsWriteTo(t *testing.T) {
+	m := NewMetrics()
+	requests := m.NewCounter("requests_total", "Requests served.", "path", "status")
+	latency := m.NewHistogram("latency_seconds", "Latency.", []float64{0.1, 1})
+	m.NewGaugeFunc("users", "Users.", func() (float64, error) { return 3, nil })
+	m.NewGaugeFunc("broken", "Fails.", func() (float64, error) { return 0, errors.New("boom") })
+
+	requests.Inc("/b", "200")
+	requests.Inc("/a", "200")
+	requests.Inc("/a", "200")
+	requests.Inc(`/"q"`, "404")
+	latency.Observe(0.05)
+	latency.Observe(0.1)
+	latency.Observe(0.5)
+	latency.Observe(3)
+
+	var b strings.Builder
+	if _, err := m.WriteTo(&b); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	want := `# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{path="/\"q\"",status="404"} 1
+requests_total{path="/a",status="200"} 2
+requests_total{path="/b",status="200"} 1
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 2
+latency_seconds_bucket{le="1"} 3
+latency_seconds_bucket{le="+Inf"} 4
+latency_seconds_sum 3.65
+latency_seconds_count 4
+# HELP users Users.
+# TYPE users gauge
+users 3
+`
+	if b.String() != want {
+		t.Errorf("WriteTo wrote\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestCounterConcurrentInc(t *testing.T) {
+	m := NewMetrics()
+	c := m.NewCounter("hits_total", "Hits.", "path")
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.Inc("/")
+			}
+		}()
+	}
+	wg.Wait()
+	if got := c.get([]string{"/"}).Load(); got != 5000 {
+		t.Errorf("counter = %d, want 5000", got)
+	}
+}
@@ -0,0 +1,269 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// CurrentSchemaVersion is the db.json layout this binary reads and writes.
+// Bump it together with a new entry in migrations whenever DBStructure, Chirp
+// or User change shape.
+const CurrentSchemaVersion = 8
+
+// ErrSchemaTooNew is returned when db.json was written by a newer binary
+var ErrSchemaTooNew = errors.New("database schema is newer than this binary supports")
+
+// migration upgrades a decoded db.json document from version-1 to version.
+// It edits doc in place and returns a line per change it made.
+type migration struct {
+	version     int
+	description string
+	apply       func(doc map[string]any) ([]string, error)
+}
+
+// migrations is applied in order to every file older than
+// CurrentSchemaVersion. Never edit or reorder a released migration.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "add schema_version and fill in user fields older files lack",
+		apply: func(doc map[string]any) ([]string, error) {
+			changes := ensureObject(doc, "chirps")
+			changes = append(changes, ensureObject(doc, "users")...)
+			defaults := []struct {
+				field string
+				value any
+			}{
+				{"refresh_token", ""},
+				{"refresh_expiry", "0001-01-01T00:00:00Z"},
+				{"is_chirpy_red", false},
+			}
+			err := eachRecord(doc, "users", func(id string, user map[string]any) {
+				for _, d := range defaults {
+					if _, ok := user[d.field]; !ok {
+						user[d.field] = d.value
+						changes = append(changes, fmt.Sprintf("users/%s: set %s to %v", id, d.field, d.value))
+					}
+				}
+			})
+			return changes, err
+		},
+	},
+	{
+		version:     2,
+		description: "add chirp timestamps and edit history",
+		apply: func(doc map[string]any) ([]string, error) {
+			changes := ensureObject(doc, "chirp_history")
+			// Chirps posted before timestamps existed are stamped with the
+			// time of the migration, the earliest time we can vouch for
+			now := time.Now().UTC().Format(time.RFC3339Nano)
+			err := eachRecord(doc, "chirps", func(id string, chirp map[string]any) {
+				for _, field := range []string{"created_at", "updated_at"} {
+					if _, ok := chirp[field]; !ok {
+						chirp[field] = now
+						changes = append(changes, fmt.Sprintf("chirps/%s: set %s to %s", id, field, now))
+					}
+				}
+			})
+			return changes, err
+		},
+	},
+	{
+		version:     3,
+		description: "add the chirp review queue",
+		apply: func(doc map[string]any) ([]string, error) {
+			return ensureObject(doc, "chirp_flags"), nil
+		},
+	},
+	{
+		version:     4,
+		description: "give every user a role",
+		apply: func(doc map[string]any) ([]string, error) {
+			var changes []string
+			err := eachRecord(doc, "users", func(id string, user map[string]any) {
+				if _, ok := user["role"]; !ok {
+					user["role"] = string(RoleUser)
+					changes = append(changes, fmt.Sprintf("users/%s: set role to %s", id, RoleUser))
+				}
+			})
+			return changes, err
+		},
+	},
+	{
+		version:     5,
+		description: "move refresh tokens to hashed sessions, logging everyone out",
+		apply: func(doc map[string]any) ([]string, error) {
+			changes := ensureObject(doc, "sessions")
+			err := eachRecord(doc, "users", func(id string, user map[string]any) {
+				for _, field := range []string{"refresh_token", "refresh_expiry"} {
+					if _, ok := user[field]; ok {
+						delete(user, field)
+						changes = append(changes, fmt.Sprintf("users/%s: removed %s", id, field))
+					}
+				}
+			})
+			return changes, err
+		},
+	},
+	{
+		version:     6,
+		description: "add the access token denylist",
+		apply: func(doc map[string]any) ([]string, error) {
+			return ensureObject(doc, "denied_tokens"), nil
+		},
+	},
+	{
+		version:     7,
+		description: "add the audit log",
+		apply: func(doc map[string]any) ([]string, error) {
+			return ensureObject(doc, "audit_log"), nil
+		},
+	},
+	{
+		version:     8,
+		description: "add password resets",
+		apply: func(doc map[string]any) ([]string, error) {
+			return ensureObject(doc, "password_resets"), nil
+		},
+	},
+}
+
+// MigrationStep describes one migration applied, or that would be applied,
+// to a database file
+type MigrationStep struct {
+	Version     int
+	Description string
+	Changes     []string
+}
+
+// MigrationReport lists what Migrate did or would do
+type MigrationReport struct {
+	FromVersion int
+	ToVersion   int
+	Steps       []MigrationStep
+}
+
+// Migrate brings the JSON database at path up to CurrentSchemaVersion. With
+// dryRun set the file is left untouched and the report describes what would
+// change. Otherwise it takes the same lock as NewDB, and fails with
+// ErrDBLocked while a server has the database open.
+func Migrate(path string, dryRun bool) (MigrationReport, error) {
+	if !dryRun {
+		lock, err := lockDB(path)
+		if err != nil {
+			return MigrationReport{}, err
+		}
+		defer lock.Close()
+	}
+	return migrate(path, dryRun)
+}
+
+// migrate is Migrate for callers already holding the lock
+func migrate(path string, dryRun bool) (MigrationReport, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return MigrationReport{}, fmt.Errorf("could not read db file: %w", err)
+	}
+	data, report, err := migrateJSON(content)
+	if err != nil {
+		return report, err
+	}
+	if dryRun || len(report.Steps) == 0 {
+		return report, nil
+	}
+	if err := writeJournal(path, data); err != nil {
+		return report, err
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return report, err
+	}
+	return report, clearJournal(path)
+}
+
+// migrateJSON applies every pending migration to a db.json document and
+// returns the upgraded document
+func migrateJSON(content []byte) ([]byte, MigrationReport, error) {
+	doc := map[string]any{}
+	if err := json.Unmarshal(content, &doc); err != nil {
+		return nil, MigrationReport{}, err
+	}
+	from, err := schemaVersion(doc)
+	if err != nil {
+		return nil, MigrationReport{}, err
+	}
+	report := MigrationReport{FromVersion: from, ToVersion: from}
+	if from > CurrentSchemaVersion {
+		return nil, report, fmt.Errorf("%w: file is version %d, binary supports up to %d",
+			ErrSchemaTooNew, from, CurrentSchemaVersion)
+	}
+	for _, m := range migrations {
+		if m.version <= from {
+			continue
+		}
+		changes, err := m.apply(doc)
+		if err != nil {
+			return nil, report, fmt.Errorf("migration %d: %w", m.version, err)
+		}
+		doc["schema_version"] = m.version
+		report.ToVersion = m.version
+		report.Steps = append(report.Steps, MigrationStep{
+			Version:     m.version,
+			Description: m.description,
+			Changes:     changes,
+		})
+	}
+	if len(report.Steps) == 0 {
+		return content, report, nil
+	}
+	data, err := json.Marshal(doc)
+	return data, report, err
+}
+
+func schemaVersion(doc map[string]any) (int, error) {
+	raw, ok := doc["schema_version"]
+	if !ok {
+		return 0, nil
+	}
+	v, ok := raw.(float64)
+	if !ok || v != float64(int(v)) {
+		return 0, fmt.Errorf("invalid schema_version %v", raw)
+	}
+	return int(v), nil
+}
+
+// ensureObject makes sure doc[key] is a JSON object
+func ensureObject(doc map[string]any, key string) []string {
+	if _, ok := doc[key].(map[string]any); ok {
+		return nil
+	}
+	doc[key] = map[string]any{}
+	return []string{fmt.Sprintf("%s: created empty collection", key)}
+}
+
+// eachRecord calls fn for every record in the doc[collection] object, in ID
+// order so reports are stable
+func eachRecord(doc map[string]any, collection string, fn func(id string, record map[string]any)) error {
+	records, _ := doc[collection].(map[string]any)
+	ids := make([]string, 0, len(records))
+	for id := range records {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if len(ids[i]) != len(ids[j]) {
+			return len(ids[i]) < len(ids[j])
+		}
+		return ids[i] < ids[j]
+	})
+	for _, id := range ids {
+		record, ok := records[id].(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s/%s is not an object", collection, id)
+		}
+		fn(id, record)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewDBMigratesUnversionedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.json")
+	old := `{"chirps":{"1":{"body":"hi","id":1,"author_id":1}},"users":{"1":{"email":"a@b.c","id":1,"password":"x"}}}`
+	if err := os.WriteFile(path, []byte(old), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Migrate(path, true)
+	if err != nil {
+		t.Fatalf("Migrate dry run: %v", err)
+	}
+	if report.FromVersion != 0 || report.ToVersion != CurrentSchemaVersion {
+		t.Fatalf("dry run reported %d -> %d", report.FromVersion, report.ToVersion)
+	}
+	if len(report.Steps) == 0 || len(report.Steps[0].Changes) == 0 {
+		t.Fatalf("dry run reported no changes: %+v", report)
+	}
+	if content, _ := os.ReadFile(path); string(content) != old {
+		t.Fatal("dry run modified the file")
+	}
+
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	if err := db.View(func(dbs *DBStructure) error {
+		if dbs.SchemaVersion != CurrentSchemaVersion {
+			t.Errorf("schema version %d, want %d", dbs.SchemaVersion, CurrentSchemaVersion)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.GetSingleChirp(ctx, 1); !ok {
+		t.Fatal("chirp lost in migration")
+	}
+}
+
+func TestNewDBRefusesNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.json")
+	newer := `{"schema_version":999,"chirps":{},"users":{}}`
+	if err := os.WriteFile(path, []byte(newer), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDB(path); !errors.Is(err, ErrSchemaTooNew) {
+		t.Fatalf("NewDB returned %v, want %v", err, ErrSchemaTooNew)
+	}
+}
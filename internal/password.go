@@ -0,0 +1,245 @@
+package internal
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordAlgorithm names how new password hashes are made
+type PasswordAlgorithm string
+
+const (
+	PasswordBcrypt   PasswordAlgorithm = "bcrypt"
+	PasswordArgon2id PasswordAlgorithm = "argon2id"
+)
+
+// Argon2Params are the cost parameters of argon2id hashes. Memory is in KiB.
+type Argon2Params struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+}
+
+// DefaultArgon2Params are the second recommended option of RFC 9106, for
+// when 2 GiB per hash is too much
+var DefaultArgon2Params = Argon2Params{Time: 3, Memory: 64 * 1024, Threads: 4}
+
+const (
+	// DefaultBcryptCost takes a few hundred milliseconds per hash
+	DefaultBcryptCost = 12
+	argon2SaltLen     = 16
+	argon2KeyLen      = 32
+)
+
+// PasswordHasher hashes new passwords with the configured algorithm and
+// cost, and verifies hashes made with any supported one
+type PasswordHasher struct {
+	algorithm  PasswordAlgorithm
+	bcryptCost int
+	argon2     Argon2Params
+	dummy      func() string
+}
+
+func NewPasswordHasher(algorithm PasswordAlgorithm, bcryptCost int, argon2 Argon2Params) (*PasswordHasher, error) {
+	switch algorithm {
+	case PasswordBcrypt:
+		if bcryptCost < bcrypt.MinCost || bcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	case PasswordArgon2id:
+		if argon2.Time < 1 || argon2.Memory < 8*uint32(argon2.Threads) || argon2.Threads < 1 {
+			return nil, errors.New("argon2 time and threads must be at least 1, and memory at least 8 KiB per thread")
+		}
+	default:
+		return nil, fmt.Errorf("password hash must be bcrypt or argon2id, not %q", algorithm)
+	}
+	h := &PasswordHasher{algorithm: algorithm, bcryptCost: bcryptCost, argon2: argon2}
+	h.dummy = sync.OnceValue(func() string {
+		hash, _ := h.Hash("not a real password")
+		return hash
+	})
+	return h, nil
+}
+
+// Hash returns a hash of password to store
+func (h *PasswordHasher) Hash(password string) (string, error) {
+	if h.algorithm == PasswordArgon2id {
+		salt := make([]byte, argon2SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		p := h.argon2
+		key := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, argon2KeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.Memory, p.Time, p.Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	}
+	bytes, err := bcrypt.GenerateFromPassword([]byte(password), h.bcryptCost)
+	return string(bytes), err
+}
+
+// Verify reports whether password matches hash, and if so whether hash was
+// made with another algorithm or cost than new hashes are and should be
+// replaced
+func (h *PasswordHasher) Verify(password, hash string) (ok, rehash bool) {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		p, salt, key, err := parseArgon2Hash(hash)
+		if err != nil {
+			return false, false
+		}
+		got := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, uint32(len(key)))
+		if subtle.ConstantTimeCompare(got, key) != 1 {
+			return false, false
+		}
+		return true, h.algorithm != PasswordArgon2id || p != h.argon2
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false, false
+	}
+	cost, _ := bcrypt.Cost([]byte(hash))
+	return true, h.algorithm != PasswordBcrypt || cost != h.bcryptCost
+}
+
+// DummyVerify spends the time a Verify would, without checking anything.
+// Call it when there is no hash to check against, so that the response time
+// doesn't tell.
+func (h *PasswordHasher) DummyVerify(password string) {
+	h.Verify(password, h.dummy())
+}
+
+// MatchDummy makes DummyVerify take as long as verifying the most common
+// kind of hash among hashes, which should be the stored ones: hashes made
+// with an older algorithm or cost stay until their users log in. Accounts
+// whose hash is of a less common kind still take a different time to
+// verify than unknown emails. It must be called before DummyVerify.
+func (h *PasswordHasher) MatchDummy(hashes []string) {
+	counts := map[hashKind]int{}
+	var common hashKind
+	for _, hash := range hashes {
+		if kind, ok := kindOf(hash); ok {
+			counts[kind]++
+			if counts[kind] > counts[common] {
+				common = kind
+			}
+		}
+	}
+	if len(counts) == 0 {
+		return
+	}
+	like := &PasswordHasher{algorithm: common.algorithm, bcryptCost: common.bcryptCost, argon2: common.argon2}
+	h.dummy = sync.OnceValue(func() string {
+		hash, _ := like.Hash("not a real password")
+		return hash
+	})
+}
+
+// hashKind is the algorithm and cost a hash was made with
+type hashKind struct {
+	algorithm  PasswordAlgorithm
+	bcryptCost int
+	argon2     Argon2Params
+}
+
+func kindOf(hash string) (hashKind, bool) {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		p, _, _, err := parseArgon2Hash(hash)
+		return hashKind{algorithm: PasswordArgon2id, argon2: p}, err == nil
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return hashKind{algorithm: PasswordBcrypt, bcryptCost: cost}, err == nil
+}
+
+// parseArgon2Hash splits a hash made by Hash into its parameters, salt and
+// key
+func parseArgon2Hash(hash string) (p Argon2Params, salt, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return p, nil, nil, errors.New("malformed argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, errors.New("unsupported argon2 version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return p, nil, nil, fmt.Errorf("malformed argon2id parameters: %w", err)
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return p, nil, nil, err
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return p, nil, nil, err
+	}
+	return p, salt, key, nil
+}
+
+// maxPasswordBytes is the most bcrypt can hash. It holds for argon2id too, so
+// that every password can be rehashed if the algorithm is switched back.
+const maxPasswordBytes = 72
+
+// ErrWeakPassword wraps every reason PasswordPolicy.Check rejects a password
+var ErrWeakPassword = errors.New("password rejected")
+
+// PasswordPolicy decides which new passwords are acceptable
+type PasswordPolicy struct {
+	MinLength int
+	// breached are known leaked passwords, which attackers try first
+	breached map[string]bool
+}
+
+// NewPasswordPolicy returns a policy requiring minLength characters and, if
+// breachList is set, rejecting the passwords listed one per line in that
+// file
+func NewPasswordPolicy(minLength int, breachList string) (*PasswordPolicy, error) {
+	p := &PasswordPolicy{MinLength: minLength, breached: map[string]bool{}}
+	if breachList == "" {
+		return p, nil
+	}
+	f, err := os.Open(breachList)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimRight(scanner.Text(), "\r"); line != "" {
+			p.breached[line] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", breachList, err)
+	}
+	return p, nil
+}
+
+// Check returns an error wrapping ErrWeakPassword, saying what is wrong,
+// if password may not be used for the account with email
+func (p *PasswordPolicy) Check(email, password string) error {
+	if password == "" {
+		return fmt.Errorf("%w: must not be empty", ErrWeakPassword)
+	}
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return fmt.Errorf("%w: must be at least %d characters", ErrWeakPassword, p.MinLength)
+	}
+	if len(password) > maxPasswordBytes {
+		return fmt.Errorf("%w: must be at most %d bytes", ErrWeakPassword, maxPasswordBytes)
+	}
+	email = strings.ToLower(strings.TrimSpace(email))
+	local, _, _ := strings.Cut(email, "@")
+	if lower := strings.ToLower(password); email != "" && (lower == email || lower == local) {
+		return fmt.Errorf("%w: must not be your email", ErrWeakPassword)
+	}
+	if p.breached[password] {
+		return fmt.Errorf("%w: it has appeared in a data breach, choose another", ErrWeakPassword)
+	}
+	return nil
+}
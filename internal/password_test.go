@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testArgon2Params are cheap enough for tests
+var testArgon2Params = Argon2Params{Time: 1, Memory: 64, Threads: 1}
+
+func TestPasswordHasher(t *testing.T) {
+	for _, algorithm := range []PasswordAlgorithm{PasswordBcrypt, PasswordArgon2id} {
+		t.Run(string(algorithm), func(t *testing.T) {
+			h, err := NewPasswordHasher(algorithm, bcrypt.MinCost, testArgon2Params)
+			if err != nil {
+				t.Fatalf("NewPasswordHasher: %v", err)
+			}
+			hash, err := h.Hash("correct horse")
+			if err != nil {
+				t.Fatalf("Hash: %v", err)
+			}
+			if !strings.HasPrefix(hash, "$") || strings.Contains(hash, "correct horse") {
+				t.Fatalf("Hash = %q", hash)
+			}
+			if ok, rehash := h.Verify("correct horse", hash); !ok || rehash {
+				t.Errorf("Verify(right password) = %v, %v; want true, false", ok, rehash)
+			}
+			if ok, _ := h.Verify("wrong horse", hash); ok {
+				t.Error("Verify accepted a wrong password")
+			}
+			if again, _ := h.Hash("correct horse"); again == hash {
+				t.Error("two hashes of one password are equal, salt missing")
+			}
+		})
+	}
+}
+
+func TestPasswordHasherRehash(t *testing.T) {
+	cheap, _ := NewPasswordHasher(PasswordBcrypt, bcrypt.MinCost, testArgon2Params)
+	dearer, _ := NewPasswordHasher(PasswordBcrypt, bcrypt.MinCost+1, testArgon2Params)
+	argon, _ := NewPasswordHasher(PasswordArgon2id, bcrypt.MinCost, testArgon2Params)
+	argonDearer, _ := NewPasswordHasher(PasswordArgon2id, bcrypt.MinCost, Argon2Params{Time: 2, Memory: 64, Threads: 1})
+
+	bcryptHash, _ := cheap.Hash("pw")
+	argonHash, _ := argon.Hash("pw")
+	for _, tc := range []struct {
+		name   string
+		h      *PasswordHasher
+		hash   string
+		rehash bool
+	}{
+		{"bcrypt cost raised", dearer, bcryptHash, true},
+		{"bcrypt to argon2id", argon, bcryptHash, true},
+		{"argon2id to bcrypt", cheap, argonHash, true},
+		{"argon2id params changed", argonDearer, argonHash, true},
+		{"argon2id unchanged", argon, argonHash, false},
+	} {
+		if ok, rehash := tc.h.Verify("pw", tc.hash); !ok || rehash != tc.rehash {
+			t.Errorf("%s: Verify = %v, %v; want true, %v", tc.name, ok, rehash, tc.rehash)
+		}
+	}
+
+	for _, hash := range []string{"", "plaintext", "$argon2id$v=19$m=64,t=1,p=1$!!$!!", "$argon2id$v=18" + argonHash[14:]} {
+		if ok, _ := argon.Verify("pw", hash); ok {
+			t.Errorf("Verify accepted hash %q", hash)
+		}
+	}
+}
+
+func TestMatchDummy(t *testing.T) {
+	h, _ := NewPasswordHasher(PasswordBcrypt, bcrypt.MinCost, testArgon2Params)
+	legacy, _ := NewPasswordHasher(PasswordBcrypt, bcrypt.MinCost+1, testArgon2Params)
+	argon, _ := NewPasswordHasher(PasswordArgon2id, bcrypt.MinCost, testArgon2Params)
+	current, _ := h.Hash("a")
+	old1, _ := legacy.Hash("b")
+	old2, _ := legacy.Hash("c")
+	argonHash, _ := argon.Hash("d")
+
+	h.MatchDummy([]string{current, old1, "not a hash", argonHash, old2})
+	if cost, err := bcrypt.Cost([]byte(h.dummy())); err != nil || cost != bcrypt.MinCost+1 {
+		t.Errorf("dummy hash cost = %d, %v; want the %d most stored hashes have", cost, err, bcrypt.MinCost+1)
+	}
+
+	h, _ = NewPasswordHasher(PasswordBcrypt, bcrypt.MinCost, testArgon2Params)
+	h.MatchDummy([]string{argonHash})
+	if kind, _ := kindOf(h.dummy()); kind != (hashKind{algorithm: PasswordArgon2id, argon2: testArgon2Params}) {
+		t.Errorf("dummy hash kind = %+v, want argon2id like the stored one", kind)
+	}
+
+	h, _ = NewPasswordHasher(PasswordBcrypt, bcrypt.MinCost, testArgon2Params)
+	h.MatchDummy(nil)
+	if cost, _ := bcrypt.Cost([]byte(h.dummy())); cost != bcrypt.MinCost {
+		t.Errorf("with no stored hashes dummy hash cost = %d, want the configured %d", cost, bcrypt.MinCost)
+	}
+}
+
+func TestNewPasswordHasherRejects(t *testing.T) {
+	for name, build := range map[string]func() (*PasswordHasher, error){
+		"bcrypt cost too low":  func() (*PasswordHasher, error) { return NewPasswordHasher(PasswordBcrypt, 3, testArgon2Params) },
+		"bcrypt cost too high": func() (*PasswordHasher, error) { return NewPasswordHasher(PasswordBcrypt, 32, testArgon2Params) },
+		"argon2 no threads": func() (*PasswordHasher, error) {
+			return NewPasswordHasher(PasswordArgon2id, 10, Argon2Params{Time: 1, Memory: 64})
+		},
+		"unknown algorithm": func() (*PasswordHasher, error) { return NewPasswordHasher("md5", 10, testArgon2Params) },
+	} {
+		if _, err := build(); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	breachList := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(breachList, []byte("password123\r\nletmein!!\n\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewPasswordPolicy(8, breachList)
+	if err != nil {
+		t.Fatalf("NewPasswordPolicy: %v", err)
+	}
+	for password, ok := range map[string]bool{
+		"":                      false,
+		"short":                 false,
+		"ünïcödé!":              true,
+		"password123":           false,
+		"letmein!!":             false,
+		"alice.smith":           false,
+		"correct horse":         true,
+		strings.Repeat("a", 73): false,
+	} {
+		err := p.Check("alice.smith@example.com", password)
+		if (err == nil) != ok {
+			t.Errorf("Check(%q) = %v, want ok = %v", password, err, ok)
+		}
+		if err != nil && !errors.Is(err, ErrWeakPassword) {
+			t.Errorf("Check(%q) = %v, not an ErrWeakPassword", password, err)
+		}
+	}
+	if err := p.Check("alice@example.com", "Alice@Example.com"); err == nil {
+		t.Error("email as password accepted")
+	}
+
+	if _, err := NewPasswordPolicy(8, filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("missing breach list accepted")
+	}
+}
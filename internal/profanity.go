@@ -0,0 +1,292 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// ProfanityPolicy says what happens to a chirp containing a listed word
+type ProfanityPolicy string
+
+const (
+	// PolicyMask replaces the word with asterisks
+	PolicyMask ProfanityPolicy = "mask"
+	// PolicyReject refuses the chirp
+	PolicyReject ProfanityPolicy = "reject"
+	// PolicyFlag accepts the chirp unchanged and queues it for review
+	PolicyFlag ProfanityPolicy = "flag"
+)
+
+const profanityMask = "****"
+
+// defaultProfanityWords is used until a word list file exists
+var defaultProfanityWords = []ProfanityWord{
+	{Word: "kerfuffle", Policy: PolicyMask},
+	{Word: "sharbert", Policy: PolicyMask},
+	{Word: "fornax", Policy: PolicyMask},
+}
+
+// ProfanityWord is one entry of the word list
+type ProfanityWord struct {
+	Word   string          `json:"word"`
+	Policy ProfanityPolicy `json:"policy"`
+}
+
+// ProfanityResult is the outcome of checking a chirp body
+type ProfanityResult struct {
+	// Body is the input with every masked word replaced
+	Body string
+	// Rejected and Flagged list the words, as written, that matched a
+	// reject or flag policy
+	Rejected []string
+	Flagged  []string
+}
+
+// ProfanityFilter checks chirp bodies against a word list kept in a text
+// file, one word per line optionally followed by its policy:
+//
+//	# lines starting with # are comments
+//	kerfuffle
+//	fornax reject
+//	sharbert flag
+//
+// Words are matched whole, after Unicode case folding, so "Kerfuffle!" and
+// "KERFUFFLE" both match "kerfuffle". The file is reloaded when it changes.
+type ProfanityFilter struct {
+	path    string
+	mux     sync.RWMutex
+	words   map[string]ProfanityWord
+	modTime time.Time
+}
+
+// NewProfanityFilter loads the word list at path. A missing file is not an
+// error: the built-in list is used until the file is created.
+func NewProfanityFilter(path string) (*ProfanityFilter, error) {
+	f := &ProfanityFilter{path: path}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload rereads the word list file
+func (f *ProfanityFilter) Reload() error {
+	info, err := os.Stat(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		f.set(defaultProfanityWords, time.Time{})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	content, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	words, err := parseProfanityWords(content)
+	if err != nil {
+		return fmt.Errorf("%s: %w", f.path, err)
+	}
+	f.set(words, info.ModTime())
+	return nil
+}
+
+// Watch reloads the word list whenever the file's modification time changes,
+// checking every interval until stop is closed
+func (f *ProfanityFilter) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			info, err := os.Stat(f.path)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				slog.Error("cannot check profanity list", "path", f.path, "error", err)
+				continue
+			}
+			f.mux.RLock()
+			loaded := f.modTime
+			f.mux.RUnlock()
+			if (err == nil && info.ModTime().Equal(loaded)) || (err != nil && loaded.IsZero()) {
+				continue
+			}
+			if err := f.Reload(); err != nil {
+				slog.Error("cannot reload profanity list", "path", f.path, "error", err)
+				continue
+			}
+			slog.Info("reloaded profanity list", "path", f.path)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Words returns the current word list sorted by word
+func (f *ProfanityFilter) Words() []ProfanityWord {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+	words := make([]ProfanityWord, 0, len(f.words))
+	for _, w := range f.words {
+		words = append(words, w)
+	}
+	sort.Slice(words, func(i, j int) bool {
+		return words[i].Word < words[j].Word
+	})
+	return words
+}
+
+// SetWords validates words, saves them to the word list file and starts
+// using them
+func (f *ProfanityFilter) SetWords(words []ProfanityWord) error {
+	var buf bytes.Buffer
+	buf.WriteString("# word [mask|reject|flag]\n")
+	normalized := make([]ProfanityWord, 0, len(words))
+	for i, w := range words {
+		n, err := normalizeProfanityWord(w)
+		if err != nil {
+			return fmt.Errorf("entry %d: %w", i+1, err)
+		}
+		normalized = append(normalized, n)
+		fmt.Fprintf(&buf, "%s %s\n", n.Word, n.Policy)
+	}
+	if err := writeFileAtomic(f.path, buf.Bytes()); err != nil {
+		return err
+	}
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	f.set(normalized, info.ModTime())
+	return nil
+}
+
+func (f *ProfanityFilter) set(words []ProfanityWord, modTime time.Time) {
+	byFold := make(map[string]ProfanityWord, len(words))
+	for _, w := range words {
+		byFold[foldCase(w.Word)] = w
+	}
+	f.mux.Lock()
+	f.words = byFold
+	f.modTime = modTime
+	f.mux.Unlock()
+}
+
+// Check applies the word list to body
+func (f *ProfanityFilter) Check(body string) ProfanityResult {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	var res ProfanityResult
+	var out strings.Builder
+	last := 0
+	for _, span := range wordSpans(body) {
+		word := body[span[0]:span[1]]
+		entry, ok := f.words[foldCase(word)]
+		if !ok {
+			continue
+		}
+		switch entry.Policy {
+		case PolicyReject:
+			res.Rejected = append(res.Rejected, word)
+		case PolicyFlag:
+			res.Flagged = append(res.Flagged, word)
+		default:
+			out.WriteString(body[last:span[0]])
+			out.WriteString(profanityMask)
+			last = span[1]
+		}
+	}
+	out.WriteString(body[last:])
+	res.Body = out.String()
+	return res
+}
+
+func parseProfanityWords(content []byte) ([]ProfanityWord, error) {
+	var words []ProfanityWord
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("line %d: expected a word and an optional policy", line)
+		}
+		w := ProfanityWord{Word: fields[0]}
+		if len(fields) == 2 {
+			w.Policy = ProfanityPolicy(fields[1])
+		}
+		w, err := normalizeProfanityWord(w)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		words = append(words, w)
+	}
+	return words, scanner.Err()
+}
+
+func normalizeProfanityWord(w ProfanityWord) (ProfanityWord, error) {
+	spans := wordSpans(w.Word)
+	if len(spans) != 1 || spans[0][0] != 0 || spans[0][1] != len(w.Word) {
+		return w, fmt.Errorf("%q is not a single word", w.Word)
+	}
+	switch w.Policy {
+	case "":
+		w.Policy = PolicyMask
+	case PolicyMask, PolicyReject, PolicyFlag:
+	default:
+		return w, fmt.Errorf("unknown policy %q for %q", w.Policy, w.Word)
+	}
+	return w, nil
+}
+
+// wordSpans returns the byte offsets of every run of letters, digits and
+// combining marks in s. Everything else, including punctuation and any
+// kind of whitespace, separates words.
+func wordSpans(s string) [][2]int {
+	var spans [][2]int
+	start := -1
+	for i, r := range s {
+		inWord := unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r)
+		if inWord && start < 0 {
+			start = i
+		} else if !inWord && start >= 0 {
+			spans = append(spans, [2]int{start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		spans = append(spans, [2]int{start, len(s)})
+	}
+	return spans
+}
+
+// foldCase maps every rune to a canonical member of its Unicode simple case
+// folding orbit, so strings that differ only in case fold to the same value
+// (including pairs like "ſ"/"s" and "K"/"k" that ToLower misses)
+func foldCase(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	for _, r := range s {
+		min := r
+		for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+			if f < min {
+				min = f
+			}
+		}
+		b.WriteRune(min)
+	}
+	return b.String()
+}
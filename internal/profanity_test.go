@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestProfanityFilterCheck(t *testing.T) {
+	f, err := NewProfanityFilter(filepath.Join(t.TempDir(), "profanity.txt"))
+	if err != nil {
+		t.Fatalf("NewProfanityFilter: %v", err)
+	}
+	words := []ProfanityWord{
+		{Word: "kerfuffle"},
+		{Word: "fornax", Policy: PolicyReject},
+		{Word: "straße", Policy: PolicyFlag},
+	}
+	if err := f.SetWords(words); err != nil {
+		t.Fatalf("SetWords: %v", err)
+	}
+	if words[0].Policy != "" {
+		t.Fatalf("SetWords changed the caller's slice: %v", words)
+	}
+
+	tests := []struct {
+		body         string
+		wantBody     string
+		wantRejected []string
+		wantFlagged  []string
+	}{
+		{"What a Kerfuffle!", "What a ****!", nil, nil},
+		{"KERFUFFLE\nkerfuffle,kerfuffle", "****\n****,****", nil, nil},
+		{"kerfuffles are fine", "kerfuffles are fine", nil, nil},
+		{"Fornax.", "Fornax.", []string{"Fornax"}, nil},
+		{"STRASSE or STRAßE", "STRASSE or STRAßE", nil, []string{"STRAßE"}},
+	}
+	for _, tt := range tests {
+		res := f.Check(tt.body)
+		if res.Body != tt.wantBody || !slices.Equal(res.Rejected, tt.wantRejected) || !slices.Equal(res.Flagged, tt.wantFlagged) {
+			t.Errorf("Check(%q) = %+v, want body %q rejected %v flagged %v",
+				tt.body, res, tt.wantBody, tt.wantRejected, tt.wantFlagged)
+		}
+	}
+
+	reloaded, err := NewProfanityFilter(f.path)
+	if err != nil {
+		t.Fatalf("NewProfanityFilter: %v", err)
+	}
+	if !slices.Equal(reloaded.Words(), f.Words()) {
+		t.Fatalf("reloaded words %v, want %v", reloaded.Words(), f.Words())
+	}
+}
@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RatePolicy allows Limit requests per Period. Requests are counted with a
+// token bucket holding Limit tokens and refilled evenly over Period, so a
+// client that has been quiet can make Limit requests at once.
+type RatePolicy struct {
+	Limit  int
+	Period time.Duration
+}
+
+// ParseRatePolicy parses a policy written as "<limit>/<period>", such as
+// "30/1m". The period may leave out a count of one, as in "30/m".
+func ParseRatePolicy(s string) (RatePolicy, error) {
+	limit, period, ok := strings.Cut(strings.TrimSpace(s), "/")
+	if !ok {
+		return RatePolicy{}, fmt.Errorf("rate %q is not <limit>/<period>", s)
+	}
+	n, err := strconv.Atoi(limit)
+	if err != nil || n < 1 {
+		return RatePolicy{}, fmt.Errorf("rate %q: limit must be a positive integer", s)
+	}
+	if period != "" && (period[0] < '0' || period[0] > '9') {
+		period = "1" + period
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return RatePolicy{}, fmt.Errorf("rate %q: period must be a positive duration", s)
+	}
+	return RatePolicy{Limit: n, Period: d}, nil
+}
+
+func (p RatePolicy) String() string {
+	return strconv.Itoa(p.Limit) + "/" + p.Period.String()
+}
+
+// RateLimitResult is the outcome of one request against a policy
+type RateLimitResult struct {
+	Allowed bool
+	// Remaining is how many more requests would be allowed right now
+	Remaining int
+	// Reset is how long until the full limit is available again
+	Reset time.Duration
+	// RetryAfter is how long a refused request has to wait
+	RetryAfter time.Duration
+}
+
+// RateLimiter counts requests per key. The key identifies both the client
+// and what it is limited on, so one limiter can serve every policy.
+// Implementations backed by a shared store let several servers enforce one
+// limit.
+type RateLimiter interface {
+	Allow(ctx context.Context, key string, policy RatePolicy) (RateLimitResult, error)
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+	period time.Duration
+}
+
+// MemoryRateLimiter keeps token buckets in memory, so each server process
+// counts only the requests it serves
+type MemoryRateLimiter struct {
+	now func() time.Time
+
+	mux       sync.Mutex
+	buckets   map[string]*rateBucket
+	lastSweep time.Time
+}
+
+func NewMemoryRateLimiter() *MemoryRateLimiter {
+	return &MemoryRateLimiter{
+		now:     time.Now,
+		buckets: map[string]*rateBucket{},
+	}
+}
+
+// Allow takes a token from the bucket of key if there is one
+func (l *MemoryRateLimiter) Allow(ctx context.Context, key string, policy RatePolicy) (RateLimitResult, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	now := l.now()
+	l.sweep(now)
+
+	capacity := float64(policy.Limit)
+	perToken := policy.Period / time.Duration(policy.Limit)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &rateBucket{tokens: capacity, last: now}
+		l.buckets[key] = b
+	}
+	b.period = policy.Period
+	b.tokens = min(capacity, b.tokens+float64(now.Sub(b.last))/float64(perToken))
+	b.last = now
+
+	res := RateLimitResult{}
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = time.Duration(math.Ceil((1 - b.tokens) * float64(perToken)))
+	}
+	res.Remaining = int(b.tokens)
+	res.Reset = time.Duration(math.Ceil((capacity - b.tokens) * float64(perToken)))
+	return res, nil
+}
+
+// sweep drops buckets that have refilled, at most once a minute
+func (l *MemoryRateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= b.period {
+			delete(l.buckets, key)
+		}
+	}
+}
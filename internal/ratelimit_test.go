@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRatePolicy(t *testing.T) {
+	for s, want := range map[string]RatePolicy{
+		"30/1m":   {Limit: 30, Period: time.Minute},
+		"30/m":    {Limit: 30, Period: time.Minute},
+		" 5/1h ":  {Limit: 5, Period: time.Hour},
+		"1/500ms": {Limit: 1, Period: 500 * time.Millisecond},
+	} {
+		got, err := ParseRatePolicy(s)
+		if err != nil || got != want {
+			t.Errorf("ParseRatePolicy(%q) = %v, %v; want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "30", "0/1m", "-1/1m", "x/1m", "30/", "30/0s", "30/-1m", "30/fortnight"} {
+		if _, err := ParseRatePolicy(s); err == nil {
+			t.Errorf("ParseRatePolicy(%q) accepted", s)
+		}
+	}
+}
+
+func TestMemoryRateLimiter(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	limiter := NewMemoryRateLimiter()
+	limiter.now = clock.now
+	policy := RatePolicy{Limit: 3, Period: 3 * time.Second}
+
+	// The full burst is available at once
+	for i := 3; i > 0; i-- {
+		res, _ := limiter.Allow(ctx, "a", policy)
+		if !res.Allowed || res.Remaining != i-1 {
+			t.Fatalf("request %d: %+v", 4-i, res)
+		}
+	}
+	res, _ := limiter.Allow(ctx, "a", policy)
+	if res.Allowed || res.RetryAfter != time.Second || res.Reset != 3*time.Second {
+		t.Fatalf("over the limit: %+v, want refused for 1s, full in 3s", res)
+	}
+	if res, _ := limiter.Allow(ctx, "b", policy); !res.Allowed {
+		t.Error("another key was limited")
+	}
+
+	// Tokens come back one per period / limit
+	clock.advance(time.Second)
+	if res, _ := limiter.Allow(ctx, "a", policy); !res.Allowed || res.Remaining != 0 {
+		t.Errorf("after a refill: %+v", res)
+	}
+	clock.advance(500 * time.Millisecond)
+	if res, _ := limiter.Allow(ctx, "a", policy); res.Allowed || res.RetryAfter != 500*time.Millisecond {
+		t.Errorf("half a token: %+v", res)
+	}
+
+	// and never pile up past the limit
+	clock.advance(time.Hour)
+	for i := 0; i < 3; i++ {
+		limiter.Allow(ctx, "a", policy)
+	}
+	if res, _ := limiter.Allow(ctx, "a", policy); res.Allowed {
+		t.Error("bucket filled past its limit")
+	}
+	if _, ok := limiter.buckets["b"]; ok {
+		t.Error("refilled bucket not swept")
+	}
+}
@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"errors"
+	"slices"
+)
+
+// Role decides what a user is allowed to do beyond managing their own
+// account and chirps
+type Role string
+
+const (
+	RoleUser      Role = "user"
+	RoleModerator Role = "moderator"
+	RoleAdmin     Role = "admin"
+)
+
+// ErrInvalidRole is returned for a role name that isn't one of the above
+var ErrInvalidRole = errors.New("role must be user, moderator or admin")
+
+// Permission is an action that only some roles may take
+type Permission string
+
+const (
+	// PermModerateChirps allows deleting any chirp and working through the
+	// review queue
+	PermModerateChirps Permission = "moderate_chirps"
+	// PermManageUsers allows listing users and changing their roles
+	PermManageUsers Permission = "manage_users"
+	// PermManageServer allows reading metrics, editing the profanity list
+	// and resetting the database
+	PermManageServer Permission = "manage_server"
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleUser:      nil,
+	RoleModerator: {PermModerateChirps},
+	RoleAdmin:     {PermModerateChirps, PermManageUsers, PermManageServer},
+}
+
+// ParseRole returns the role named s
+func ParseRole(s string) (Role, error) {
+	role := Role(s)
+	if _, ok := rolePermissions[role]; !ok {
+		return "", ErrInvalidRole
+	}
+	return role, nil
+}
+
+// Can reports whether the role grants p. Unknown roles, including the empty
+// role, grant nothing.
+func (r Role) Can(p Permission) bool {
+	return slices.Contains(rolePermissions[r], p)
+}
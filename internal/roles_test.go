@@ -0,0 +1,29 @@
+package internal
+
+import "testing"
+
+func TestRoleCan(t *testing.T) {
+	tests := []struct {
+		role Role
+		perm Permission
+		want bool
+	}{
+		{RoleUser, PermModerateChirps, false},
+		{RoleModerator, PermModerateChirps, true},
+		{RoleModerator, PermManageUsers, false},
+		{RoleModerator, PermManageServer, false},
+		{RoleAdmin, PermModerateChirps, true},
+		{RoleAdmin, PermManageUsers, true},
+		{RoleAdmin, PermManageServer, true},
+		{"", PermModerateChirps, false},
+		{"root", PermManageServer, false},
+	}
+	for _, tt := range tests {
+		if got := tt.role.Can(tt.perm); got != tt.want {
+			t.Errorf("Role(%q).Can(%q) = %v, want %v", tt.role, tt.perm, got, tt.want)
+		}
+	}
+	if _, err := ParseRole("root"); err != ErrInvalidRole {
+		t.Errorf("ParseRole(root) returned %v, want %v", err, ErrInvalidRole)
+	}
+}
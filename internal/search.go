@@ -0,0 +1,239 @@
+package internal
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// searchIndex is an inverted index over chirp bodies. For every term it
+// records the chirps containing it and the token positions the term occurs
+// at, which is enough to answer multi-term AND queries, phrase queries and
+// to rank results with BM25. It is not safe for concurrent use; the owning
+// store guards it.
+type searchIndex struct {
+	postings map[string]map[int][]int
+	// docTerms lists the distinct terms of each chirp so it can be removed
+	// without scanning every posting list
+	docTerms map[int][]string
+	docLen   map[int]int
+	totalLen int
+}
+
+// BM25 tuning constants, the usual defaults
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+func newSearchIndex(chirps map[int]Chirp) *searchIndex {
+	idx := &searchIndex{
+		postings: make(map[string]map[int][]int),
+		docTerms: make(map[int][]string),
+		docLen:   make(map[int]int),
+	}
+	for id, chirp := range chirps {
+		idx.add(id, chirp.Body)
+	}
+	return idx
+}
+
+// apply brings the index in line with a commit. before and after hold the
+// chirps the commit changed as they were and as they are; one missing from
+// after was deleted, one missing from before was created.
+func (idx *searchIndex) apply(before, after map[int]Chirp) {
+	for id, old := range before {
+		if cur, ok := after[id]; !ok || cur.Body != old.Body {
+			idx.remove(id)
+		}
+	}
+	for id, cur := range after {
+		if old, ok := before[id]; !ok || cur.Body != old.Body {
+			idx.add(id, cur.Body)
+		}
+	}
+}
+
+func (idx *searchIndex) add(id int, body string) {
+	idx.remove(id)
+	terms := tokenize(body)
+	for pos, term := range terms {
+		docs, ok := idx.postings[term]
+		if !ok {
+			docs = make(map[int][]int)
+			idx.postings[term] = docs
+		}
+		if _, seen := docs[id]; !seen {
+			idx.docTerms[id] = append(idx.docTerms[id], term)
+		}
+		docs[id] = append(docs[id], pos)
+	}
+	idx.docLen[id] = len(terms)
+	idx.totalLen += len(terms)
+}
+
+func (idx *searchIndex) remove(id int) {
+	n, ok := idx.docLen[id]
+	if !ok {
+		return
+	}
+	for _, term := range idx.docTerms[id] {
+		docs := idx.postings[term]
+		delete(docs, id)
+		if len(docs) == 0 {
+			delete(idx.postings, term)
+		}
+	}
+	delete(idx.docTerms, id)
+	delete(idx.docLen, id)
+	idx.totalLen -= n
+}
+
+// searchQuery is a parsed query: every term and every phrase must match
+type searchQuery struct {
+	terms   []string
+	phrases [][]string
+}
+
+// parseSearchQuery splits a query into bare terms and "quoted phrases". An
+// unterminated quote runs to the end of the query.
+func parseSearchQuery(q string) searchQuery {
+	var sq searchQuery
+	for i, part := range strings.Split(q, `"`) {
+		tokens := tokenize(part)
+		if len(tokens) == 0 {
+			continue
+		}
+		// Odd parts were inside quotes
+		if i%2 == 1 && len(tokens) > 1 {
+			sq.phrases = append(sq.phrases, tokens)
+		} else {
+			sq.terms = append(sq.terms, tokens...)
+		}
+	}
+	return sq
+}
+
+func (sq searchQuery) empty() bool {
+	return len(sq.terms) == 0 && len(sq.phrases) == 0
+}
+
+// search returns the IDs of chirps matching q, most relevant first. Ties go
+// to the newer chirp.
+func (idx *searchIndex) search(q string) []int {
+	sq := parseSearchQuery(q)
+	if sq.empty() {
+		return nil
+	}
+	// Every word of every phrase is also a required term
+	required := append([]string{}, sq.terms...)
+	for _, phrase := range sq.phrases {
+		required = append(required, phrase...)
+	}
+
+	candidates := idx.intersect(required)
+	scores := make(map[int]float64, len(candidates))
+	for _, id := range candidates {
+		if !idx.containsPhrases(id, sq.phrases) {
+			continue
+		}
+		scores[id] = idx.score(id, required)
+	}
+
+	ids := make([]int, 0, len(scores))
+	for id := range scores {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if scores[ids[i]] != scores[ids[j]] {
+			return scores[ids[i]] > scores[ids[j]]
+		}
+		return ids[i] > ids[j]
+	})
+	return ids
+}
+
+// intersect returns the chirps containing every term
+func (idx *searchIndex) intersect(terms []string) []int {
+	// Start from the rarest term to keep the candidate set small
+	sorted := append([]string{}, terms...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return len(idx.postings[sorted[i]]) < len(idx.postings[sorted[j]])
+	})
+	var ids []int
+	for id := range idx.postings[sorted[0]] {
+		ids = append(ids, id)
+	}
+	for _, term := range sorted[1:] {
+		docs := idx.postings[term]
+		kept := ids[:0]
+		for _, id := range ids {
+			if _, ok := docs[id]; ok {
+				kept = append(kept, id)
+			}
+		}
+		ids = kept
+	}
+	return ids
+}
+
+// containsPhrases reports whether chirp id has every phrase as consecutive
+// tokens
+func (idx *searchIndex) containsPhrases(id int, phrases [][]string) bool {
+	for _, phrase := range phrases {
+		found := false
+		for _, start := range idx.postings[phrase[0]][id] {
+			if idx.phraseAt(id, phrase, start) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (idx *searchIndex) phraseAt(id int, phrase []string, start int) bool {
+	for offset, term := range phrase[1:] {
+		want := start + offset + 1
+		ok := false
+		for _, pos := range idx.postings[term][id] {
+			if pos == want {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// score ranks chirp id against the query terms with BM25
+func (idx *searchIndex) score(id int, terms []string) float64 {
+	n := float64(len(idx.docLen))
+	avgLen := float64(idx.totalLen) / n
+	docLen := float64(idx.docLen[id])
+	total := 0.0
+	for _, term := range terms {
+		docs := idx.postings[term]
+		df := float64(len(docs))
+		tf := float64(len(docs[id]))
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+		total += idf * tf * (bm25K1 + 1) / (tf + bm25K1*(1-bm25B+bm25B*docLen/avgLen))
+	}
+	return total
+}
+
+// tokenize splits text into lower-cased words. Anything that is not a letter
+// or digit separates words, so punctuation and line breaks never end up
+// inside a term.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
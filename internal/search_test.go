@@ -0,0 +1,47 @@
+package internal
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSearchIndex(t *testing.T) {
+	chirps := map[int]Chirp{
+		1: {ID: 1, Body: "The quick brown fox"},
+		2: {ID: 2, Body: "A brown dog, quick!"},
+		3: {ID: 3, Body: "fox fox fox\nbrown"},
+		4: {ID: 4, Body: "Lazy dog sleeps"},
+	}
+	idx := newSearchIndex(chirps)
+
+	tests := []struct {
+		query string
+		want  []int
+	}{
+		{"fox", []int{3, 1}},
+		{"QUICK brown", []int{2, 1}},
+		{`"quick brown"`, []int{1}},
+		{`"brown quick"`, nil},
+		{`dog "lazy dog"`, []int{4}},
+		{"cat", nil},
+		{"!!!", nil},
+	}
+	for _, tt := range tests {
+		if got := idx.search(tt.query); !slices.Equal(got, tt.want) {
+			t.Errorf("search(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	after := map[int]Chirp{
+		1: chirps[1],
+		2: {ID: 2, Body: "a red fox"},
+		4: chirps[4],
+	}
+	idx.apply(chirps, after)
+	if got := idx.search("fox"); !slices.Equal(got, []int{2, 1}) {
+		t.Errorf("after apply, search(fox) = %v, want [2 1]", got)
+	}
+	if got := idx.search("dog"); !slices.Equal(got, []int{4}) {
+		t.Errorf("after apply, search(dog) = %v, want [4]", got)
+	}
+}
@@ -1,91 +1,378 @@
 package internal
 
 import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
-	"log"
+	"math/big"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
-	"golang.org/x/crypto/bcrypt"
 )
 
-func HashPassword(password string) (string, error) {
-    bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
-    return string(bytes), err
-}
-func CheckPasswordHash(password, hash string) bool {
-    err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-    return err == nil
-}
-
-type MyCustomClaims struct {
-    jwt.RegisteredClaims
-    Subject string `json:"subject"` // Add this field if needed in your claims
-}
-
-func CreateJWT(secretKey string, params map[string]interface{}) (string, error) {
-    // Create claims with standard claims and optional custom claims
-    claims := MyCustomClaims{
-        RegisteredClaims: jwt.RegisteredClaims{
-            Issuer:   "chirpy",
-            IssuedAt: jwt.NewNumericDate(time.Now().UTC()),
-            ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(time.Duration(params["Expires"].(int)) * time.Second)),
-        },
-        Subject: params["Subject"].(string), // Access subject from params if present
-    }
-
-    // Create a new token object with HS256 signing method
-    token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-
-    // Sign the token using the secret key
-    tokenString, err := token.SignedString([]byte(secretKey))
-    if err != nil {
-        return "", fmt.Errorf("error signing token: %w", err)
-    }
-
-    return tokenString, nil
-}
-
-func ParseJWT(tokenString string, secretKey string) (map[string]interface{}, error) {
-    // Parse the token with HS256 signing method
-    token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-        return []byte(secretKey), nil
-    })
-    if err != nil {
-        if err == jwt.ErrSignatureInvalid {
-            return nil, fmt.Errorf("invalid token signature")
-        }
-        return nil, fmt.Errorf("error parsing token: %w", err)
-    }
-
-    if !token.Valid {
-        return nil, fmt.Errorf("invalid token")
-    }
-
-    // Extract claims as a map[string]interface{}
-    claims := token.Claims.(jwt.MapClaims)
-
-    // Return the claims as a map
-    return claims, nil
-}
-
-func IsAuthenticated(tokenString, secret string) (int,bool){
-    if tokenString == "" || secret == ""{
-        return 0,false
-    }
-    token, err := ParseJWT(tokenString, secret)
-    if err != nil{
-		log.Printf("Error decoding parameters: %s", err)
-        return 0,false
-	}
-    if subject, ok := token["subject"].(string); ok {
-        userID, err := strconv.Atoi(subject)
-        if err != nil{
-            log.Printf("Error parsing parameters: %s", err)
-            return 0,false
-        }
-        return userID, true
-    }
-    return 0,false
+// Claims are the claims of an access token. The user ID is the registered
+// subject claim.
+type Claims struct {
+	jwt.RegisteredClaims
+	// SessionID is the session the token was issued for
+	SessionID int `json:"sid,omitempty"`
+}
+
+// UserID returns the ID of the user the token was issued to
+func (c Claims) UserID() (int, error) {
+	id, err := strconv.Atoi(c.Subject)
+	if err != nil {
+		return 0, fmt.Errorf("invalid subject %q", c.Subject)
+	}
+	return id, nil
+}
+
+// ErrUnknownSigningKey is returned for a token whose kid header doesn't name
+// a key in the keyring
+var ErrUnknownSigningKey = errors.New("token signed with an unknown key")
+
+// SigningKey is a key access tokens are signed or verified with. Each key is
+// pinned to a single algorithm.
+type SigningKey struct {
+	// ID is the kid header of tokens signed with the key
+	ID     string
+	Method jwt.SigningMethod
+	sign   any
+	verify any
+	public crypto.PublicKey
+}
+
+// CanSign reports whether the key holds the secret or private key needed to
+// sign tokens, rather than only a public key
+func (k SigningKey) CanSign() bool {
+	return k.sign != nil
+}
+
+// NewHMACKey returns an HS256 key for secret. Its ID is derived from the
+// secret, so tokens signed before a restart still find their key.
+func NewHMACKey(secret string) SigningKey {
+	sum := sha256.Sum256([]byte(secret))
+	return SigningKey{
+		ID:     "hs-" + base64.RawURLEncoding.EncodeToString(sum[:8]),
+		Method: jwt.SigningMethodHS256,
+		sign:   []byte(secret),
+		verify: []byte(secret),
+	}
+}
+
+// NewPrivateKey returns an EdDSA key for an Ed25519 private key or an RS256
+// key for an RSA private key of at least 2048 bits
+func NewPrivateKey(key crypto.Signer) (SigningKey, error) {
+	k, err := NewPublicKey(key.Public())
+	if err != nil {
+		return SigningKey{}, err
+	}
+	k.sign = key
+	return k, nil
+}
+
+// NewPublicKey returns a verification-only key, e.g. for a private key that
+// has been rotated out but whose tokens may still be in use. Its ID is the
+// RFC 7638 thumbprint of the key.
+func NewPublicKey(key crypto.PublicKey) (SigningKey, error) {
+	k := SigningKey{verify: key, public: key}
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		k.Method = jwt.SigningMethodEdDSA
+	case *rsa.PublicKey:
+		if key.N.BitLen() < 2048 {
+			return SigningKey{}, errors.New("RSA keys must be at least 2048 bits")
+		}
+		k.Method = jwt.SigningMethodRS256
+	default:
+		return SigningKey{}, fmt.Errorf("unsupported key type %T, want Ed25519 or RSA", key)
+	}
+	thumbprint, err := json.Marshal(k.jwk().thumbprintMembers())
+	if err != nil {
+		return SigningKey{}, err
+	}
+	sum := sha256.Sum256(thumbprint)
+	k.ID = base64.RawURLEncoding.EncodeToString(sum[:])
+	return k, nil
+}
+
+// ParsePrivateKeyPEM reads a PKCS #8 Ed25519 or RSA private key, or a
+// PKCS #1 RSA private key
+func ParsePrivateKeyPEM(data []byte) (SigningKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return SigningKey{}, errors.New("no PEM data found")
+	}
+	var key any
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return SigningKey{}, fmt.Errorf("unexpected PEM block %q, want a private key", block.Type)
+	}
+	if err != nil {
+		return SigningKey{}, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return SigningKey{}, fmt.Errorf("unsupported key type %T", key)
+	}
+	return NewPrivateKey(signer)
+}
+
+// ParsePublicKeyPEM reads a PKIX Ed25519 or RSA public key
+func ParsePublicKeyPEM(data []byte) (SigningKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return SigningKey{}, errors.New("no PEM data found")
+	}
+	if block.Type != "PUBLIC KEY" {
+		return SigningKey{}, fmt.Errorf("unexpected PEM block %q, want a public key", block.Type)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return SigningKey{}, err
+	}
+	return NewPublicKey(key)
+}
+
+// Keyring issues access tokens with its current key and accepts tokens
+// signed with any of its keys, so a key can be rotated out without logging
+// everyone out: keep the old one as a verification key until its last token
+// has expired.
+type Keyring struct {
+	issuer   string
+	audience string
+	current  SigningKey
+	keys     map[string]SigningKey
+	methods  []string
+}
+
+// NewKeyring returns a keyring that signs with current and also verifies
+// tokens signed with any of previous. Tokens carry issuer and audience and
+// are only accepted with the same values.
+func NewKeyring(issuer, audience string, current SigningKey, previous ...SigningKey) (*Keyring, error) {
+	if !current.CanSign() {
+		return nil, errors.New("the current key must be able to sign")
+	}
+	k := &Keyring{
+		issuer:   issuer,
+		audience: audience,
+		current:  current,
+		keys:     map[string]SigningKey{},
+	}
+	for _, key := range append([]SigningKey{current}, previous...) {
+		if _, ok := k.keys[key.ID]; ok {
+			continue
+		}
+		k.keys[key.ID] = key
+		if !slices.Contains(k.methods, key.Method.Alg()) {
+			k.methods = append(k.methods, key.Method.Alg())
+		}
+	}
+	return k, nil
+}
+
+// CreateJWT returns an access token for userID's session that expires after
+// ttl
+func (k *Keyring) CreateJWT(userID, sessionID int, ttl time.Duration) (string, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", fmt.Errorf("error generating token ID: %w", err)
+	}
+	now := time.Now().UTC()
+	claims := Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    k.issuer,
+			Subject:   strconv.Itoa(userID),
+			Audience:  jwt.ClaimStrings{k.audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+			ID:        hex.EncodeToString(jti),
+		},
+		SessionID: sessionID,
+	}
+	token := jwt.NewWithClaims(k.current.Method, claims)
+	token.Header["kid"] = k.current.ID
+	tokenString, err := token.SignedString(k.current.sign)
+	if err != nil {
+		return "", fmt.Errorf("error signing token: %w", err)
+	}
+	return tokenString, nil
+}
+
+// ParseJWT verifies an access token and returns its claims. The token must
+// name one of the keyring's keys in its kid header and be signed with that
+// key's algorithm; issuer, audience, expiry, subject and ID are required.
+func (k *Keyring) ParseJWT(tokenString string) (Claims, error) {
+	claims := Claims{}
+	_, err := jwt.ParseWithClaims(tokenString, &claims, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := k.keys[kid]
+		if !ok {
+			return nil, ErrUnknownSigningKey
+		}
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, fmt.Errorf("key %s does not allow %s", kid, token.Method.Alg())
+		}
+		return key.verify, nil
+	},
+		jwt.WithValidMethods(k.methods),
+		jwt.WithIssuer(k.issuer),
+		jwt.WithAudience(k.audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
+	if err != nil {
+		return Claims{}, err
+	}
+	if claims.ID == "" {
+		return Claims{}, errors.New("token has no jti claim")
+	}
+	if _, err := claims.UserID(); err != nil {
+		return Claims{}, err
+	}
+	return claims, nil
+}
+
+// ErrTokenRevoked is returned for an access token on the denylist
+var ErrTokenRevoked = errors.New("token has been revoked")
+
+// Denylist holds the IDs of access tokens revoked before they expired
+type Denylist interface {
+	IsTokenDenied(ctx context.Context, jti string) (bool, error)
+}
+
+// IsAuthenticated verifies an access token like ParseJWT and also rejects it
+// with ErrTokenRevoked if its jti is on the denylist
+func (k *Keyring) IsAuthenticated(ctx context.Context, tokenString string, denylist Denylist) (Claims, error) {
+	claims, err := k.ParseJWT(tokenString)
+	if err != nil {
+		return Claims{}, err
+	}
+	denied, err := denylist.IsTokenDenied(ctx, claims.ID)
+	if err != nil {
+		return Claims{}, fmt.Errorf("error checking token denylist: %w", err)
+	}
+	if denied {
+		return Claims{}, ErrTokenRevoked
+	}
+	return claims, nil
+}
+
+// JWK is a public key in JSON Web Key form (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Use string `json:"use,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys of the keyring so other services can verify
+// its tokens. HMAC secrets are never included.
+func (k *Keyring) JWKS() JWKS {
+	set := JWKS{Keys: []JWK{}}
+	for _, key := range k.keys {
+		if key.public == nil {
+			continue
+		}
+		jwk := key.jwk()
+		jwk.Kid = key.ID
+		jwk.Alg = key.Method.Alg()
+		jwk.Use = "sig"
+		set.Keys = append(set.Keys, jwk)
+	}
+	slices.SortFunc(set.Keys, func(a, b JWK) int { return strings.Compare(a.Kid, b.Kid) })
+	return set
+}
+
+func (k SigningKey) jwk() JWK {
+	switch key := k.public.(type) {
+	case ed25519.PublicKey:
+		return JWK{Kty: "OKP", Crv: "Ed25519", X: base64.RawURLEncoding.EncodeToString(key)}
+	case *rsa.PublicKey:
+		return JWK{
+			Kty: "RSA",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}
+	}
+	return JWK{}
+}
+
+// thumbprintMembers returns the required members of the key, which
+// encoding/json writes in the lexicographic order RFC 7638 asks for
+func (j JWK) thumbprintMembers() map[string]string {
+	if j.Kty == "RSA" {
+		return map[string]string{"e": j.E, "kty": j.Kty, "n": j.N}
+	}
+	return map[string]string{"crv": j.Crv, "kty": j.Kty, "x": j.X}
+}
+
+// NewToken returns a random opaque token, such as a refresh or password
+// reset token, and the hash it is stored under
+func NewToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = hex.EncodeToString(b)
+	return token, HashToken(token), nil
+}
+
+// HashToken returns the hex SHA-256 of a random token for storage. Unlike a
+// password, a token has enough entropy that a fast hash is safe.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ErrNoAuthorization is returned when a request has no Authorization header
+var ErrNoAuthorization = errors.New("no Authorization header")
+
+// ErrMalformedAuthorization is returned for an Authorization header that
+// isn't a single token after the expected scheme
+var ErrMalformedAuthorization = errors.New("malformed Authorization header")
+
+// AuthorizationCredentials returns the credentials from an Authorization
+// header of the form "<scheme> <credentials>". The scheme is matched
+// case-insensitively; the credentials must be a single non-empty token.
+func AuthorizationCredentials(header, scheme string) (string, error) {
+	if header == "" {
+		return "", ErrNoAuthorization
+	}
+	got, credentials, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(got, scheme) {
+		return "", ErrMalformedAuthorization
+	}
+	credentials = strings.TrimLeft(credentials, " ")
+	if credentials == "" || strings.ContainsAny(credentials, " \t") {
+		return "", ErrMalformedAuthorization
+	}
+	return credentials, nil
 }
@@ -0,0 +1,917 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLiteDB is a Store backed by an embedded SQLite database file.
+type SQLiteDB struct {
+	path string
+	conn *sql.DB
+
+	// search indexes chirp bodies in memory, the same way DB does. It is
+	// built when the file is opened and updated after each chirp write.
+	searchMux sync.RWMutex
+	search    *searchIndex
+	// chirpWrites is held by each chirp write from its statement until the
+	// search index has followed, so the index sees the writes in the order
+	// they were committed
+	chirpWrites sync.Mutex
+}
+
+// sqliteMigrations are applied in order, each in its own transaction, and
+// the number applied is tracked in PRAGMA user_version. Never edit or reorder
+// a released migration; append a new one instead.
+var sqliteMigrations = []string{
+	// 1: initial schema. IF NOT EXISTS keeps it safe for files created
+	// before user_version was tracked.
+	`CREATE TABLE IF NOT EXISTS users (
+		id             INTEGER PRIMARY KEY AUTOINCREMENT,
+		email          TEXT NOT NULL UNIQUE,
+		password       TEXT NOT NULL,
+		refresh_token  TEXT NOT NULL DEFAULT '',
+		refresh_expiry TIMESTAMP NOT NULL DEFAULT '0001-01-01 00:00:00+00:00',
+		is_chirpy_red  BOOLEAN NOT NULL DEFAULT 0
+	);
+	CREATE INDEX IF NOT EXISTS users_refresh_token ON users(refresh_token);
+
+	CREATE TABLE IF NOT EXISTS chirps (
+		id        INTEGER PRIMARY KEY AUTOINCREMENT,
+		body      TEXT NOT NULL,
+		author_id INTEGER NOT NULL REFERENCES users(id)
+	);
+	CREATE INDEX IF NOT EXISTS chirps_author_id ON chirps(author_id);`,
+
+	// 2: chirp timestamps and edit history
+	`ALTER TABLE chirps ADD COLUMN created_at TIMESTAMP NOT NULL DEFAULT '0001-01-01 00:00:00+00:00';
+	ALTER TABLE chirps ADD COLUMN updated_at TIMESTAMP NOT NULL DEFAULT '0001-01-01 00:00:00+00:00';
+	UPDATE chirps SET created_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP;
+
+	CREATE TABLE chirp_revisions (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		chirp_id    INTEGER NOT NULL REFERENCES chirps(id) ON DELETE CASCADE,
+		body        TEXT NOT NULL,
+		posted_at   TIMESTAMP NOT NULL,
+		replaced_at TIMESTAMP NOT NULL
+	);
+	CREATE INDEX chirp_revisions_chirp_id ON chirp_revisions(chirp_id);`,
+
+	// 3: chirp review queue. words is a JSON array.
+	`CREATE TABLE chirp_flags (
+		chirp_id   INTEGER PRIMARY KEY REFERENCES chirps(id) ON DELETE CASCADE,
+		words      TEXT NOT NULL,
+		flagged_at TIMESTAMP NOT NULL
+	);`,
+
+	// 4: user roles
+	`ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user';`,
+
+	// 5: sessions keyed by refresh token hash. The plaintext refresh tokens
+	// on users are dropped, logging everyone out once.
+	`CREATE TABLE sessions (
+		id           INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id      INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		token_hash   TEXT NOT NULL UNIQUE,
+		user_agent   TEXT NOT NULL,
+		ip           TEXT NOT NULL,
+		created_at   TIMESTAMP NOT NULL,
+		last_used_at TIMESTAMP NOT NULL,
+		expires_at   TIMESTAMP NOT NULL
+	);
+	CREATE INDEX sessions_user_id ON sessions(user_id);
+	DROP INDEX IF EXISTS users_refresh_token;
+	ALTER TABLE users DROP COLUMN refresh_token;
+	ALTER TABLE users DROP COLUMN refresh_expiry;`,
+
+	// 6: hashes of rotated-out refresh tokens, for reuse detection
+	`CREATE TABLE session_retired_tokens (
+		token_hash TEXT PRIMARY KEY,
+		session_id INTEGER NOT NULL REFERENCES sessions(id) ON DELETE CASCADE
+	);
+	CREATE INDEX session_retired_tokens_session_id ON session_retired_tokens(session_id);`,
+
+	// 7: access token denylist
+	`CREATE TABLE denied_tokens (
+		jti        TEXT PRIMARY KEY,
+		expires_at TIMESTAMP NOT NULL
+	);
+	CREATE INDEX denied_tokens_expires_at ON denied_tokens(expires_at);`,
+
+	// 8: audit log
+	`CREATE TABLE audit_log (
+		id       INTEGER PRIMARY KEY AUTOINCREMENT,
+		time     TIMESTAMP NOT NULL,
+		action   TEXT NOT NULL,
+		actor_id INTEGER NOT NULL DEFAULT 0,
+		user_id  INTEGER NOT NULL DEFAULT 0,
+		email    TEXT NOT NULL DEFAULT '',
+		ip       TEXT NOT NULL DEFAULT ''
+	);`,
+
+	// 9: password resets
+	`CREATE TABLE password_resets (
+		token_hash TEXT PRIMARY KEY,
+		user_id    INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		created_at TIMESTAMP NOT NULL,
+		expires_at TIMESTAMP NOT NULL
+	);
+	CREATE INDEX password_resets_user_id ON password_resets(user_id);`,
+}
+
+// NewSQLiteDB opens the SQLite database at path, creating the file and
+// schema if they don't exist
+func NewSQLiteDB(path string) (*SQLiteDB, error) {
+	conn, err := sql.Open("sqlite3", "file:"+path+"?_foreign_keys=on&_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+	db := &SQLiteDB{path: path, conn: conn}
+	if err := db.ensureSchema(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := db.buildSearchIndex(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Close closes the underlying database connection
+func (db *SQLiteDB) Close() error {
+	return db.conn.Close()
+}
+
+func (db *SQLiteDB) buildSearchIndex() error {
+	chirps, err := db.GetChirps(context.Background())
+	if err != nil {
+		return err
+	}
+	byID := make(map[int]Chirp, len(chirps))
+	for _, chirp := range chirps {
+		byID[chirp.ID] = chirp
+	}
+	db.searchMux.Lock()
+	db.search = newSearchIndex(byID)
+	db.searchMux.Unlock()
+	return nil
+}
+
+// ensureSchema applies any sqliteMigrations the file hasn't seen yet
+func (db *SQLiteDB) ensureSchema() error {
+	var version int
+	if err := db.conn.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version > len(sqliteMigrations) {
+		return fmt.Errorf("%w: file is version %d, binary supports up to %d",
+			ErrSchemaTooNew, version, len(sqliteMigrations))
+	}
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := db.conn.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("sqlite migration %d: %w", i+1, err)
+		}
+		// PRAGMA doesn't take bound parameters
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ResetDB removes every chirp and user
+func (db *SQLiteDB) ResetDB(ctx context.Context) error {
+	db.chirpWrites.Lock()
+	defer db.chirpWrites.Unlock()
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range []string{
+		"DELETE FROM chirp_flags",
+		"DELETE FROM chirp_revisions",
+		"DELETE FROM chirps",
+		"DELETE FROM audit_log",
+		"DELETE FROM password_resets",
+		"DELETE FROM denied_tokens",
+		"DELETE FROM session_retired_tokens",
+		"DELETE FROM sessions",
+		"DELETE FROM users",
+		"DELETE FROM sqlite_sequence WHERE name IN ('audit_log', 'chirp_revisions', 'chirps', 'sessions', 'users')",
+	} {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	db.searchMux.Lock()
+	db.search = newSearchIndex(nil)
+	db.searchMux.Unlock()
+	return nil
+}
+
+const chirpColumns = "id, body, author_id, created_at, updated_at"
+
+func scanChirp(row rowScanner) (Chirp, error) {
+	var c Chirp
+	err := row.Scan(&c.ID, &c.Body, &c.AuthorID, &c.CreatedAt, &c.UpdatedAt)
+	return c, err
+}
+
+// CreateChirp inserts a new chirp
+func (db *SQLiteDB) CreateChirp(ctx context.Context, body string, userId int) (Chirp, error) {
+	db.chirpWrites.Lock()
+	defer db.chirpWrites.Unlock()
+	now := time.Now().UTC()
+	res, err := db.conn.ExecContext(ctx,
+		"INSERT INTO chirps (body, author_id, created_at, updated_at) VALUES (?, ?, ?, ?)",
+		body, userId, now, now,
+	)
+	if err != nil {
+		return Chirp{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Chirp{}, err
+	}
+	db.searchMux.Lock()
+	db.search.add(int(id), body)
+	db.searchMux.Unlock()
+	return Chirp{ID: int(id), Body: body, AuthorID: userId, CreatedAt: now, UpdatedAt: now}, nil
+}
+
+// GetChirps returns all chirps in the database
+func (db *SQLiteDB) GetChirps(ctx context.Context) ([]Chirp, error) {
+	rows, err := db.conn.QueryContext(ctx, "SELECT "+chirpColumns+" FROM chirps ORDER BY id")
+	if err != nil {
+		return []Chirp{}, err
+	}
+	defer rows.Close()
+	chirps := []Chirp{}
+	for rows.Next() {
+		c, err := scanChirp(rows)
+		if err != nil {
+			return []Chirp{}, err
+		}
+		chirps = append(chirps, c)
+	}
+	return chirps, rows.Err()
+}
+
+// CountChirps returns the number of chirps in the database
+func (db *SQLiteDB) CountChirps(ctx context.Context) (int, error) {
+	var n int
+	err := db.conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM chirps").Scan(&n)
+	return n, err
+}
+
+// GetChirpsPage returns one page of chirps using the primary key and the
+// author index
+func (db *SQLiteDB) GetChirpsPage(ctx context.Context, q ChirpQuery) (ChirpPage, error) {
+	query := "SELECT " + chirpColumns + " FROM chirps WHERE 1 = 1"
+	args := []any{}
+	if q.AuthorID != 0 {
+		query += " AND author_id = ?"
+		args = append(args, q.AuthorID)
+	}
+	order := "ASC"
+	if q.Desc {
+		order = "DESC"
+		if q.AfterID != 0 {
+			query += " AND id < ?"
+			args = append(args, q.AfterID)
+		}
+	} else if q.AfterID != 0 {
+		query += " AND id > ?"
+		args = append(args, q.AfterID)
+	}
+	// Ask for one extra row to learn whether another page follows
+	query += " ORDER BY id " + order + " LIMIT ?"
+	args = append(args, q.Limit+1)
+
+	rows, err := db.conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return ChirpPage{Chirps: []Chirp{}}, err
+	}
+	defer rows.Close()
+	page := ChirpPage{Chirps: []Chirp{}}
+	for rows.Next() {
+		c, err := scanChirp(rows)
+		if err != nil {
+			return ChirpPage{Chirps: []Chirp{}}, err
+		}
+		page.Chirps = append(page.Chirps, c)
+	}
+	if len(page.Chirps) > q.Limit {
+		page.Chirps = page.Chirps[:q.Limit]
+		page.NextAfterID = page.Chirps[q.Limit-1].ID
+	}
+	return page, rows.Err()
+}
+
+// FlagChirp queues a chirp for review because it contains words
+func (db *SQLiteDB) FlagChirp(ctx context.Context, id int, words []string) error {
+	if _, ok := db.GetSingleChirp(ctx, id); !ok {
+		return ErrChirpNotFound
+	}
+	encoded, err := json.Marshal(words)
+	if err != nil {
+		return err
+	}
+	_, err = db.conn.ExecContext(ctx,
+		"INSERT OR REPLACE INTO chirp_flags (chirp_id, words, flagged_at) VALUES (?, ?, ?)",
+		id, string(encoded), time.Now().UTC(),
+	)
+	return err
+}
+
+// GetFlaggedChirps returns the chirps awaiting review, oldest flag first
+func (db *SQLiteDB) GetFlaggedChirps(ctx context.Context) ([]FlaggedChirp, error) {
+	rows, err := db.conn.QueryContext(ctx,
+		"SELECT c.id, c.body, c.author_id, c.created_at, c.updated_at, f.words, f.flagged_at "+
+			"FROM chirp_flags f JOIN chirps c ON c.id = f.chirp_id ORDER BY f.flagged_at",
+	)
+	if err != nil {
+		return []FlaggedChirp{}, err
+	}
+	defer rows.Close()
+	flagged := []FlaggedChirp{}
+	for rows.Next() {
+		var f FlaggedChirp
+		var words string
+		err := rows.Scan(&f.Chirp.ID, &f.Chirp.Body, &f.Chirp.AuthorID, &f.Chirp.CreatedAt,
+			&f.Chirp.UpdatedAt, &words, &f.FlaggedAt)
+		if err != nil {
+			return []FlaggedChirp{}, err
+		}
+		if err := json.Unmarshal([]byte(words), &f.Words); err != nil {
+			return []FlaggedChirp{}, err
+		}
+		flagged = append(flagged, f)
+	}
+	return flagged, rows.Err()
+}
+
+// ClearChirpFlag removes a chirp from the review queue
+func (db *SQLiteDB) ClearChirpFlag(ctx context.Context, id int) error {
+	res, err := db.conn.ExecContext(ctx, "DELETE FROM chirp_flags WHERE chirp_id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrChirpNotFound
+	}
+	return nil
+}
+
+// SearchChirps returns up to limit chirps matching query, most relevant
+// first
+func (db *SQLiteDB) SearchChirps(ctx context.Context, query string, limit int) ([]Chirp, error) {
+	db.searchMux.RLock()
+	ids := db.search.search(query)
+	db.searchMux.RUnlock()
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	if len(ids) == 0 {
+		return []Chirp{}, nil
+	}
+
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	placeholders := strings.Repeat(", ?", len(ids))[2:]
+	rows, err := db.conn.QueryContext(ctx, "SELECT "+chirpColumns+" FROM chirps WHERE id IN ("+placeholders+")", args...)
+	if err != nil {
+		return []Chirp{}, err
+	}
+	defer rows.Close()
+	byID := make(map[int]Chirp, len(ids))
+	for rows.Next() {
+		c, err := scanChirp(rows)
+		if err != nil {
+			return []Chirp{}, err
+		}
+		byID[c.ID] = c
+	}
+	if err := rows.Err(); err != nil {
+		return []Chirp{}, err
+	}
+	chirps := []Chirp{}
+	for _, id := range ids {
+		// A chirp deleted since the search ran is simply skipped
+		if chirp, ok := byID[id]; ok {
+			chirps = append(chirps, chirp)
+		}
+	}
+	return chirps, nil
+}
+
+func (db *SQLiteDB) GetSingleChirp(ctx context.Context, id int) (Chirp, bool) {
+	c, err := scanChirp(db.conn.QueryRowContext(ctx, "SELECT "+chirpColumns+" FROM chirps WHERE id = ?", id))
+	if err != nil {
+		return Chirp{}, false
+	}
+	return c, true
+}
+
+// UpdateChirp replaces the body of a chirp owned by userid, keeping the old
+// body in chirp_revisions
+func (db *SQLiteDB) UpdateChirp(ctx context.Context, id, userid int, body string) (Chirp, error) {
+	db.chirpWrites.Lock()
+	defer db.chirpWrites.Unlock()
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	chirp, err := scanChirp(tx.QueryRowContext(ctx, "SELECT "+chirpColumns+" FROM chirps WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, ErrChirpNotFound
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+	if chirp.AuthorID != userid {
+		return Chirp{}, ErrNotChirpAuthor
+	}
+
+	now := time.Now().UTC()
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO chirp_revisions (chirp_id, body, posted_at, replaced_at) VALUES (?, ?, ?, ?)",
+		id, chirp.Body, chirp.UpdatedAt, now,
+	)
+	if err != nil {
+		return Chirp{}, err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE chirps SET body = ?, updated_at = ? WHERE id = ?", body, now, id); err != nil {
+		return Chirp{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Chirp{}, err
+	}
+	db.searchMux.Lock()
+	db.search.add(id, body)
+	db.searchMux.Unlock()
+	chirp.Body = body
+	chirp.UpdatedAt = now
+	return chirp, nil
+}
+
+// GetChirpHistory returns the previous bodies of a chirp, oldest first
+func (db *SQLiteDB) GetChirpHistory(ctx context.Context, id int) ([]ChirpRevision, error) {
+	if _, ok := db.GetSingleChirp(ctx, id); !ok {
+		return []ChirpRevision{}, ErrChirpNotFound
+	}
+	rows, err := db.conn.QueryContext(ctx,
+		"SELECT body, posted_at, replaced_at FROM chirp_revisions WHERE chirp_id = ? ORDER BY id", id,
+	)
+	if err != nil {
+		return []ChirpRevision{}, err
+	}
+	defer rows.Close()
+	history := []ChirpRevision{}
+	for rows.Next() {
+		var r ChirpRevision
+		if err := rows.Scan(&r.Body, &r.PostedAt, &r.ReplacedAt); err != nil {
+			return []ChirpRevision{}, err
+		}
+		history = append(history, r)
+	}
+	return history, rows.Err()
+}
+
+// DeleteChirp deletes the chirp if it belongs to userid
+func (db *SQLiteDB) DeleteChirp(ctx context.Context, id, userid int) error {
+	db.chirpWrites.Lock()
+	defer db.chirpWrites.Unlock()
+	res, err := db.conn.ExecContext(ctx, "DELETE FROM chirps WHERE id = ? AND author_id = ?", id, userid)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotChirpAuthor
+	}
+	db.searchMux.Lock()
+	db.search.remove(id)
+	db.searchMux.Unlock()
+	return nil
+}
+
+// DeleteAnyChirp deletes a chirp regardless of its author
+func (db *SQLiteDB) DeleteAnyChirp(ctx context.Context, id int) error {
+	db.chirpWrites.Lock()
+	defer db.chirpWrites.Unlock()
+	res, err := db.conn.ExecContext(ctx, "DELETE FROM chirps WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrChirpNotFound
+	}
+	db.searchMux.Lock()
+	db.search.remove(id)
+	db.searchMux.Unlock()
+	return nil
+}
+
+const userColumns = "id, email, password, is_chirpy_red, role"
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanUser(row rowScanner) (User, error) {
+	var u User
+	err := row.Scan(&u.ID, &u.Email, &u.Password, &u.IsChirpyRed, &u.Role)
+	return u, err
+}
+
+// CreateUser inserts a new user with an already hashed password
+func (db *SQLiteDB) CreateUser(ctx context.Context, email, passwordHash string) (UserExternal, error) {
+	if _, ok := db.GetSingleUserByEmail(ctx, email); ok {
+		return UserExternal{}, errors.New("User already exists")
+	}
+	res, err := db.conn.ExecContext(ctx, "INSERT INTO users (email, password) VALUES (?, ?)", email, passwordHash)
+	if err != nil {
+		return UserExternal{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return UserExternal{}, err
+	}
+	return DbUsertoUserX(User{ID: int(id), Email: email, Password: passwordHash, Role: RoleUser}), nil
+}
+
+// GetUsers returns all users in the database
+func (db *SQLiteDB) GetUsers(ctx context.Context) ([]User, error) {
+	rows, err := db.conn.QueryContext(ctx, "SELECT "+userColumns+" FROM users ORDER BY id")
+	if err != nil {
+		return []User{}, err
+	}
+	defer rows.Close()
+	users := []User{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return []User{}, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// CountUsers returns the number of users in the database
+func (db *SQLiteDB) CountUsers(ctx context.Context) (int, error) {
+	var n int
+	err := db.conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM users").Scan(&n)
+	return n, err
+}
+
+func (db *SQLiteDB) GetSingleUser(ctx context.Context, id int) (User, bool) {
+	u, err := scanUser(db.conn.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE id = ?", id))
+	if err != nil {
+		return User{}, false
+	}
+	return u, true
+}
+
+func (db *SQLiteDB) GetSingleUserByEmail(ctx context.Context, email string) (User, bool) {
+	u, err := scanUser(db.conn.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE email = ?", email))
+	if err != nil {
+		return User{}, false
+	}
+	return u, true
+}
+
+func (db *SQLiteDB) UpdateSingleUser(ctx context.Context, id int, params UpdateUserParams) (UserExternal, error) {
+	usr, ok := db.GetSingleUser(ctx, id)
+	if !ok {
+		return UserExternal{}, ErrUserNotFound
+	}
+
+	_, err := db.conn.ExecContext(ctx,
+		"UPDATE users SET email = ?, password = ? WHERE id = ?",
+		params.Email, params.Password, id,
+	)
+	if err != nil {
+		return UserExternal{}, err
+	}
+	return UserExternal{
+		Email:       params.Email,
+		ID:          id,
+		IsChirpyRed: usr.IsChirpyRed,
+		Role:        usr.Role,
+	}, nil
+}
+
+func (db *SQLiteDB) UpgradeUser(ctx context.Context, userid int) error {
+	res, err := db.conn.ExecContext(ctx, "UPDATE users SET is_chirpy_red = 1 WHERE id = ?", userid)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// SetUserRole changes a user's role
+func (db *SQLiteDB) SetUserRole(ctx context.Context, userid int, role Role) error {
+	res, err := db.conn.ExecContext(ctx, "UPDATE users SET role = ? WHERE id = ?", role, userid)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// DenyToken rejects the access token with ID jti until it expires at
+// expiresAt. Entries for tokens that have since expired are pruned at the
+// same time.
+func (db *SQLiteDB) DenyToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "DELETE FROM denied_tokens WHERE expires_at < ?", time.Now().UTC()); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		"INSERT INTO denied_tokens (jti, expires_at) VALUES (?, ?) ON CONFLICT (jti) DO NOTHING", jti, expiresAt.UTC(),
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// IsTokenDenied reports whether the access token with ID jti was revoked
+func (db *SQLiteDB) IsTokenDenied(ctx context.Context, jti string) (bool, error) {
+	var denied bool
+	err := db.conn.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM denied_tokens WHERE jti = ?)", jti).Scan(&denied)
+	return denied, err
+}
+
+// CreatePasswordReset stores a password reset, replacing any the user
+// already had. Expired resets are pruned at the same time.
+func (db *SQLiteDB) CreatePasswordReset(ctx context.Context, reset PasswordReset) error {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx,
+		"DELETE FROM password_resets WHERE user_id = ? OR expires_at < ?", reset.UserID, time.Now().UTC(),
+	); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		"INSERT INTO password_resets (token_hash, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)",
+		reset.TokenHash, reset.UserID, reset.CreatedAt.UTC(), reset.ExpiresAt.UTC(),
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetPasswordReset returns the unexpired password reset with tokenHash
+func (db *SQLiteDB) GetPasswordReset(ctx context.Context, tokenHash string) (PasswordReset, error) {
+	var r PasswordReset
+	err := db.conn.QueryRowContext(ctx,
+		"SELECT token_hash, user_id, created_at, expires_at FROM password_resets WHERE token_hash = ? AND expires_at >= ?",
+		tokenHash, time.Now().UTC(),
+	).Scan(&r.TokenHash, &r.UserID, &r.CreatedAt, &r.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return PasswordReset{}, ErrResetTokenInvalid
+	}
+	return r, err
+}
+
+// ResetPassword uses up the unexpired password reset with tokenHash to set
+// the user's password hash to passwordHash, and ends all of their sessions.
+// It returns the user's ID.
+func (db *SQLiteDB) ResetPassword(ctx context.Context, tokenHash, passwordHash string) (int, error) {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var userID int
+	err = tx.QueryRowContext(ctx,
+		"DELETE FROM password_resets WHERE token_hash = ? AND expires_at >= ? RETURNING user_id",
+		tokenHash, time.Now().UTC(),
+	).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrResetTokenInvalid
+	}
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET password = ? WHERE id = ?", passwordHash, userID); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM password_resets WHERE user_id = ?", userID); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM sessions WHERE user_id = ?", userID); err != nil {
+		return 0, err
+	}
+	return userID, tx.Commit()
+}
+
+// AddAuditEntry appends an entry to the audit log and returns it with its ID
+func (db *SQLiteDB) AddAuditEntry(ctx context.Context, entry AuditEntry) (AuditEntry, error) {
+	res, err := db.conn.ExecContext(ctx,
+		"INSERT INTO audit_log (time, action, actor_id, user_id, email, ip) VALUES (?, ?, ?, ?, ?, ?)",
+		entry.Time.UTC(), entry.Action, entry.ActorID, entry.UserID, entry.Email, entry.IP,
+	)
+	if err != nil {
+		return AuditEntry{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return AuditEntry{}, err
+	}
+	entry.ID = int(id)
+	return entry, nil
+}
+
+// GetAuditEntries returns up to limit audit log entries, newest first
+func (db *SQLiteDB) GetAuditEntries(ctx context.Context, limit int) ([]AuditEntry, error) {
+	rows, err := db.conn.QueryContext(ctx,
+		"SELECT id, time, action, actor_id, user_id, email, ip FROM audit_log ORDER BY id DESC LIMIT ?", limit,
+	)
+	if err != nil {
+		return []AuditEntry{}, err
+	}
+	defer rows.Close()
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.ID, &e.Time, &e.Action, &e.ActorID, &e.UserID, &e.Email, &e.IP); err != nil {
+			return []AuditEntry{}, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+const sessionColumns = "id, user_id, token_hash, user_agent, ip, created_at, last_used_at, expires_at"
+
+func scanSession(row rowScanner) (Session, error) {
+	var s Session
+	err := row.Scan(&s.ID, &s.UserID, &s.TokenHash, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastUsedAt, &s.ExpiresAt)
+	return s, err
+}
+
+// CreateSession stores a new session and returns it with its ID. Expired
+// sessions are pruned at the same time.
+func (db *SQLiteDB) CreateSession(ctx context.Context, session Session) (Session, error) {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return Session{}, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "DELETE FROM sessions WHERE expires_at < ?", time.Now().UTC()); err != nil {
+		return Session{}, err
+	}
+	res, err := tx.ExecContext(ctx,
+		"INSERT INTO sessions (user_id, token_hash, user_agent, ip, created_at, last_used_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		session.UserID, session.TokenHash, session.UserAgent, session.IP, session.CreatedAt, session.LastUsedAt, session.ExpiresAt,
+	)
+	if err != nil {
+		return Session{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Session{}, err
+	}
+	session.ID = int(id)
+	return session, tx.Commit()
+}
+
+// RotateSession replaces the refresh token hash of the unexpired session
+// holding tokenHash with newHash and records that it was used. If tokenHash
+// was already rotated out the session is revoked and returned together with
+// ErrRefreshTokenReused.
+func (db *SQLiteDB) RotateSession(ctx context.Context, tokenHash, newHash string) (Session, error) {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return Session{}, err
+	}
+	defer tx.Rollback()
+	now := time.Now().UTC()
+	session, err := scanSession(tx.QueryRowContext(ctx,
+		"UPDATE sessions SET token_hash = ?, last_used_at = ? WHERE token_hash = ? AND expires_at >= ? RETURNING "+sessionColumns,
+		newHash, now, tokenHash, now,
+	))
+	if err == nil {
+		if _, err := tx.ExecContext(ctx,
+			"INSERT INTO session_retired_tokens (token_hash, session_id) VALUES (?, ?)", tokenHash, session.ID,
+		); err != nil {
+			return Session{}, err
+		}
+		if _, err := tx.ExecContext(ctx,
+			`DELETE FROM session_retired_tokens WHERE session_id = ? AND rowid NOT IN (
+				SELECT rowid FROM session_retired_tokens WHERE session_id = ? ORDER BY rowid DESC LIMIT ?)`,
+			session.ID, session.ID, maxRetiredTokens,
+		); err != nil {
+			return Session{}, err
+		}
+		return session, tx.Commit()
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return Session{}, err
+	}
+	session, err = scanSession(tx.QueryRowContext(ctx,
+		"DELETE FROM sessions WHERE id = (SELECT session_id FROM session_retired_tokens WHERE token_hash = ?) RETURNING "+sessionColumns,
+		tokenHash,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Session{}, ErrSessionNotFound
+	}
+	if err != nil {
+		return Session{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Session{}, err
+	}
+	return session, ErrRefreshTokenReused
+}
+
+// GetUserSessions returns a user's unexpired sessions, oldest first
+func (db *SQLiteDB) GetUserSessions(ctx context.Context, userid int) ([]Session, error) {
+	rows, err := db.conn.QueryContext(ctx,
+		"SELECT "+sessionColumns+" FROM sessions WHERE user_id = ? AND expires_at >= ? ORDER BY id",
+		userid, time.Now().UTC(),
+	)
+	if err != nil {
+		return []Session{}, err
+	}
+	defer rows.Close()
+	sessions := []Session{}
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return []Session{}, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// RevokeSession ends one of a user's sessions
+func (db *SQLiteDB) RevokeSession(ctx context.Context, userid, id int) error {
+	res, err := db.conn.ExecContext(ctx, "DELETE FROM sessions WHERE id = ? AND user_id = ?", id, userid)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeSessionByToken ends the session a refresh token hash belongs to
+func (db *SQLiteDB) RevokeSessionByToken(ctx context.Context, tokenHash string) error {
+	res, err := db.conn.ExecContext(ctx, "DELETE FROM sessions WHERE token_hash = ?", tokenHash)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeUserSessions ends every session of a user
+func (db *SQLiteDB) RevokeUserSessions(ctx context.Context, userid int) error {
+	_, err := db.conn.ExecContext(ctx, "DELETE FROM sessions WHERE user_id = ?", userid)
+	return err
+}
@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Store is the persistence layer used by the HTTP handlers. The JSON file
+// database (DB) and the SQLite database (SQLiteDB) both implement it.
+type Store interface {
+	CreateChirp(ctx context.Context, body string, userId int) (Chirp, error)
+	GetChirps(ctx context.Context) ([]Chirp, error)
+	CountChirps(ctx context.Context) (int, error)
+	GetChirpsPage(ctx context.Context, q ChirpQuery) (ChirpPage, error)
+	GetSingleChirp(ctx context.Context, id int) (Chirp, bool)
+	DeleteChirp(ctx context.Context, id, userid int) error
+	DeleteAnyChirp(ctx context.Context, id int) error
+	UpdateChirp(ctx context.Context, id, userid int, body string) (Chirp, error)
+	GetChirpHistory(ctx context.Context, id int) ([]ChirpRevision, error)
+	SearchChirps(ctx context.Context, query string, limit int) ([]Chirp, error)
+	FlagChirp(ctx context.Context, id int, words []string) error
+	GetFlaggedChirps(ctx context.Context) ([]FlaggedChirp, error)
+	ClearChirpFlag(ctx context.Context, id int) error
+
+	CreateUser(ctx context.Context, email, passwordHash string) (UserExternal, error)
+	GetUsers(ctx context.Context) ([]User, error)
+	CountUsers(ctx context.Context) (int, error)
+	GetSingleUser(ctx context.Context, id int) (User, bool)
+	GetSingleUserByEmail(ctx context.Context, email string) (User, bool)
+	UpdateSingleUser(ctx context.Context, id int, params UpdateUserParams) (UserExternal, error)
+	UpgradeUser(ctx context.Context, userid int) error
+	SetUserRole(ctx context.Context, userid int, role Role) error
+
+	CreateSession(ctx context.Context, session Session) (Session, error)
+	RotateSession(ctx context.Context, tokenHash, newHash string) (Session, error)
+	GetUserSessions(ctx context.Context, userid int) ([]Session, error)
+	RevokeSession(ctx context.Context, userid, id int) error
+	RevokeSessionByToken(ctx context.Context, tokenHash string) error
+	RevokeUserSessions(ctx context.Context, userid int) error
+
+	DenyToken(ctx context.Context, jti string, expiresAt time.Time) error
+	IsTokenDenied(ctx context.Context, jti string) (bool, error)
+
+	CreatePasswordReset(ctx context.Context, reset PasswordReset) error
+	GetPasswordReset(ctx context.Context, tokenHash string) (PasswordReset, error)
+	ResetPassword(ctx context.Context, tokenHash, passwordHash string) (int, error)
+
+	AddAuditEntry(ctx context.Context, entry AuditEntry) (AuditEntry, error)
+	GetAuditEntries(ctx context.Context, limit int) ([]AuditEntry, error)
+
+	ResetDB(ctx context.Context) error
+	Close() error
+}
+
+// maxRetiredTokens is how many of a session's rotated-out refresh token
+// hashes are kept to detect their reuse. Replays come soon after a token is
+// stolen; an older token is still rejected but no longer revokes the
+// session.
+const maxRetiredTokens = 20
+
+// ChirpQuery selects one page of chirps ordered by ID
+type ChirpQuery struct {
+	// AuthorID limits the page to one author's chirps when non-zero
+	AuthorID int
+	// Desc orders chirps newest first
+	Desc bool
+	// AfterID starts the page after this chirp ID in the chosen order.
+	// Zero starts from the beginning.
+	AfterID int
+	// Limit is the maximum number of chirps returned and must be positive
+	Limit int
+}
+
+// ChirpPage is one page of chirps. NextAfterID is the AfterID of the next
+// page, or zero if this is the last one.
+type ChirpPage struct {
+	Chirps      []Chirp
+	NextAfterID int
+}
+
+var (
+	// ErrUserNotFound is returned when no user has the requested ID
+	ErrUserNotFound = errors.New("user not found")
+	// ErrChirpNotFound is returned when no chirp has the requested ID
+	ErrChirpNotFound = errors.New("chirp not found")
+	// ErrNotChirpAuthor is returned when a chirp is missing or belongs to
+	// someone other than the requesting user
+	ErrNotChirpAuthor = errors.New("cannot find matching user")
+	// ErrSessionNotFound is returned for an unknown or expired refresh
+	// token, or a session that belongs to someone else
+	ErrSessionNotFound = errors.New("session not found")
+	// ErrRefreshTokenReused is returned when a refresh token that was
+	// already rotated out is presented again. The session it belonged to has
+	// been revoked, since either the client or an attacker holds a stolen
+	// copy.
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+	// ErrResetTokenInvalid is returned for a password reset token that is
+	// unknown, expired or already used
+	ErrResetTokenInvalid = errors.New("invalid or expired password reset token")
+)
+
+var (
+	_ Store = (*DB)(nil)
+	_ Store = (*SQLiteDB)(nil)
+)
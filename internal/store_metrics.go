@@ -0,0 +1,292 @@
+package internal
+
+import (
+	"context"
+	"time"
+)
+
+// instrumentedStore times every call to the wrapped Store. It deliberately
+// doesn't embed Store, so adding a method to the interface without timing it
+// here fails to compile.
+type instrumentedStore struct {
+	store Store
+	ops   *Histogram
+}
+
+var _ Store = (*instrumentedStore)(nil)
+
+// InstrumentStore returns s with the duration of every call recorded in ops,
+// labelled with the method name and its result (ok, error or not_found). ops must have the
+// labels "op" and "result".
+func InstrumentStore(s Store, ops *Histogram) Store {
+	return &instrumentedStore{store: s, ops: ops}
+}
+
+func (s *instrumentedStore) observe(op string, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	s.ops.Observe(time.Since(start).Seconds(), op, result)
+}
+
+// observeLookup records a lookup that reports a miss with a bool
+func (s *instrumentedStore) observeLookup(op string, start time.Time, found bool) {
+	result := "ok"
+	if !found {
+		result = "not_found"
+	}
+	s.ops.Observe(time.Since(start).Seconds(), op, result)
+}
+
+func (s *instrumentedStore) CreateChirp(ctx context.Context, body string, userId int) (Chirp, error) {
+	start := time.Now()
+	v, err := s.store.CreateChirp(ctx, body, userId)
+	s.observe("CreateChirp", start, err)
+	return v, err
+}
+
+func (s *instrumentedStore) GetChirps(ctx context.Context) ([]Chirp, error) {
+	start := time.Now()
+	v, err := s.store.GetChirps(ctx)
+	s.observe("GetChirps", start, err)
+	return v, err
+}
+
+func (s *instrumentedStore) CountChirps(ctx context.Context) (int, error) {
+	start := time.Now()
+	v, err := s.store.CountChirps(ctx)
+	s.observe("CountChirps", start, err)
+	return v, err
+}
+
+func (s *instrumentedStore) GetChirpsPage(ctx context.Context, q ChirpQuery) (ChirpPage, error) {
+	start := time.Now()
+	v, err := s.store.GetChirpsPage(ctx, q)
+	s.observe("GetChirpsPage", start, err)
+	return v, err
+}
+
+func (s *instrumentedStore) GetSingleChirp(ctx context.Context, id int) (Chirp, bool) {
+	start := time.Now()
+	v, ok := s.store.GetSingleChirp(ctx, id)
+	s.observeLookup("GetSingleChirp", start, ok)
+	return v, ok
+}
+
+func (s *instrumentedStore) DeleteChirp(ctx context.Context, id, userid int) error {
+	start := time.Now()
+	err := s.store.DeleteChirp(ctx, id, userid)
+	s.observe("DeleteChirp", start, err)
+	return err
+}
+
+func (s *instrumentedStore) DeleteAnyChirp(ctx context.Context, id int) error {
+	start := time.Now()
+	err := s.store.DeleteAnyChirp(ctx, id)
+	s.observe("DeleteAnyChirp", start, err)
+	return err
+}
+
+func (s *instrumentedStore) UpdateChirp(ctx context.Context, id, userid int, body string) (Chirp, error) {
+	start := time.Now()
+	v, err := s.store.UpdateChirp(ctx, id, userid, body)
+	s.observe("UpdateChirp", start, err)
+	return v, err
+}
+
+func (s *instrumentedStore) GetChirpHistory(ctx context.Context, id int) ([]ChirpRevision, error) {
+	start := time.Now()
+	v, err := s.store.GetChirpHistory(ctx, id)
+	s.observe("GetChirpHistory", start, err)
+	return v, err
+}
+
+func (s *instrumentedStore) SearchChirps(ctx context.Context, query string, limit int) ([]Chirp, error) {
+	start := time.Now()
+	v, err := s.store.SearchChirps(ctx, query, limit)
+	s.observe("SearchChirps", start, err)
+	return v, err
+}
+
+func (s *instrumentedStore) FlagChirp(ctx context.Context, id int, words []string) error {
+	start := time.Now()
+	err := s.store.FlagChirp(ctx, id, words)
+	s.observe("FlagChirp", start, err)
+	return err
+}
+
+func (s *instrumentedStore) GetFlaggedChirps(ctx context.Context) ([]FlaggedChirp, error) {
+	start := time.Now()
+	v, err := s.store.GetFlaggedChirps(ctx)
+	s.observe("GetFlaggedChirps", start, err)
+	return v, err
+}
+
+func (s *instrumentedStore) ClearChirpFlag(ctx context.Context, id int) error {
+	start := time.Now()
+	err := s.store.ClearChirpFlag(ctx, id)
+	s.observe("ClearChirpFlag", start, err)
+	return err
+}
+
+func (s *instrumentedStore) CreateUser(ctx context.Context, email, passwordHash string) (UserExternal, error) {
+	start := time.Now()
+	v, err := s.store.CreateUser(ctx, email, passwordHash)
+	s.observe("CreateUser", start, err)
+	return v, err
+}
+
+func (s *instrumentedStore) GetUsers(ctx context.Context) ([]User, error) {
+	start := time.Now()
+	v, err := s.store.GetUsers(ctx)
+	s.observe("GetUsers", start, err)
+	return v, err
+}
+
+func (s *instrumentedStore) CountUsers(ctx context.Context) (int, error) {
+	start := time.Now()
+	v, err := s.store.CountUsers(ctx)
+	s.observe("CountUsers", start, err)
+	return v, err
+}
+
+func (s *instrumentedStore) GetSingleUser(ctx context.Context, id int) (User, bool) {
+	start := time.Now()
+	v, ok := s.store.GetSingleUser(ctx, id)
+	s.observeLookup("GetSingleUser", start, ok)
+	return v, ok
+}
+
+func (s *instrumentedStore) GetSingleUserByEmail(ctx context.Context, email string) (User, bool) {
+	start := time.Now()
+	v, ok := s.store.GetSingleUserByEmail(ctx, email)
+	s.observeLookup("GetSingleUserByEmail", start, ok)
+	return v, ok
+}
+
+func (s *instrumentedStore) UpdateSingleUser(ctx context.Context, id int, params UpdateUserParams) (UserExternal, error) {
+	start := time.Now()
+	v, err := s.store.UpdateSingleUser(ctx, id, params)
+	s.observe("UpdateSingleUser", start, err)
+	return v, err
+}
+
+func (s *instrumentedStore) UpgradeUser(ctx context.Context, userid int) error {
+	start := time.Now()
+	err := s.store.UpgradeUser(ctx, userid)
+	s.observe("UpgradeUser", start, err)
+	return err
+}
+
+func (s *instrumentedStore) SetUserRole(ctx context.Context, userid int, role Role) error {
+	start := time.Now()
+	err := s.store.SetUserRole(ctx, userid, role)
+	s.observe("SetUserRole", start, err)
+	return err
+}
+
+func (s *instrumentedStore) CreateSession(ctx context.Context, session Session) (Session, error) {
+	start := time.Now()
+	v, err := s.store.CreateSession(ctx, session)
+	s.observe("CreateSession", start, err)
+	return v, err
+}
+
+func (s *instrumentedStore) RotateSession(ctx context.Context, tokenHash, newHash string) (Session, error) {
+	start := time.Now()
+	v, err := s.store.RotateSession(ctx, tokenHash, newHash)
+	s.observe("RotateSession", start, err)
+	return v, err
+}
+
+func (s *instrumentedStore) GetUserSessions(ctx context.Context, userid int) ([]Session, error) {
+	start := time.Now()
+	v, err := s.store.GetUserSessions(ctx, userid)
+	s.observe("GetUserSessions", start, err)
+	return v, err
+}
+
+func (s *instrumentedStore) RevokeSession(ctx context.Context, userid, id int) error {
+	start := time.Now()
+	err := s.store.RevokeSession(ctx, userid, id)
+	s.observe("RevokeSession", start, err)
+	return err
+}
+
+func (s *instrumentedStore) RevokeSessionByToken(ctx context.Context, tokenHash string) error {
+	start := time.Now()
+	err := s.store.RevokeSessionByToken(ctx, tokenHash)
+	s.observe("RevokeSessionByToken", start, err)
+	return err
+}
+
+func (s *instrumentedStore) RevokeUserSessions(ctx context.Context, userid int) error {
+	start := time.Now()
+	err := s.store.RevokeUserSessions(ctx, userid)
+	s.observe("RevokeUserSessions", start, err)
+	return err
+}
+
+func (s *instrumentedStore) DenyToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	start := time.Now()
+	err := s.store.DenyToken(ctx, jti, expiresAt)
+	s.observe("DenyToken", start, err)
+	return err
+}
+
+func (s *instrumentedStore) IsTokenDenied(ctx context.Context, jti string) (bool, error) {
+	start := time.Now()
+	v, err := s.store.IsTokenDenied(ctx, jti)
+	s.observe("IsTokenDenied", start, err)
+	return v, err
+}
+
+func (s *instrumentedStore) CreatePasswordReset(ctx context.Context, reset PasswordReset) error {
+	start := time.Now()
+	err := s.store.CreatePasswordReset(ctx, reset)
+	s.observe("CreatePasswordReset", start, err)
+	return err
+}
+
+func (s *instrumentedStore) GetPasswordReset(ctx context.Context, tokenHash string) (PasswordReset, error) {
+	start := time.Now()
+	v, err := s.store.GetPasswordReset(ctx, tokenHash)
+	s.observe("GetPasswordReset", start, err)
+	return v, err
+}
+
+func (s *instrumentedStore) ResetPassword(ctx context.Context, tokenHash, passwordHash string) (int, error) {
+	start := time.Now()
+	v, err := s.store.ResetPassword(ctx, tokenHash, passwordHash)
+	s.observe("ResetPassword", start, err)
+	return v, err
+}
+
+func (s *instrumentedStore) AddAuditEntry(ctx context.Context, entry AuditEntry) (AuditEntry, error) {
+	start := time.Now()
+	v, err := s.store.AddAuditEntry(ctx, entry)
+	s.observe("AddAuditEntry", start, err)
+	return v, err
+}
+
+func (s *instrumentedStore) GetAuditEntries(ctx context.Context, limit int) ([]AuditEntry, error) {
+	start := time.Now()
+	v, err := s.store.GetAuditEntries(ctx, limit)
+	s.observe("GetAuditEntries", start, err)
+	return v, err
+}
+
+func (s *instrumentedStore) ResetDB(ctx context.Context) error {
+	start := time.Now()
+	err := s.store.ResetDB(ctx)
+	s.observe("ResetDB", start, err)
+	return err
+}
+
+func (s *instrumentedStore) Close() error {
+	start := time.Now()
+	err := s.store.Close()
+	s.observe("Close", start, err)
+	return err
+}
@@ -0,0 +1,215 @@
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// ThrottleLimits configures how failed logins from one account or one IP
+// address are slowed down
+type ThrottleLimits struct {
+	// FreeFailures is how many failures are allowed before any delay
+	FreeFailures int
+	// BaseDelay is the wait after the first failure past FreeFailures. Every
+	// further failure doubles it, up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// LockoutFailures locks the key for LockoutDuration once that many
+	// failures have piled up. Zero never locks.
+	LockoutFailures int
+	LockoutDuration time.Duration
+	// ResetAfter forgets the failures of a key that has had none for this
+	// long
+	ResetAfter time.Duration
+}
+
+// DefaultAccountLimits lets an account be guessed at a few times, then backs
+// off and locks it for a while after ten failures
+var DefaultAccountLimits = ThrottleLimits{
+	FreeFailures:    3,
+	BaseDelay:       time.Second,
+	MaxDelay:        time.Minute,
+	LockoutFailures: 10,
+	LockoutDuration: 15 * time.Minute,
+	ResetAfter:      time.Hour,
+}
+
+// DefaultIPLimits is more lenient than DefaultAccountLimits, as many users
+// can share an address, and never locks
+var DefaultIPLimits = ThrottleLimits{
+	FreeFailures: 20,
+	BaseDelay:    time.Second,
+	MaxDelay:     5 * time.Minute,
+	ResetAfter:   time.Hour,
+}
+
+type throttleEntry struct {
+	failures int
+	last     time.Time
+	// pending counts attempts Check let through that haven't failed or
+	// succeeded yet, and reserved is when the latest of them started
+	pending     int
+	reserved    time.Time
+	lockedUntil time.Time
+}
+
+// LoginThrottle tracks failed logins per account and per client IP address
+// in memory and tells how long the next attempt has to wait. Accounts are
+// tracked by the email tried, whether or not a user has it, so the response
+// doesn't reveal which emails are registered.
+type LoginThrottle struct {
+	account ThrottleLimits
+	ip      ThrottleLimits
+	now     func() time.Time
+
+	mux       sync.Mutex
+	accounts  map[string]*throttleEntry
+	ips       map[string]*throttleEntry
+	lastSweep time.Time
+}
+
+// NewLoginThrottle returns a throttle applying account to each email and ip
+// to each client address
+func NewLoginThrottle(account, ip ThrottleLimits) *LoginThrottle {
+	return &LoginThrottle{
+		account:  account,
+		ip:       ip,
+		now:      time.Now,
+		accounts: map[string]*throttleEntry{},
+		ips:      map[string]*throttleEntry{},
+	}
+}
+
+// Check returns how long a login for account from ip has to wait, or zero if
+// it may go ahead. A login that may go ahead is counted as pending, and
+// throttles the ones after it as if it had failed, until Failure or Success
+// is called for it; so every zero from Check must be followed by one of them.
+// Otherwise many guesses sent at once would all pass before the first one
+// failed.
+func (t *LoginThrottle) Check(account, ip string) time.Duration {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	now := t.now()
+	t.sweep(now)
+	if wait := t.wait(account, ip, now); wait > 0 {
+		return wait
+	}
+	reserve(t.entry(t.accounts, account, t.account, now), now)
+	reserve(t.entry(t.ips, ip, t.ip, now), now)
+	return 0
+}
+
+// Failure records a failed login for account from ip. It reports whether
+// this failure locked the account.
+func (t *LoginThrottle) Failure(account, ip string) (locked bool) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	now := t.now()
+	e := t.entry(t.ips, ip, t.ip, now)
+	release(e)
+	t.ip.fail(e, now)
+	e = t.entry(t.accounts, account, t.account, now)
+	release(e)
+	return t.account.fail(e, now)
+}
+
+// Success forgets the failed logins of account. Those of the IP address are
+// kept, so one good password can't be used to keep guessing others.
+func (t *LoginThrottle) Success(account, ip string) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	delete(t.accounts, account)
+	release(t.ips[ip])
+}
+
+// Unlock lifts a lockout and any backoff on account. It reports whether the
+// account was locked.
+func (t *LoginThrottle) Unlock(account string) bool {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	e, ok := t.accounts[account]
+	delete(t.accounts, account)
+	return ok && t.now().Before(e.lockedUntil)
+}
+
+// wait returns how long a login for account from ip has to wait
+func (t *LoginThrottle) wait(account, ip string, now time.Time) time.Duration {
+	return max(t.account.wait(t.accounts[account], now), t.ip.wait(t.ips[ip], now))
+}
+
+// entry returns the entry for key, starting afresh if its failures are old
+// enough to be forgotten
+func (t *LoginThrottle) entry(m map[string]*throttleEntry, key string, l ThrottleLimits, now time.Time) *throttleEntry {
+	e, ok := m[key]
+	if !ok || l.expired(e, now) {
+		e = &throttleEntry{}
+		m[key] = e
+	}
+	return e
+}
+
+// sweep drops forgotten entries, at most once a minute
+func (t *LoginThrottle) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < time.Minute {
+		return
+	}
+	t.lastSweep = now
+	for key, e := range t.accounts {
+		if t.account.expired(e, now) {
+			delete(t.accounts, key)
+		}
+	}
+	for key, e := range t.ips {
+		if t.ip.expired(e, now) {
+			delete(t.ips, key)
+		}
+	}
+}
+
+func (l ThrottleLimits) expired(e *throttleEntry, now time.Time) bool {
+	return e.pending == 0 && !now.Before(e.lockedUntil) && now.Sub(e.last) > l.ResetAfter
+}
+
+func (l ThrottleLimits) wait(e *throttleEntry, now time.Time) time.Duration {
+	if e == nil || l.expired(e, now) {
+		return 0
+	}
+	if now.Before(e.lockedUntil) {
+		return e.lockedUntil.Sub(now)
+	}
+	over := e.failures + e.pending - l.FreeFailures
+	if over <= 0 {
+		return 0
+	}
+	delay := l.MaxDelay
+	if over-1 < 63 && l.BaseDelay <= l.MaxDelay>>(over-1) {
+		delay = l.BaseDelay << (over - 1)
+	}
+	last := e.last
+	if e.pending > 0 && e.reserved.After(last) {
+		last = e.reserved
+	}
+	return max(last.Add(delay).Sub(now), 0)
+}
+
+func reserve(e *throttleEntry, now time.Time) {
+	e.pending++
+	e.reserved = now
+}
+
+func release(e *throttleEntry) {
+	if e != nil && e.pending > 0 {
+		e.pending--
+	}
+}
+
+func (l ThrottleLimits) fail(e *throttleEntry, now time.Time) (locked bool) {
+	e.failures++
+	e.last = now
+	if l.LockoutFailures > 0 && e.failures >= l.LockoutFailures {
+		e.failures = 0
+		e.lockedUntil = now.Add(l.LockoutDuration)
+		return true
+	}
+	return false
+}
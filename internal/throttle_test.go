@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock is a time source tests move forward by hand
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestThrottle(account, ip ThrottleLimits) (*LoginThrottle, *fakeClock) {
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	throttle := NewLoginThrottle(account, ip)
+	throttle.now = clock.now
+	return throttle, clock
+}
+
+// peek returns how long a login would have to wait, without counting it as
+// pending the way Check does
+func peek(throttle *LoginThrottle, account, ip string) time.Duration {
+	throttle.mux.Lock()
+	defer throttle.mux.Unlock()
+	return throttle.wait(account, ip, throttle.now())
+}
+
+func TestLoginThrottleBackoff(t *testing.T) {
+	throttle, clock := newTestThrottle(ThrottleLimits{
+		FreeFailures: 2,
+		BaseDelay:    time.Second,
+		MaxDelay:     5 * time.Second,
+		ResetAfter:   time.Hour,
+	}, ThrottleLimits{ResetAfter: time.Hour})
+
+	// Each failure past the free ones doubles the wait, up to the maximum
+	for i, want := range []time.Duration{0, 0, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if wait := throttle.Check("a@example.com", "1.2.3.4"); wait != 0 {
+			t.Fatalf("attempt %d had to wait %v after waiting out the backoff", i+1, wait)
+		}
+		throttle.Failure("a@example.com", "1.2.3.4")
+		if wait := peek(throttle, "a@example.com", "1.2.3.4"); wait != want {
+			t.Errorf("after %d failures wait = %v, want %v", i+1, wait, want)
+		}
+		if wait := peek(throttle, "b@example.com", "5.6.7.8"); wait != 0 {
+			t.Errorf("another account from another address has to wait %v", wait)
+		}
+		clock.advance(want)
+	}
+
+	throttle.Check("a@example.com", "1.2.3.4")
+	throttle.Success("a@example.com", "1.2.3.4")
+	throttle.Failure("a@example.com", "1.2.3.4")
+	if wait := peek(throttle, "a@example.com", "1.2.3.4"); wait != 0 {
+		t.Errorf("success didn't reset the backoff, wait = %v", wait)
+	}
+
+	throttle.Failure("a@example.com", "1.2.3.4")
+	throttle.Failure("a@example.com", "1.2.3.4")
+	clock.advance(time.Hour + time.Second)
+	if wait := peek(throttle, "a@example.com", "1.2.3.4"); wait != 0 {
+		t.Errorf("old failures not forgotten, wait = %v", wait)
+	}
+}
+
+func TestLoginThrottleLockout(t *testing.T) {
+	throttle, clock := newTestThrottle(ThrottleLimits{
+		FreeFailures:    100,
+		LockoutFailures: 3,
+		LockoutDuration: 15 * time.Minute,
+		ResetAfter:      time.Hour,
+	}, ThrottleLimits{ResetAfter: time.Hour})
+
+	for i := 1; i <= 3; i++ {
+		locked := throttle.Failure("a@example.com", "1.2.3.4")
+		if locked != (i == 3) {
+			t.Errorf("failure %d: locked = %v", i, locked)
+		}
+	}
+	if wait := peek(throttle, "a@example.com", "9.9.9.9"); wait != 15*time.Minute {
+		t.Errorf("locked account wait = %v, want 15m from any address", wait)
+	}
+	clock.advance(15 * time.Minute)
+	if wait := peek(throttle, "a@example.com", "1.2.3.4"); wait != 0 {
+		t.Errorf("lockout didn't expire, wait = %v", wait)
+	}
+
+	for i := 0; i < 3; i++ {
+		throttle.Failure("a@example.com", "1.2.3.4")
+	}
+	if !throttle.Unlock("a@example.com") {
+		t.Error("Unlock reported the account wasn't locked")
+	}
+	if wait := peek(throttle, "a@example.com", "1.2.3.4"); wait != 0 {
+		t.Errorf("unlocked account wait = %v", wait)
+	}
+	if throttle.Unlock("a@example.com") {
+		t.Error("Unlock reported an unlocked account as locked")
+	}
+}
+
+func TestLoginThrottlePerIP(t *testing.T) {
+	throttle, _ := newTestThrottle(ThrottleLimits{ResetAfter: time.Hour}, ThrottleLimits{
+		FreeFailures: 2,
+		BaseDelay:    time.Minute,
+		MaxDelay:     time.Hour,
+		ResetAfter:   time.Hour,
+	})
+	// Spreading guesses over accounts still slows down the address
+	for _, account := range []string{"a", "b", "c"} {
+		throttle.Failure(account, "1.2.3.4")
+	}
+	throttle.Success("a", "1.2.3.4")
+	if wait := peek(throttle, "d", "1.2.3.4"); wait != time.Minute {
+		t.Errorf("address wait = %v, want 1m", wait)
+	}
+	if wait := peek(throttle, "d", "5.6.7.8"); wait != 0 {
+		t.Errorf("other address wait = %v", wait)
+	}
+}
+
+func TestLoginThrottlePending(t *testing.T) {
+	throttle, _ := newTestThrottle(ThrottleLimits{
+		FreeFailures: 2,
+		BaseDelay:    time.Second,
+		MaxDelay:     time.Minute,
+		ResetAfter:   time.Hour,
+	}, ThrottleLimits{ResetAfter: time.Hour})
+
+	// Guesses sent together are throttled before any of them has failed
+	for i, want := range []time.Duration{0, 0, 0, time.Second, time.Second} {
+		if wait := throttle.Check("a@example.com", "1.2.3.4"); wait != want {
+			t.Errorf("attempt %d wait = %v, want %v", i+1, wait, want)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		throttle.Failure("a@example.com", "1.2.3.4")
+	}
+	if wait := peek(throttle, "a@example.com", "1.2.3.4"); wait != time.Second {
+		t.Errorf("after the pending attempts failed wait = %v, want 1s", wait)
+	}
+
+	// A success releases the pending attempt of the address too
+	throttle, _ = newTestThrottle(ThrottleLimits{ResetAfter: time.Hour}, ThrottleLimits{
+		FreeFailures: 1,
+		BaseDelay:    time.Second,
+		MaxDelay:     time.Minute,
+		ResetAfter:   time.Hour,
+	})
+	throttle.Check("a@example.com", "1.2.3.4")
+	throttle.Check("b@example.com", "1.2.3.4")
+	throttle.Success("a@example.com", "1.2.3.4")
+	throttle.Success("b@example.com", "1.2.3.4")
+	if wait := peek(throttle, "c@example.com", "1.2.3.4"); wait != 0 {
+		t.Errorf("address wait after successes = %v", wait)
+	}
+}
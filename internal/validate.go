@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/rivo/uniseg"
+)
+
+// ChirpRules are the limits every chirp body is checked against. Lengths
+// count user-perceived characters (grapheme clusters), so an emoji with a
+// skin tone modifier or a letter with a combining accent counts as one.
+type ChirpRules struct {
+	MaxLength int
+	// MaxLengthRed applies to Chirpy Red members
+	MaxLengthRed int
+}
+
+// DefaultChirpRules are the limits used when none are configured
+var DefaultChirpRules = ChirpRules{MaxLength: 140, MaxLengthRed: 280}
+
+// ValidationError is one rule a chirp body broke
+type ValidationError struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors lists every rule a chirp body broke
+type ValidationErrors []ValidationError
+
+func (errs ValidationErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// ChirpLength returns the number of user-perceived characters in body
+func ChirpLength(body string) int {
+	return uniseg.GraphemeClusterCount(body)
+}
+
+// Validate checks body against every rule and returns all violations, or nil
+// if the body is acceptable
+func (rules ChirpRules) Validate(body string, isChirpyRed bool) ValidationErrors {
+	var errs ValidationErrors
+	if !utf8.ValidString(body) {
+		errs = append(errs, ValidationError{Rule: "encoding", Message: "Chirp is not valid UTF-8"})
+	}
+	if strings.TrimSpace(body) == "" {
+		errs = append(errs, ValidationError{Rule: "required", Message: "Chirp is empty"})
+	}
+	max := rules.MaxLength
+	if isChirpyRed {
+		max = rules.MaxLengthRed
+	}
+	if n := ChirpLength(body); n > max {
+		errs = append(errs, ValidationError{
+			Rule:    "max_length",
+			Message: fmt.Sprintf("Chirp is too long: %d characters, the limit is %d", n, max),
+		})
+	}
+	return errs
+}
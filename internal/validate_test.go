@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestChirpLength(t *testing.T) {
+	tests := []struct {
+		body string
+		want int
+	}{
+		{"hello", 5},
+		{"h\u00e9llo", 5},
+		{"he\u0301llo", 5},
+		{"👍🏽", 1},
+		{"👩‍👩‍👧‍👦 family", 8},
+		{"🇳🇱", 1},
+		{"日本語", 3},
+	}
+	for _, tt := range tests {
+		if got := ChirpLength(tt.body); got != tt.want {
+			t.Errorf("ChirpLength(%q) = %d, want %d", tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestChirpRulesValidate(t *testing.T) {
+	rules := ChirpRules{MaxLength: 10, MaxLengthRed: 20}
+	tests := []struct {
+		body      string
+		red       bool
+		wantRules []string
+	}{
+		{"short", false, nil},
+		{strings.Repeat("👍🏽", 10), false, nil},
+		{strings.Repeat("a", 11), false, []string{"max_length"}},
+		{strings.Repeat("a", 11), true, nil},
+		{strings.Repeat("a", 21), true, []string{"max_length"}},
+		{"", false, []string{"required"}},
+		{" \n\t ", false, []string{"required"}},
+		{"\xff", false, []string{"encoding"}},
+		{strings.Repeat(" ", 11), false, []string{"required", "max_length"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, e := range rules.Validate(tt.body, tt.red) {
+			got = append(got, e.Rule)
+		}
+		if !slices.Equal(got, tt.wantRules) {
+			t.Errorf("Validate(%q, %v) broke %v, want %v", tt.body, tt.red, got, tt.wantRules)
+		}
+	}
+}
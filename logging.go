@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"net/http"
+	"server/internal"
+	"time"
+)
+
+// requestInfo collects what handlers learn about a request, such as the
+// route it matched and who made it, for the logging and metrics middleware
+// to report once it has been served
+type requestInfo struct {
+	route    string
+	userID   int
+	clientIP string
+}
+
+type requestInfoKey struct{}
+
+// withRequestInfo returns r carrying a requestInfo, reusing one an outer
+// middleware already attached
+func withRequestInfo(r *http.Request) (*http.Request, *requestInfo) {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		return r, info
+	}
+	info := &requestInfo{route: unmatchedRoute}
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)), info
+}
+
+// setRequestUser records the authenticated user for the access log
+func setRequestUser(r *http.Request, userID int) {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		info.userID = userID
+	}
+}
+
+// maxRequestIDLength bounds request IDs accepted from clients
+const maxRequestIDLength = 128
+
+// middlewareLogging gives every request an ID, taken from the X-Request-ID
+// header when the client or a proxy sent a sane one, echoes it in the
+// response, makes a logger carrying it available through
+// internal.Logger(r.Context()) and writes one access log line per request
+func middlewareLogging(logger *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		reqLogger := logger.With("request_id", id)
+		r = r.WithContext(internal.ContextWithLogger(r.Context(), reqLogger))
+		r, info := withRequestInfo(r)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		level := slog.LevelInfo
+		if rec.status >= 500 {
+			level = slog.LevelError
+		}
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("route", info.route),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rec.status),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.Int("bytes", rec.bytes),
+			slog.String("remote_addr", r.RemoteAddr),
+		}
+		// a trusted proxy forwarded the request for someone else
+		if host, _, _ := net.SplitHostPort(r.RemoteAddr); info.clientIP != "" && info.clientIP != host {
+			attrs = append(attrs, slog.String("client_ip", info.clientIP))
+		}
+		if info.userID != 0 {
+			attrs = append(attrs, slog.Int("user_id", info.userID))
+		}
+		reqLogger.LogAttrs(r.Context(), level, "request", attrs...)
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// middlewareClientIP works out the address each request came from, looking
+// through the trusted proxies, for clientIP to return
+func middlewareClientIP(proxies internal.TrustedProxies, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, info := withRequestInfo(r)
+		info.clientIP = proxies.ClientIP(r.RemoteAddr, r.Header.Values("X-Forwarded-For"))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the address the request came from, without the port
+func clientIP(r *http.Request) string {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok && info.clientIP != "" {
+		return info.clientIP
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -1,17 +1,22 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/json"
-	"flag"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"server/internal"
 	"strconv"
-	"strings"
-
-	"github.com/lpernett/godotenv"
+	"syscall"
+	"time"
 )
 
 
@@ -21,48 +26,189 @@ func HealzHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("OK"))
 }
 
+// openStore opens the storage backend selected with -store. An empty path
+// falls back to the backend's default file in the working directory.
+func openStore(kind, path string, snapshotInterval time.Duration) (internal.Store, error) {
+	switch kind {
+	case "json":
+		if path == "" {
+			path = "./db.json"
+		}
+		return internal.NewDB(path, internal.WithSnapshotInterval(snapshotInterval))
+	case "sqlite":
+		if path == "" {
+			path = "./db.sqlite"
+		}
+		return internal.NewSQLiteDB(path)
+	}
+	return nil, fmt.Errorf("unknown store %q", kind)
+}
+
+// fatal logs msg at error level and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
 func main() {
-	mux := http.NewServeMux()
-	cfg := apiConfig{fileserverHits: 0}
-	dbg := flag.Bool("debug", false, "Enable debug mode")
-	flag.Parse()
-	fileServer := http.FileServer(http.Dir("./static"))
-	dbPath := "./db.json"
-	db, err := internal.NewDB(dbPath)
-	errEnv := godotenv.Load()
-	if errEnv != nil {
-		log.Fatal("ERROR: Cannot initialize env")
-	}
-	jwtSecret := os.Getenv("JWT_SECRET")
-	pokaKey := os.Getenv("POLKA_KEY")
-	cfg.jwtSecret = jwtSecret
-	cfg.polkaKey = pokaKey
-	if *dbg{
-		db.ResetDB()	
+	if code, ok := runCommand(os.Args[1:]); ok {
+		os.Exit(code)
+	}
+	conf, err := LoadConfig(os.Args[0], os.Args[1:])
+	if err != nil {
+		log.Fatalf("ERROR: invalid configuration:\n%v", err)
+	}
+	var level slog.Level
+	level.UnmarshalText([]byte(conf.LogLevel))
+	logger := slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	slog.SetDefault(logger)
+	cfg := apiConfig{}
+	cfg.tokens, err = conf.Keyring()
+	if err != nil {
+		fatal("cannot load token signing keys", "error", err)
+	}
+	// both were checked by LoadConfig
+	proxies, _ := internal.ParseTrustedProxies(conf.TrustedProxies)
+	policies, _ := conf.RatePolicies()
+	limits := newRateLimits(internal.NewMemoryRateLimiter(), policies, cfg.tokens)
+	mux := newRouteMux(limits)
+	cfg.polkaKey = conf.PolkaKey
+	cfg.logins = conf.LoginThrottle()
+	cfg.passwords, _ = conf.PasswordHasher() // checked by LoadConfig
+	cfg.passwordPolicy, err = internal.NewPasswordPolicy(conf.PasswordMinLength, conf.PasswordBreachList)
+	if err != nil {
+		fatal("cannot load password breach list", "path", conf.PasswordBreachList, "error", err)
 	}
+	cfg.mailer, _ = conf.NewMailer() // checked by LoadConfig
+	if cfg.mailer == nil {
+		logger.Warn("no mailer set, password reset is disabled")
+	}
+	cfg.passwordResetURL = conf.PasswordResetURL
+	cfg.chirpRules = internal.ChirpRules{MaxLength: conf.ChirpMaxLength, MaxLengthRed: conf.ChirpMaxLengthRed}
+	fileServer := http.FileServer(http.Dir(conf.StaticDir))
+	store, err := openStore(conf.Store, conf.DBPath, conf.SnapshotInterval)
+	if err != nil {
+		fatal("cannot open database", "store", conf.Store, "error", err)
+	}
+	users, err := store.GetUsers(context.Background())
 	if err != nil {
-		log.Fatal("ERROR: cannot initialize database at "+ dbPath)
+		fatal("cannot load users", "error", err)
+	}
+	hashes := make([]string, len(users))
+	for i, user := range users {
+		hashes[i] = user.Password
 	}
-	chirps, err := db.GetChirps()
+	cfg.passwords.MatchDummy(hashes)
+	// Hash the dummy password now, or the first login with an unknown email
+	// would take twice as long as a wrong password
+	go cfg.passwords.DummyVerify("")
+	registry := internal.NewMetrics()
+	cfg.metrics = newHTTPMetrics(registry)
+	db := internal.InstrumentStore(store, registry.NewHistogram("chirpy_db_operation_duration_seconds",
+		"Time taken by database operations.", internal.DefaultLatencyBuckets, "op", "result"))
+	registry.NewGaugeFunc("chirpy_chirps", "Chirps currently stored.", func() (float64, error) {
+		n, err := store.CountChirps(context.Background())
+		return float64(n), err
+	})
+	registry.NewGaugeFunc("chirpy_users", "Registered users.", func() (float64, error) {
+		n, err := store.CountUsers(context.Background())
+		return float64(n), err
+	})
+	registry.NewGaugeFunc("chirpy_fileserver_hits", "Static site visits since the last reset.", func() (float64, error) {
+		return float64(cfg.fileserverHits.Load()), nil
+	})
+	profanity, err := internal.NewProfanityFilter(conf.ProfanityWords)
 	if err != nil {
-		log.Fatalf("ERROR: cannot retrieve chirps: %v", err)
+		fatal("cannot load profanity list", "path", conf.ProfanityWords, "error", err)
+	}
+	cfg.profanity = profanity
+	stopWatch := make(chan struct{})
+	go profanity.Watch(5*time.Second, stopWatch)
+	if conf.Debug {
+		if err := db.ResetDB(context.Background()); err != nil {
+			fatal("cannot reset database", "error", err)
+		}
 	}
-	fmt.Println(chirps)
 	mux.Handle("/app/*", cfg.middlewareMetricsInc(http.StripPrefix("/app", fileServer)))
 	mux.HandleFunc("GET /api/healthz", HealzHandler)
-	mux.HandleFunc("GET /admin/metrics", func(w http.ResponseWriter, r *http.Request) {
-		MetricsHandler(w, r, &cfg)
+	mux.HandleFunc("GET /.well-known/jwks.json", func(w http.ResponseWriter, r *http.Request) {
+		JWKSHandler(w, r, &cfg)
 	})
-	mux.HandleFunc("/api/reset", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("GET /admin/metrics", cfg.RequirePermission(db, internal.PermManageServer, func(w http.ResponseWriter, r *http.Request) {
+		PrometheusHandler(w, r, &cfg)
+	}))
+	mux.HandleFunc("GET /admin/hits", cfg.RequirePermission(db, internal.PermManageServer, func(w http.ResponseWriter, r *http.Request) {
+		HitsHandler(w, r, &cfg)
+	}))
+	mux.HandleFunc("/api/reset", cfg.RequirePermission(db, internal.PermManageServer, func(w http.ResponseWriter, r *http.Request) {
 		ResetHandler(w, r, &cfg)
-	})
-	mux.HandleFunc("POST /api/validate_chirp", validateChirpHandler)
-	mux.HandleFunc("POST /api/chirps", func(w http.ResponseWriter, r *http.Request) {
+	}))
+	mux.HandleFunc("GET /admin/profanity", cfg.RequirePermission(db, internal.PermManageServer, func(w http.ResponseWriter, r *http.Request) {
+		GetProfanityWordsHandler(w, r, &cfg)
+	}))
+	mux.HandleFunc("PUT /admin/profanity", cfg.RequirePermission(db, internal.PermManageServer, func(w http.ResponseWriter, r *http.Request) {
+		SetProfanityWordsHandler(w, r, &cfg)
+	}))
+	mux.HandleFunc("GET /admin/flagged", cfg.RequirePermission(db, internal.PermModerateChirps, func(w http.ResponseWriter, r *http.Request) {
+		GetFlaggedChirpsHandler(w, r, db)
+	}))
+	mux.HandleFunc("DELETE /admin/flagged/{id}", cfg.RequirePermission(db, internal.PermModerateChirps, func(w http.ResponseWriter, r *http.Request) {
+		type retError struct {
+			Error string `json:"error"`
+		}
+		chirpID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil{
+			errMsg := retError{Error: err.Error()}
+			dat, _ := json.Marshal(errMsg)
+			w.WriteHeader(400)
+			w.Write(dat)
+			return
+		}
+		ClearChirpFlagHandler(w, r, db, chirpID)
+	}))
+	mux.HandleFunc("PUT /admin/users/{id}/role", cfg.RequirePermission(db, internal.PermManageUsers, func(w http.ResponseWriter, r *http.Request) {
+		type retError struct {
+			Error string `json:"error"`
+		}
+		userID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil{
+			errMsg := retError{Error: err.Error()}
+			dat, _ := json.Marshal(errMsg)
+			w.WriteHeader(400)
+			w.Write(dat)
+			return
+		}
+		SetUserRoleHandler(w, r, db, userID)
+	}))
+	mux.HandleFunc("POST /admin/users/{id}/unlock", cfg.RequirePermission(db, internal.PermManageUsers, func(w http.ResponseWriter, r *http.Request) {
+		type retError struct {
+			Error string `json:"error"`
+		}
+		userID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil{
+			errMsg := retError{Error: err.Error()}
+			dat, _ := json.Marshal(errMsg)
+			w.WriteHeader(400)
+			w.Write(dat)
+			return
+		}
+		UnlockUserHandler(w, r, db, &cfg, userID)
+	}))
+	mux.HandleFunc("GET /admin/audit", cfg.RequirePermission(db, internal.PermManageUsers, func(w http.ResponseWriter, r *http.Request) {
+		GetAuditLogHandler(w, r, db)
+	}))
+	mux.HandleFunc("POST /api/validate_chirp", cfg.OptionalAuth(db, func(w http.ResponseWriter, r *http.Request) {
+		validateChirpHandler(w, r, &cfg)
+	}))
+	mux.HandleFunc("POST /api/chirps", cfg.RequireAuth(db, func(w http.ResponseWriter, r *http.Request) {
 		CreateChirpHandler(w, r, db, &cfg)
-	})
+	}))
 	mux.HandleFunc("GET /api/chirps", func(w http.ResponseWriter, r *http.Request) {
 		GetChirpsHandler(w, r, db)
 	})
+	mux.HandleFunc("GET /api/chirps/search", func(w http.ResponseWriter, r *http.Request) {
+		SearchChirpsHandler(w, r, db)
+	})
 	mux.HandleFunc("GET /api/chirps/{id}", func(w http.ResponseWriter, r *http.Request) {
 		type retError struct {
 			Error string `json:"error"`
@@ -77,15 +223,21 @@ func main() {
 		}
 		GetChirpHandler(w, r, db, chirpID)
 	})
-	mux.HandleFunc("GET /api/users", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("GET /api/users", cfg.RequirePermission(db, internal.PermManageUsers, func(w http.ResponseWriter, r *http.Request) {
 		GetUsersHandler(w, r, db)
-	})
+	}))
 	mux.HandleFunc("POST /api/users", func(w http.ResponseWriter, r *http.Request) {
-		CreateUsersHandler(w, r, db)
+		CreateUsersHandler(w, r, db, &cfg)
 	})
-	mux.HandleFunc("PUT /api/users", func(w http.ResponseWriter, r *http.Request) {
-		UpdateUserHandler(w, r, db, &cfg)
+	mux.HandleFunc("POST /api/password/forgot", func(w http.ResponseWriter, r *http.Request) {
+		ForgotPasswordHandler(w, r, db, &cfg)
+	})
+	mux.HandleFunc("POST /api/password/reset", func(w http.ResponseWriter, r *http.Request) {
+		ResetPasswordHandler(w, r, db, &cfg)
 	})
+	mux.HandleFunc("PUT /api/users", cfg.RequireAuth(db, func(w http.ResponseWriter, r *http.Request) {
+		UpdateUserHandler(w, r, db, &cfg)
+	}))
 	mux.HandleFunc("POST /api/login", func(w http.ResponseWriter, r *http.Request) {
 		ValidateUserHandler(w, r, db, &cfg)
 	})
@@ -95,7 +247,30 @@ func main() {
 	mux.HandleFunc("POST /api/revoke", func(w http.ResponseWriter, r *http.Request) {
 		RevokeTokenHandler(w, r, db, &cfg)
 	})
-	mux.HandleFunc("DELETE /api/chirps/{id}", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("POST /api/logout", cfg.RequireAuth(db, func(w http.ResponseWriter, r *http.Request) {
+		LogoutHandler(w, r, db)
+	}))
+	mux.HandleFunc("GET /api/sessions", cfg.RequireAuth(db, func(w http.ResponseWriter, r *http.Request) {
+		GetSessionsHandler(w, r, db)
+	}))
+	mux.HandleFunc("DELETE /api/sessions", cfg.RequireAuth(db, func(w http.ResponseWriter, r *http.Request) {
+		RevokeAllSessionsHandler(w, r, db)
+	}))
+	mux.HandleFunc("DELETE /api/sessions/{id}", cfg.RequireAuth(db, func(w http.ResponseWriter, r *http.Request) {
+		type retError struct {
+			Error string `json:"error"`
+		}
+		sessionID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil{
+			errMsg := retError{Error: err.Error()}
+			dat, _ := json.Marshal(errMsg)
+			w.WriteHeader(400)
+			w.Write(dat)
+			return
+		}
+		RevokeSessionHandler(w, r, db, sessionID)
+	}))
+	mux.HandleFunc("DELETE /api/chirps/{id}", cfg.RequireAuth(db, func(w http.ResponseWriter, r *http.Request) {
 		type retError struct {
 			Error string `json:"error"`
 		}
@@ -108,17 +283,143 @@ func main() {
 			return
 		}
 		DeleteChirpHandler(w, r, db, &cfg, chirpID)
+	}))
+	mux.HandleFunc("PATCH /api/chirps/{id}", cfg.RequireAuth(db, func(w http.ResponseWriter, r *http.Request) {
+		type retError struct {
+			Error string `json:"error"`
+		}
+		chirpID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil{
+			errMsg := retError{Error: err.Error()}
+			dat, _ := json.Marshal(errMsg)
+			w.WriteHeader(400)
+			w.Write(dat)
+			return
+		}
+		UpdateChirpHandler(w, r, db, &cfg, chirpID)
+	}))
+	mux.HandleFunc("GET /api/chirps/{id}/history", func(w http.ResponseWriter, r *http.Request) {
+		type retError struct {
+			Error string `json:"error"`
+		}
+		chirpID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil{
+			errMsg := retError{Error: err.Error()}
+			dat, _ := json.Marshal(errMsg)
+			w.WriteHeader(400)
+			w.Write(dat)
+			return
+		}
+		GetChirpHistoryHandler(w, r, db, chirpID)
 	})
 	mux.HandleFunc("POST /api/polka/webhooks", func(w http.ResponseWriter, r *http.Request) {
-		apiKey := r.Header.Get("Authorization")
-		apiKey = strings.Replace(apiKey,"ApiKey ","",1)
-		if apiKey != cfg.polkaKey {
+		apiKey, err := internal.AuthorizationCredentials(r.Header.Get("Authorization"), "ApiKey")
+		if err != nil || subtle.ConstantTimeCompare([]byte(apiKey), []byte(cfg.polkaKey)) != 1 {
 			w.WriteHeader(401)
 			return
 		}
 		HandlePolkaWebhook(w, r, db, &cfg)
 	})
 
-	server := http.Server{Handler: mux, Addr: "localhost:8080"}
-	log.Fatal(server.ListenAndServe())
+	for _, route := range limits.unused() {
+		logger.Warn("rate limit set for a route that doesn't exist", "route", route)
+	}
+
+	useTLS := conf.TLSCert != ""
+	var handler http.Handler = mux
+	handler = middlewareClientIP(proxies, handler)
+	if useTLS && conf.HSTSMaxAge > 0 {
+		handler = middlewareHSTS(conf.HSTSMaxAge, handler)
+	}
+	handler = cfg.metrics.middleware(handler)
+	handler = middlewareLogging(logger, handler)
+	newServer := func(addr string, h http.Handler) *http.Server {
+		return &http.Server{
+			Handler:           h,
+			Addr:              addr,
+			ReadHeaderTimeout: conf.ReadHeaderTimeout,
+			ReadTimeout:       conf.ReadTimeout,
+			WriteTimeout:      conf.WriteTimeout,
+			IdleTimeout:       conf.IdleTimeout,
+			ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+		}
+	}
+	server := newServer(net.JoinHostPort(conf.Addr, conf.Port), handler)
+	servers := []*http.Server{server}
+	if useTLS {
+		certs, err := internal.NewCertReloader(conf.TLSCert, conf.TLSKey)
+		if err != nil {
+			fatal("cannot load TLS certificate", "cert", conf.TLSCert, "error", err)
+		}
+		go certs.Watch(time.Minute, stopWatch)
+		// HTTP/2 is negotiated automatically as long as TLSNextProto is nil
+		server.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.GetCertificate,
+		}
+		if conf.HTTPRedirectPort != "" {
+			servers = append(servers, newServer(net.JoinHostPort(conf.Addr, conf.HTTPRedirectPort), redirectToHTTPS(conf.Port)))
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	serveErr := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			if srv.TLSConfig != nil {
+				slog.Info("listening", "addr", srv.Addr, "tls", true)
+				serveErr <- srv.ListenAndServeTLS("", "")
+			} else {
+				slog.Info("listening", "addr", srv.Addr, "tls", false)
+				serveErr <- srv.ListenAndServe()
+			}
+		}(srv)
+	}
+
+	code := 0
+	running := len(servers)
+	select {
+	case err := <-serveErr:
+		slog.Error("server stopped", "error", err)
+		running--
+		code = 1
+	case <-ctx.Done():
+		stop()
+		slog.Info("shutting down", "drain_timeout", conf.ShutdownTimeout.String())
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), conf.ShutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			slog.Error("cannot shut down cleanly", "addr", srv.Addr, "error", err)
+			srv.Close()
+			code = 1
+		}
+	}
+	for ; running > 0; running-- {
+		if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("server stopped", "error", err)
+			code = 1
+		}
+	}
+	close(stopWatch)
+	// Let password reset emails still being sent finish, as they write to
+	// the store, but give them no longer than requests had
+	sent := make(chan struct{})
+	go func() {
+		cfg.background.Wait()
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(conf.ShutdownTimeout):
+		slog.Error("gave up waiting for password reset emails")
+		code = 1
+	}
+	if err := db.Close(); err != nil {
+		slog.Error("cannot flush database", "error", err)
+		code = 1
+	}
+	os.Exit(code)
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"server/internal"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// httpMetrics records every request by route, method and status
+type httpMetrics struct {
+	registry *internal.Metrics
+	requests *internal.Counter
+	duration *internal.Histogram
+	size     *internal.Histogram
+}
+
+func newHTTPMetrics(registry *internal.Metrics) *httpMetrics {
+	return &httpMetrics{
+		registry: registry,
+		requests: registry.NewCounter("chirpy_http_requests_total", "HTTP requests served.", "method", "path", "status"),
+		duration: registry.NewHistogram("chirpy_http_request_duration_seconds", "Time taken to serve HTTP requests.", internal.DefaultLatencyBuckets, "method", "path"),
+		size:     registry.NewHistogram("chirpy_http_response_size_bytes", "Size of HTTP response bodies.", internal.DefaultSizeBuckets, "method", "path"),
+	}
+}
+
+// unmatchedRoute labels requests that matched no route, so that scanning for
+// random paths can't create unbounded label values
+const unmatchedRoute = "unmatched"
+
+// middleware records the request once next has served it. It must wrap a
+// routeMux to know which route served the request.
+func (m *httpMetrics) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r, info := withRequestInfo(r)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		m.requests.Inc(r.Method, info.route, strconv.Itoa(rec.status))
+		m.duration.Observe(time.Since(start).Seconds(), r.Method, info.route)
+		m.size.Observe(float64(rec.bytes), r.Method, info.route)
+	})
+}
+
+// routeMux is a ServeMux that records the pattern each request matched in its
+// requestInfo and applies the rate limit of the route
+type routeMux struct {
+	*http.ServeMux
+	limits *rateLimits
+}
+
+func newRouteMux(limits *rateLimits) *routeMux {
+	return &routeMux{ServeMux: http.NewServeMux(), limits: limits}
+}
+
+func (mux *routeMux) Handle(pattern string, handler http.Handler) {
+	// drop the method; it is recorded separately
+	path := pattern
+	if i := strings.IndexByte(pattern, ' '); i >= 0 {
+		path = strings.TrimSpace(pattern[i+1:])
+	}
+	if mux.limits != nil {
+		handler = mux.limits.middleware(pattern, handler)
+	}
+	mux.ServeMux.Handle(pattern, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+			info.route = path
+		}
+		handler.ServeHTTP(w, r)
+	}))
+}
+
+func (mux *routeMux) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	mux.Handle(pattern, http.HandlerFunc(handler))
+}
+
+// statusRecorder remembers the status code and body size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int
+	wroteHeader bool
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// PrometheusHandler exposes every metric in the Prometheus text format
+func PrometheusHandler(w http.ResponseWriter, r *http.Request, cfg *apiConfig) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	cfg.metrics.registry.WriteTo(w)
+}
@@ -1,48 +1,84 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/hex"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"net"
 	"net/http"
 	"server/internal"
-	"slices"
-	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type apiConfig struct {
-	fileserverHits int
-	jwtSecret string
+	fileserverHits atomic.Int64
+	tokens *internal.Keyring
 	polkaKey string
+	profanity *internal.ProfanityFilter
+	chirpRules internal.ChirpRules
+	metrics *httpMetrics
+	logins *internal.LoginThrottle
+	passwords *internal.PasswordHasher
+	passwordPolicy *internal.PasswordPolicy
+	mailer internal.Mailer
+	passwordResetURL string
+	// background tracks work handlers leave running after they respond,
+	// which main waits for before closing the store
+	background sync.WaitGroup
 }
 
 func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cfg.fileserverHits++
+		cfg.fileserverHits.Add(1)
 		next.ServeHTTP(w, r) // Call the next handler
 	})
 }
 
-func MetricsHandler(w http.ResponseWriter, r *http.Request, cfg *apiConfig) {
+// middlewareHSTS tells browsers to only use HTTPS for this host from now on
+func middlewareHSTS(maxAge time.Duration, next http.Handler) http.Handler {
+	value := fmt.Sprintf("max-age=%d; includeSubDomains", int(maxAge.Seconds()))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", value)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// redirectToHTTPS sends every request to the same URL on the HTTPS port
+func redirectToHTTPS(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// HitsHandler shows how often the static site has been visited
+func HitsHandler(w http.ResponseWriter, r *http.Request, cfg *apiConfig) {
 	w.Header().Add("Content-Type", "text/html; charset=utf-8")
 	w.Write([]byte(fmt.Sprintf(`<html>
 <body>
     <h1>Welcome, Chirpy Admin</h1>
     <p>Chirpy has been visited %d times!</p>
 </body>
-</html>`, cfg.fileserverHits)))
+</html>`, cfg.fileserverHits.Load())))
 }
 
 func ResetHandler(w http.ResponseWriter, r *http.Request, cfg *apiConfig) {
-	cfg.fileserverHits = 0
+	cfg.fileserverHits.Store(0)
 }
 
-func validateChirpHandler(w http.ResponseWriter, r *http.Request) {
+func validateChirpHandler(w http.ResponseWriter, r *http.Request, cfg *apiConfig) {
 	type parameters struct {
 		Body string `json:"body"`
 	}
@@ -61,28 +97,30 @@ func validateChirpHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		errMsg := retError{Error: err.Error()}
 		dat, _ := json.Marshal(errMsg)
-		log.Printf("Error decoding parameters: %s", err)
+		internal.Logger(r.Context()).Info("invalid request body", "error", err)
 		w.WriteHeader(500)
 		w.Write(dat)
 		return
     }
 
-	if len(params.Body) > 140 {
-		errMsg := retError{Error: "Chirp is too long"}
-		dat, _ := json.Marshal(errMsg)
-		w.WriteHeader(400)
-		w.Write(dat)
+	user, _ := userFromContext(r.Context())
+	if !validateChirpBody(w, cfg, params.Body, user.IsChirpyRed) {
+		return
+	}
+
+	filtered, ok := filterChirpBody(w, cfg, params.Body)
+	if !ok {
 		return
 	}
 
 	respBody := returnVal {
 		Valid: true,
-		CleanedBody: replaceProfanity(params.Body),
+		CleanedBody: filtered.Body,
 	}
 	dat, err := json.Marshal(respBody)
 	if err != nil {
 		errMsg := retError{Error: err.Error()}
-		log.Printf("Error decoding parameters: %s", err)
+		internal.Logger(r.Context()).Error("cannot encode response", "error", err)
 		dat, _ := json.Marshal(errMsg)
 		w.WriteHeader(500)
 		w.Write(dat)
@@ -92,18 +130,55 @@ func validateChirpHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(dat)
 }
 
-func replaceProfanity(s string) string{
-	textSplit := strings.Split(s, " ")
-	profanityWords := []string{"kerfuffle", "sharbert", "fornax"} 
-	for index,word := range textSplit{
-		if slices.Contains(profanityWords, strings.ToLower(word)) {
-			textSplit[index] = "****"
-		}
+// validateChirpBody checks body against the configured chirp rules. If any
+// rule is broken it writes a 400 response listing all of them and returns
+// false.
+func validateChirpBody(w http.ResponseWriter, cfg *apiConfig, body string, isChirpyRed bool) bool {
+	type retError struct {
+		Error      string                    `json:"error"`
+		Violations internal.ValidationErrors `json:"violations"`
+	}
+	errs := cfg.chirpRules.Validate(body, isChirpyRed)
+	if len(errs) == 0 {
+		return true
 	}
-	return strings.Join(textSplit, " ")
+	errMsg := retError{Error: "Chirp is invalid", Violations: errs}
+	dat, _ := json.Marshal(errMsg)
+	w.WriteHeader(400)
+	w.Write(dat)
+	return false
 }
 
-func CreateChirpHandler(w http.ResponseWriter, r *http.Request, db *internal.DB, cfg *apiConfig) {
+// filterChirpBody runs body through the profanity filter. If the body uses a
+// word with the reject policy it writes a 400 response and returns false.
+func filterChirpBody(w http.ResponseWriter, cfg *apiConfig, body string) (internal.ProfanityResult, bool) {
+	type retError struct {
+		Error string   `json:"error"`
+		Words []string `json:"words"`
+	}
+	res := cfg.profanity.Check(body)
+	if len(res.Rejected) > 0 {
+		errMsg := retError{Error: "Chirp contains words that are not allowed", Words: res.Rejected}
+		dat, _ := json.Marshal(errMsg)
+		w.WriteHeader(400)
+		w.Write(dat)
+		return res, false
+	}
+	return res, true
+}
+
+// flagChirp queues a chirp for review if the filter flagged any words. A
+// failure is only logged; the chirp itself was saved.
+func flagChirp(ctx context.Context, db internal.Store, chirpID int, res internal.ProfanityResult) {
+	if len(res.Flagged) == 0 {
+		return
+	}
+	if err := db.FlagChirp(ctx, chirpID, res.Flagged); err != nil {
+		internal.Logger(ctx).Error("cannot flag chirp for review", "chirp_id", chirpID, "error", err)
+	}
+}
+
+func CreateChirpHandler(w http.ResponseWriter, r *http.Request, db internal.Store, cfg *apiConfig) {
 	type parameters struct {
 		Body string `json:"body"`
 	}
@@ -111,17 +186,8 @@ func CreateChirpHandler(w http.ResponseWriter, r *http.Request, db *internal.DB,
 		Error string `json:"error"`
 	}
 	
-	tokenString := r.Header.Get("Authorization")
-	tokenString = strings.Replace(tokenString,"Bearer ","",1)
-	userID, ok := internal.IsAuthenticated(tokenString, cfg.jwtSecret)
-	if !ok {
-		errMsg := retError{Error: "Log in again"}
-		dat, _ := json.Marshal(errMsg)
-		log.Printf("Error authenticating")
-		w.WriteHeader(401)
-		w.Write(dat)
-		return
-	}
+	user, _ := userFromContext(r.Context())
+	userID := user.ID
 
 	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
@@ -130,33 +196,35 @@ func CreateChirpHandler(w http.ResponseWriter, r *http.Request, db *internal.DB,
 	if err != nil {
 		errMsg := retError{Error: err.Error()}
 		dat, _ := json.Marshal(errMsg)
-		log.Printf("Error decoding parameters: %s", err)
+		internal.Logger(r.Context()).Info("invalid request body", "error", err)
 		w.WriteHeader(500)
 		w.Write(dat)
 		return
     }
 
-	if len(params.Body) > 140 {
-		errMsg := retError{Error: "Chirp is too long"}
-		dat, _ := json.Marshal(errMsg)
-		w.WriteHeader(400)
-		w.Write(dat)
+	if !validateChirpBody(w, cfg, params.Body, user.IsChirpyRed) {
+		return
+	}
+
+	filtered, ok := filterChirpBody(w, cfg, params.Body)
+	if !ok {
 		return
 	}
 
-	newChirp,err := db.CreateChirp(replaceProfanity(params.Body), userID)
+	newChirp,err := db.CreateChirp(r.Context(), filtered.Body, userID)
 	if err != nil {
 		errMsg := retError{Error: err.Error()}
-		log.Printf("Error decoding parameters: %s", err)
+		internal.Logger(r.Context()).Error("cannot create chirp", "error", err)
 		dat, _ := json.Marshal(errMsg)
 		w.WriteHeader(500)
 		w.Write(dat)
 		return
 	}
+	flagChirp(r.Context(), db, newChirp.ID, filtered)
 	dat, err := json.Marshal(newChirp)
 	if err != nil {
 		errMsg := retError{Error: err.Error()}
-		log.Printf("Error decoding parameters: %s", err)
+		internal.Logger(r.Context()).Error("cannot encode response", "error", err)
 		dat, _ := json.Marshal(errMsg)
 		w.WriteHeader(500)
 		w.Write(dat)
@@ -167,50 +235,140 @@ func CreateChirpHandler(w http.ResponseWriter, r *http.Request, db *internal.DB,
 }
 
 
-func GetChirpsHandler(w http.ResponseWriter, r *http.Request, db *internal.DB) {
+// maxChirpPageSize caps how many chirps GET /api/chirps returns at once. It
+// is also the page size when the client doesn't ask for one.
+const maxChirpPageSize = 100
+
+func GetChirpsHandler(w http.ResponseWriter, r *http.Request, db internal.Store) {
 	type retError struct {
 		Error string `json:"error"`
 	}
-	s := r.URL.Query().Get("author_id")
-	chirps, err := db.GetChirps()
-	so := r.URL.Query().Get("sort")
+	w.Header().Set("Content-Type", "application/json")
+	query := r.URL.Query()
+	q := internal.ChirpQuery{
+		Desc:  query.Get("sort") == "desc",
+		Limit: maxChirpPageSize,
+	}
+	if s := query.Get("author_id"); s != "" {
+		if sint, err := strconv.Atoi(s); err == nil {
+			q.AuthorID = sint
+		}
+	}
+	if s := query.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 1 {
+			errMsg := retError{Error: "limit must be a positive integer"}
+			dat, _ := json.Marshal(errMsg)
+			w.WriteHeader(400)
+			w.Write(dat)
+			return
+		}
+		q.Limit = min(limit, maxChirpPageSize)
+	}
+	if s := query.Get("cursor"); s != "" {
+		afterID, err := decodeChirpCursor(s)
+		if err != nil {
+			errMsg := retError{Error: "invalid cursor"}
+			dat, _ := json.Marshal(errMsg)
+			w.WriteHeader(400)
+			w.Write(dat)
+			return
+		}
+		q.AfterID = afterID
+	}
+
+	page, err := db.GetChirpsPage(r.Context(), q)
 	if err != nil {
 		errMsg := retError{Error: err.Error()}
-		log.Printf("Error loading chirps: %v", err)
+		internal.Logger(r.Context()).Error("cannot load chirps", "error", err)
 		dat, _ := json.Marshal(errMsg)
 		w.WriteHeader(500)
 		w.Write(dat)
 		return
 	}
-	if sint, err := strconv.Atoi(s); err == nil && s != "" {
-		var tempchirp []internal.Chirp;
-		tempchirp = make([]internal.Chirp, 0)
-		for _, c := range chirps {
-			if c.AuthorID == sint {
-				tempchirp = append(tempchirp, c)
-			}
+	if page.NextAfterID != 0 {
+		next := *r.URL
+		nextQuery := next.Query()
+		nextQuery.Set("cursor", encodeChirpCursor(page.NextAfterID))
+		nextQuery.Set("limit", strconv.Itoa(q.Limit))
+		next.RawQuery = nextQuery.Encode()
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", next.RequestURI()))
+	}
+	dat, _ := json.Marshal(page.Chirps)
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+func SearchChirpsHandler(w http.ResponseWriter, r *http.Request, db internal.Store) {
+	type retError struct {
+		Error string `json:"error"`
+	}
+	w.Header().Set("Content-Type", "application/json")
+	query := r.URL.Query()
+	q := strings.TrimSpace(query.Get("q"))
+	if q == "" {
+		errMsg := retError{Error: "q is required"}
+		dat, _ := json.Marshal(errMsg)
+		w.WriteHeader(400)
+		w.Write(dat)
+		return
+	}
+	limit := maxChirpPageSize
+	if s := query.Get("limit"); s != "" {
+		l, err := strconv.Atoi(s)
+		if err != nil || l < 1 {
+			errMsg := retError{Error: "limit must be a positive integer"}
+			dat, _ := json.Marshal(errMsg)
+			w.WriteHeader(400)
+			w.Write(dat)
+			return
 		}
-		chirps = tempchirp
+		limit = min(l, maxChirpPageSize)
 	}
-	if so != "" && so == "desc"{
-		sort.Slice(chirps, func(i, j int) bool {
-			return chirps[i].ID > chirps[j].ID
-		})
-	} else {
-		sort.Slice(chirps, func(i, j int) bool {
-			return chirps[i].ID < chirps[j].ID
-		})
+
+	chirps, err := db.SearchChirps(r.Context(), q, limit)
+	if err != nil {
+		errMsg := retError{Error: err.Error()}
+		internal.Logger(r.Context()).Error("cannot search chirps", "error", err)
+		dat, _ := json.Marshal(errMsg)
+		w.WriteHeader(500)
+		w.Write(dat)
+		return
 	}
 	dat, _ := json.Marshal(chirps)
 	w.WriteHeader(200)
 	w.Write(dat)
 }
 
-func GetChirpHandler(w http.ResponseWriter, r *http.Request, db *internal.DB, chirpID int) {
+// Cursors are opaque to clients so the paging scheme can change without
+// breaking them. Today they wrap the ID of the last chirp on the page.
+const chirpCursorPrefix = "chirp:"
+
+func encodeChirpCursor(afterID int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(chirpCursorPrefix + strconv.Itoa(afterID)))
+}
+
+func decodeChirpCursor(cursor string) (int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+	s, ok := strings.CutPrefix(string(raw), chirpCursorPrefix)
+	if !ok {
+		return 0, errors.New("unknown cursor format")
+	}
+	afterID, err := strconv.Atoi(s)
+	if err != nil || afterID < 1 {
+		return 0, errors.New("bad cursor position")
+	}
+	return afterID, nil
+}
+
+func GetChirpHandler(w http.ResponseWriter, r *http.Request, db internal.Store, chirpID int) {
 	type retError struct {
 		Error string `json:"error"`
 	}
-  chirp, ok := db.GetSingleChirp(chirpID)
+  chirp, ok := db.GetSingleChirp(r.Context(), chirpID)
   if !ok {
 	errMsg := retError{Error: "Chirp not found"}
 	dat, _ := json.Marshal(errMsg)
@@ -229,26 +387,30 @@ func GetChirpHandler(w http.ResponseWriter, r *http.Request, db *internal.DB, ch
 
 
 
-func GetUsersHandler(w http.ResponseWriter, r *http.Request, db *internal.DB) {
+func GetUsersHandler(w http.ResponseWriter, r *http.Request, db internal.Store) {
 	type retError struct {
 		Error string `json:"error"`
 	}
-	users, err := db.GetUsers()
+	users, err := db.GetUsers(r.Context())
 	if err != nil {
 		errMsg := retError{Error: err.Error()}
-		log.Printf("Error loading users: %v", err)
+		internal.Logger(r.Context()).Error("cannot load users", "error", err)
 		dat, _ := json.Marshal(errMsg)
 		w.WriteHeader(500)
 		w.Write(dat)
 		return
 	}
-	dat, _ := json.Marshal(users)
+	external := make([]internal.UserExternal, len(users))
+	for i, user := range users {
+		external[i] = internal.DbUsertoUserX(user)
+	}
+	dat, _ := json.Marshal(external)
 	w.WriteHeader(200)
 	w.Write(dat)
 }
 
 
-func CreateUsersHandler(w http.ResponseWriter, r *http.Request, db *internal.DB) {
+func CreateUsersHandler(w http.ResponseWriter, r *http.Request, db internal.Store, cfg *apiConfig) {
 	type parameters struct {
 		Email string `json:"email"`
 		Password string `json:"password"`
@@ -265,7 +427,7 @@ func CreateUsersHandler(w http.ResponseWriter, r *http.Request, db *internal.DB)
 	if err != nil {
 		errMsg := retError{Error: err.Error()}
 		dat, _ := json.Marshal(errMsg)
-		log.Printf("Error decoding parameters: %s", err)
+		internal.Logger(r.Context()).Info("invalid request body", "error", err)
 		w.WriteHeader(500)
 		w.Write(dat)
 		return
@@ -279,10 +441,27 @@ func CreateUsersHandler(w http.ResponseWriter, r *http.Request, db *internal.DB)
 		return
 	}
 
-	newUser,err := db.CreateUser(params.Email, params.Password)
+	if err := cfg.passwordPolicy.Check(params.Email, params.Password); err != nil {
+		errMsg := retError{Error: err.Error()}
+		dat, _ := json.Marshal(errMsg)
+		w.WriteHeader(400)
+		w.Write(dat)
+		return
+	}
+	hash, err := cfg.passwords.Hash(params.Password)
+	if err != nil {
+		errMsg := retError{Error: err.Error()}
+		internal.Logger(r.Context()).Error("cannot hash password", "error", err)
+		dat, _ := json.Marshal(errMsg)
+		w.WriteHeader(500)
+		w.Write(dat)
+		return
+	}
+
+	newUser,err := db.CreateUser(r.Context(), params.Email, hash)
 	if err != nil {
 		errMsg := retError{Error: err.Error()}
-		log.Printf("Error decoding parameters: %s", err)
+		internal.Logger(r.Context()).Error("cannot create user", "error", err)
 		dat, _ := json.Marshal(errMsg)
 		w.WriteHeader(500)
 		w.Write(dat)
@@ -291,7 +470,7 @@ func CreateUsersHandler(w http.ResponseWriter, r *http.Request, db *internal.DB)
 	dat, err := json.Marshal(newUser)
 	if err != nil {
 		errMsg := retError{Error: err.Error()}
-		log.Printf("Error decoding parameters: %s", err)
+		internal.Logger(r.Context()).Error("cannot encode response", "error", err)
 		dat, _ := json.Marshal(errMsg)
 		w.WriteHeader(500)
 		w.Write(dat)
@@ -301,7 +480,13 @@ func CreateUsersHandler(w http.ResponseWriter, r *http.Request, db *internal.DB)
 	w.Write(dat)
 }
 
-func ValidateUserHandler(w http.ResponseWriter, r *http.Request, db *internal.DB, cfg *apiConfig) {
+// retryAfter formats a wait as the whole seconds of a Retry-After header,
+// rounded up so the client doesn't come back too early
+func retryAfter(wait time.Duration) string {
+	return strconv.Itoa(int((wait + time.Second - 1) / time.Second))
+}
+
+func ValidateUserHandler(w http.ResponseWriter, r *http.Request, db internal.Store, cfg *apiConfig) {
 	type parameters struct {
 		Email string `json:"email"`
 		Password string `json:"password"`
@@ -325,59 +510,99 @@ func ValidateUserHandler(w http.ResponseWriter, r *http.Request, db *internal.DB
 	if err != nil {
 		errMsg := retError{Error: err.Error()}
 		dat, _ := json.Marshal(errMsg)
-		log.Printf("Error decoding parameters: %s", err)
+		internal.Logger(r.Context()).Info("invalid request body", "error", err)
 		w.WriteHeader(500)
 		w.Write(dat)
 		return
     }
 
-	user, ok := db.GetSingleUserByEmail(params.Email)
+	account := strings.ToLower(strings.TrimSpace(params.Email))
+	ip := clientIP(r)
+	if wait := cfg.logins.Check(account, ip); wait > 0 {
+		errMsg := retError{Error: "Too many failed login attempts, try again later"}
+		dat, _ := json.Marshal(errMsg)
+		internal.Logger(r.Context()).Info("login throttled", "email", account, "wait", wait.String())
+		w.Header().Set("Retry-After", retryAfter(wait))
+		w.WriteHeader(429)
+		w.Write(dat)
+		return
+	}
+
+	user, ok := db.GetSingleUserByEmail(r.Context(), params.Email)
+	var valid, rehash bool
+	if ok {
+		valid, rehash = cfg.passwords.Verify(params.Password, user.Password)
+	} else {
+		// Take as long as a wrong password would, so the timing doesn't
+		// tell which emails are registered
+		cfg.passwords.DummyVerify(params.Password)
+	}
 
-	if !ok || !(internal.CheckPasswordHash(params.Password, user.Password)) {
+	if !valid {
+		if cfg.logins.Failure(account, ip) {
+			logger := internal.Logger(r.Context()).With("email", account)
+			if ok {
+				logger = logger.With("user_id", user.ID)
+			}
+			logger.Warn("account locked after failed logins")
+			_, err := db.AddAuditEntry(r.Context(), internal.AuditEntry{
+				Time: time.Now().UTC(), Action: internal.AuditAccountLocked, UserID: user.ID, Email: account, IP: ip,
+			})
+			if err != nil {
+				internal.Logger(r.Context()).Error("cannot write audit entry", "error", err)
+			}
+		}
 		errMsg := retError{Error: "User not found"}
 		dat, _ := json.Marshal(errMsg)
 		w.WriteHeader(401)
 		w.Write(dat)
 		return
 	}
-
-	if params.Expires == 0 {
-		params.Expires = 5000
+	cfg.logins.Success(account, ip)
+	if rehash {
+		rehashPassword(r, db, cfg, user, params.Password)
 	}
 
+	expires := accessTokenTTL
+	if params.Expires > 0 {
+		expires = time.Duration(params.Expires) * time.Second
+	}
+	setRequestUser(r, user.ID)
 
-	tokenString, err := internal.CreateJWT(cfg.jwtSecret,map[string]interface{}{
-		"Expires": params.Expires, "Subject": strconv.Itoa(user.ID),
-	})
 
+	refreshToken, refreshHash, err := internal.NewToken()
 	if err != nil {
 		errMsg := retError{Error: err.Error()}
 		dat, _ := json.Marshal(errMsg)
-		log.Printf("Error decoding parameters: %s", err)
+		internal.Logger(r.Context()).Error("cannot generate refresh token", "error", err)
 		w.WriteHeader(500)
 		w.Write(dat)
 		return
 	}
 
-	srcToken := make([]byte, 15)
-	_, err = rand.Read(srcToken)
-
-	refreshToken := hex.EncodeToString(srcToken)
-	refreshExpiry := time.Now().UTC().Add(time.Duration(1440) * time.Hour)
-
+	now := time.Now().UTC()
+	session, err := db.CreateSession(r.Context(), internal.Session{
+		UserID: user.ID, TokenHash: refreshHash, UserAgent: r.UserAgent(), IP: clientIP(r),
+		CreatedAt: now, LastUsedAt: now, ExpiresAt: now.Add(sessionTTL),
+	})
 	if err != nil {
 		errMsg := retError{Error: err.Error()}
 		dat, _ := json.Marshal(errMsg)
-		log.Printf("Error decoding parameters: %s", err)
+		internal.Logger(r.Context()).Error("cannot create session", "user_id", user.ID, "error", err)
 		w.WriteHeader(500)
 		w.Write(dat)
 		return
 	}
 
-	db.UpdateSingleUser(user.ID, internal.UpdateUserParams{
-		Email: user.Email, Password: user.Password, RefreshToken:  refreshToken, RefreshExpiry: refreshExpiry,
-		}, false)
-
+	tokenString, err := cfg.tokens.CreateJWT(user.ID, session.ID, expires)
+	if err != nil {
+		errMsg := retError{Error: err.Error()}
+		dat, _ := json.Marshal(errMsg)
+		internal.Logger(r.Context()).Error("cannot create access token", "user_id", user.ID, "error", err)
+		w.WriteHeader(500)
+		w.Write(dat)
+		return
+	}
 
 	res := authRes{
 		Email: user.Email,
@@ -393,7 +618,22 @@ func ValidateUserHandler(w http.ResponseWriter, r *http.Request, db *internal.DB
 
 }
 
-func UpdateUserHandler(w http.ResponseWriter, r *http.Request, db *internal.DB, cfg *apiConfig) {
+// rehashPassword replaces the stored hash of a user who just logged in with
+// one made with the current algorithm and cost. A failure is only logged, as
+// the old hash still works.
+func rehashPassword(r *http.Request, db internal.Store, cfg *apiConfig, user internal.User, password string) {
+	hash, err := cfg.passwords.Hash(password)
+	if err == nil {
+		_, err = db.UpdateSingleUser(r.Context(), user.ID, internal.UpdateUserParams{Email: user.Email, Password: hash})
+	}
+	if err != nil {
+		internal.Logger(r.Context()).Error("cannot rehash password", "user_id", user.ID, "error", err)
+		return
+	}
+	internal.Logger(r.Context()).Info("rehashed password", "user_id", user.ID)
+}
+
+func UpdateUserHandler(w http.ResponseWriter, r *http.Request, db internal.Store, cfg *apiConfig) {
 	type retError struct {
 		Error string `json:"error"`
 	}
@@ -401,94 +641,131 @@ func UpdateUserHandler(w http.ResponseWriter, r *http.Request, db *internal.DB,
 		Email string `json:"email"`
 		Password string `json:"password"`
 	}
-	tokenString := r.Header.Get("Authorization")
-	tokenString = strings.Replace(tokenString,"Bearer ","",1)
-	token, err := internal.ParseJWT(tokenString, cfg.jwtSecret)
-	if err != nil{
-		errMsg := retError{Error: "Log in again"}
+	user, _ := userFromContext(r.Context())
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		errMsg := retError{Error: err.Error()}
 		dat, _ := json.Marshal(errMsg)
-		log.Printf("Error decoding parameters: %s", err)
-		w.WriteHeader(401)
+		internal.Logger(r.Context()).Info("invalid request body", "error", err)
+		w.WriteHeader(400)
+		w.Write(dat)
+		return
+	}
+	if err := cfg.passwordPolicy.Check(params.Email, params.Password); err != nil {
+		errMsg := retError{Error: err.Error()}
+		dat, _ := json.Marshal(errMsg)
+		w.WriteHeader(400)
+		w.Write(dat)
+		return
+	}
+	hash, err := cfg.passwords.Hash(params.Password)
+	if err != nil {
+		errMsg := retError{Error: err.Error()}
+		dat, _ := json.Marshal(errMsg)
+		internal.Logger(r.Context()).Error("cannot hash password", "error", err)
+		w.WriteHeader(500)
 		w.Write(dat)
 		return
 	}
-	if subject, ok := token["subject"].(string); ok {
-		userID, err := strconv.Atoi(subject)
-		if err != nil{
-			errMsg := retError{Error: err.Error()}
-			dat, _ := json.Marshal(errMsg)
-			log.Printf("Error decoding parameters: %s", err)
-			w.WriteHeader(401)
-			w.Write(dat)
-			return
-		}
-
-		decoder := json.NewDecoder(r.Body)
-		params := parameters{}
-		err = decoder.Decode(&params)
-		w.Header().Set("Content-Type", "application/json")
-		if err != nil {
-			errMsg := retError{Error: err.Error()}
-			dat, _ := json.Marshal(errMsg)
-			log.Printf("Error decoding parameters: %s", err)
-			w.WriteHeader(401)
-			w.Write(dat)
-			return
-		}
-
-		user, ok := db.UpdateSingleUser(userID, internal.UpdateUserParams{
-			Email: params.Email, Password: params.Password,
-		}, true)
 
-		if ok{
-			dat, _ := json.Marshal(user)
-			w.WriteHeader(200)
-			w.Write(dat)
-			return
+	updated, err := db.UpdateSingleUser(r.Context(), user.ID, internal.UpdateUserParams{
+		Email: params.Email, Password: hash,
+	})
+	if err != nil {
+		errMsg := retError{Error: err.Error()}
+		dat, _ := json.Marshal(errMsg)
+		if errors.Is(err, internal.ErrUserNotFound) {
+			w.WriteHeader(404)
+		} else {
+			internal.Logger(r.Context()).Error("cannot update user", "user_id", user.ID, "error", err)
+			w.WriteHeader(500)
 		}
-	} 
-	errMsg := retError{Error: "Cannot find user"}
-	dat, _ := json.Marshal(errMsg)
-	log.Printf("Error decoding parameters: %s", err)
-	w.WriteHeader(404)
+		w.Write(dat)
+		return
+	}
+	dat, _ := json.Marshal(updated)
+	w.WriteHeader(200)
 	w.Write(dat)
 }
 
-func RefreshTokenHandler(w http.ResponseWriter, r *http.Request, db *internal.DB, cfg *apiConfig) {
+// RefreshTokenHandler trades a refresh token for a new access token and a
+// new refresh token. The old refresh token stops working; presenting it again
+// revokes the session, as it means the token was copied.
+func RefreshTokenHandler(w http.ResponseWriter, r *http.Request, db internal.Store, cfg *apiConfig) {
 	type retError struct {
 		Error string `json:"error"`
 	}
 	type TokenRes struct {
 		Token string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
 	}
-	tokenString := r.Header.Get("Authorization")
-	tokenString = strings.Replace(tokenString,"Bearer ","",1)
-	newToken, err := db.RefreshToken(tokenString, cfg.jwtSecret)
+	tokenString, err := internal.AuthorizationCredentials(r.Header.Get("Authorization"), "Bearer")
+	if err != nil {
+		writeUnauthorized(w, err)
+		return
+	}
+	refreshToken, refreshHash, err := internal.NewToken()
+	if err != nil {
+		errMsg := retError{Error: err.Error()}
+		dat, _ := json.Marshal(errMsg)
+		internal.Logger(r.Context()).Error("cannot generate refresh token", "error", err)
+		w.WriteHeader(500)
+		w.Write(dat)
+		return
+	}
+	session, err := db.RotateSession(r.Context(), internal.HashToken(tokenString), refreshHash)
 	if err != nil{
 		errMsg := retError{Error: err.Error()}
 		dat, _ := json.Marshal(errMsg)
-		log.Printf("error refreshing token: %s", err)
-		w.WriteHeader(401)
+		switch {
+		case errors.Is(err, internal.ErrRefreshTokenReused):
+			setRequestUser(r, session.UserID)
+			internal.Logger(r.Context()).Warn("refresh token reused, revoked session", "user_id", session.UserID, "session_id", session.ID, "session_ip", session.IP)
+			w.WriteHeader(401)
+		case errors.Is(err, internal.ErrSessionNotFound):
+			internal.Logger(r.Context()).Info("cannot refresh token", "error", err)
+			w.WriteHeader(401)
+		default:
+			internal.Logger(r.Context()).Error("cannot refresh token", "error", err)
+			w.WriteHeader(500)
+		}
 		w.Write(dat)
 		return
 	}
-	t := TokenRes{Token: newToken}
+	setRequestUser(r, session.UserID)
+	newToken, err := cfg.tokens.CreateJWT(session.UserID, session.ID, accessTokenTTL)
+	if err != nil{
+		errMsg := retError{Error: "failed to generate token"}
+		dat, _ := json.Marshal(errMsg)
+		internal.Logger(r.Context()).Error("cannot create access token", "user_id", session.UserID, "error", err)
+		w.WriteHeader(500)
+		w.Write(dat)
+		return
+	}
+	t := TokenRes{Token: newToken, RefreshToken: refreshToken}
 	dat, _ := json.Marshal(t)
 	w.WriteHeader(200)
 	w.Write(dat)
 }
 
-func RevokeTokenHandler(w http.ResponseWriter, r *http.Request, db *internal.DB, cfg *apiConfig) {
+func RevokeTokenHandler(w http.ResponseWriter, r *http.Request, db internal.Store, cfg *apiConfig) {
 	type retError struct {
 		Error string `json:"error"`
 	}
-	tokenString := r.Header.Get("Authorization")
-	tokenString = strings.Replace(tokenString,"Bearer ","",1)
-	err := db.RevokeToken(tokenString)
+	tokenString, err := internal.AuthorizationCredentials(r.Header.Get("Authorization"), "Bearer")
 	if err != nil {
+		writeUnauthorized(w, err)
+		return
+	}
+	err = db.RevokeSessionByToken(r.Context(), internal.HashToken(tokenString))
+	if err != nil && !errors.Is(err, internal.ErrSessionNotFound) {
 		errMsg := retError{Error: err.Error()}
 		dat, _ := json.Marshal(errMsg)
-		log.Printf("error revoking token")
+		internal.Logger(r.Context()).Error("cannot revoke token", "error", err)
 		w.WriteHeader(500)
 		w.Write(dat)
 		return
@@ -496,35 +773,115 @@ func RevokeTokenHandler(w http.ResponseWriter, r *http.Request, db *internal.DB,
 	w.WriteHeader(204)
 }
 
-func DeleteChirpHandler(w http.ResponseWriter, r *http.Request, db *internal.DB, cfg *apiConfig, chirpID int) {
+func DeleteChirpHandler(w http.ResponseWriter, r *http.Request, db internal.Store, cfg *apiConfig, chirpID int) {
 	type retError struct {
 		Error string `json:"error"`
 	}
 	
-	tokenString := r.Header.Get("Authorization")
-	tokenString = strings.Replace(tokenString,"Bearer ","",1)
-	userID, ok := internal.IsAuthenticated(tokenString, cfg.jwtSecret)
+	user, _ := userFromContext(r.Context())
+	var err error
+	if user.Role.Can(internal.PermModerateChirps) {
+		err = db.DeleteAnyChirp(r.Context(), chirpID)
+	} else {
+		err = db.DeleteChirp(r.Context(), chirpID, user.ID)
+	}
+	if err != nil {
+		errMsg := retError{Error: err.Error()}
+		dat, _ := json.Marshal(errMsg)
+		switch {
+		case errors.Is(err, internal.ErrNotChirpAuthor):
+			w.WriteHeader(403)
+		case errors.Is(err, internal.ErrChirpNotFound):
+			w.WriteHeader(404)
+		default:
+			internal.Logger(r.Context()).Error("cannot delete chirp", "chirp_id", chirpID, "error", err)
+			w.WriteHeader(500)
+		}
+		w.Write(dat)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+func UpdateChirpHandler(w http.ResponseWriter, r *http.Request, db internal.Store, cfg *apiConfig, chirpID int) {
+	type parameters struct {
+		Body string `json:"body"`
+	}
+	type retError struct {
+		Error string `json:"error"`
+	}
+
+	user, _ := userFromContext(r.Context())
+	userID := user.ID
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		errMsg := retError{Error: err.Error()}
+		dat, _ := json.Marshal(errMsg)
+		internal.Logger(r.Context()).Info("invalid request body", "error", err)
+		w.WriteHeader(400)
+		w.Write(dat)
+		return
+	}
+
+	if !validateChirpBody(w, cfg, params.Body, user.IsChirpyRed) {
+		return
+	}
+
+	filtered, ok := filterChirpBody(w, cfg, params.Body)
 	if !ok {
-		errMsg := retError{Error: "Log in again"}
+		return
+	}
+
+	chirp, err := db.UpdateChirp(r.Context(), chirpID, userID, filtered.Body)
+	if err != nil {
+		errMsg := retError{Error: err.Error()}
 		dat, _ := json.Marshal(errMsg)
-		log.Printf("Error authenticating")
-		w.WriteHeader(401)
+		switch {
+		case errors.Is(err, internal.ErrChirpNotFound):
+			w.WriteHeader(404)
+		case errors.Is(err, internal.ErrNotChirpAuthor):
+			w.WriteHeader(403)
+		default:
+			internal.Logger(r.Context()).Error("cannot update chirp", "chirp_id", chirpID, "error", err)
+			w.WriteHeader(500)
+		}
 		w.Write(dat)
 		return
 	}
-	err := db.DeleteChirp(chirpID, userID)
+	flagChirp(r.Context(), db, chirp.ID, filtered)
+	dat, _ := json.Marshal(chirp)
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+func GetChirpHistoryHandler(w http.ResponseWriter, r *http.Request, db internal.Store, chirpID int) {
+	type retError struct {
+		Error string `json:"error"`
+	}
+	w.Header().Set("Content-Type", "application/json")
+	history, err := db.GetChirpHistory(r.Context(), chirpID)
 	if err != nil {
 		errMsg := retError{Error: err.Error()}
-		log.Printf("Error decoding parameters: %s", err)
 		dat, _ := json.Marshal(errMsg)
-		w.WriteHeader(403)
+		if errors.Is(err, internal.ErrChirpNotFound) {
+			w.WriteHeader(404)
+		} else {
+			internal.Logger(r.Context()).Error("cannot load chirp history", "chirp_id", chirpID, "error", err)
+			w.WriteHeader(500)
+		}
 		w.Write(dat)
 		return
 	}
-	w.WriteHeader(204)
+	dat, _ := json.Marshal(history)
+	w.WriteHeader(200)
+	w.Write(dat)
 }
 
-func HandlePolkaWebhook(w http.ResponseWriter, r *http.Request, db *internal.DB, cfg *apiConfig) {
+func HandlePolkaWebhook(w http.ResponseWriter, r *http.Request, db internal.Store, cfg *apiConfig) {
 	type WebhookReq struct {
 		Event string `json:"event"`
 		Data  struct {
@@ -537,7 +894,7 @@ func HandlePolkaWebhook(w http.ResponseWriter, r *http.Request, db *internal.DB,
 
 	var params WebhookReq
 	if err := decoder.Decode(&params); err != nil {
-		log.Printf("Error decoding parameters: %s", err)
+		internal.Logger(r.Context()).Info("invalid webhook body", "error", err)
 		http.Error(w, "Error decoding parameters", http.StatusInternalServerError)
 		return
 	}
@@ -548,9 +905,13 @@ func HandlePolkaWebhook(w http.ResponseWriter, r *http.Request, db *internal.DB,
 	}
 
 	// Upgrade the user here
-	if err := db.UpgradeUser(params.Data.UserID); err != nil {
-		log.Printf("Error upgrading user %d: %s", params.Data.UserID, err)
-		http.Error(w, "User upgrade failed", http.StatusNotFound)
+	if err := db.UpgradeUser(r.Context(), params.Data.UserID); err != nil {
+		internal.Logger(r.Context()).Error("cannot upgrade user", "user_id", params.Data.UserID, "error", err)
+		if errors.Is(err, internal.ErrUserNotFound) {
+			http.Error(w, "User upgrade failed", http.StatusNotFound)
+		} else {
+			http.Error(w, "User upgrade failed", http.StatusInternalServerError)
+		}
 		return
 	}
 
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"server/internal"
+	"strings"
+	"time"
+)
+
+// passwordResetTTL is how long a password reset email can be used
+const passwordResetTTL = time.Hour
+
+// ForgotPasswordHandler mails a password reset link to the user with the
+// given email. It answers the same whether or not someone has that email, and
+// sends the email after responding, so neither the response nor its timing
+// tells which emails are registered.
+func ForgotPasswordHandler(w http.ResponseWriter, r *http.Request, db internal.Store, cfg *apiConfig) {
+	type parameters struct {
+		Email string `json:"email"`
+	}
+	type retError struct {
+		Error string `json:"error"`
+	}
+	if cfg.mailer == nil {
+		passwordResetDisabled(w)
+		return
+	}
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil || params.Email == "" {
+		w.Header().Set("Content-Type", "application/json")
+		errMsg := retError{Error: "email is required"}
+		dat, _ := json.Marshal(errMsg)
+		w.WriteHeader(400)
+		w.Write(dat)
+		return
+	}
+	ctx := context.WithoutCancel(r.Context())
+	cfg.background.Add(1)
+	go func() {
+		defer cfg.background.Done()
+		sendPasswordReset(ctx, db, cfg, params.Email)
+	}()
+	w.WriteHeader(202)
+}
+
+// passwordResetDisabled answers a password reset request on a server that
+// has no mailer to send the reset link with
+func passwordResetDisabled(w http.ResponseWriter) {
+	type retError struct {
+		Error string `json:"error"`
+	}
+	w.Header().Set("Content-Type", "application/json")
+	errMsg := retError{Error: "Password reset is disabled on this server"}
+	dat, _ := json.Marshal(errMsg)
+	w.WriteHeader(501)
+	w.Write(dat)
+}
+
+// sendPasswordReset stores a password reset for the user with email, if
+// there is one, and mails them the link to use it
+func sendPasswordReset(ctx context.Context, db internal.Store, cfg *apiConfig, email string) {
+	user, ok := db.GetSingleUserByEmail(ctx, email)
+	if !ok {
+		internal.Logger(ctx).Info("password reset requested for unknown email")
+		return
+	}
+	token, hash, err := internal.NewToken()
+	if err != nil {
+		internal.Logger(ctx).Error("cannot generate password reset token", "error", err)
+		return
+	}
+	now := time.Now().UTC()
+	err = db.CreatePasswordReset(ctx, internal.PasswordReset{
+		TokenHash: hash, UserID: user.ID, CreatedAt: now, ExpiresAt: now.Add(passwordResetTTL),
+	})
+	if err != nil {
+		internal.Logger(ctx).Error("cannot store password reset", "user_id", user.ID, "error", err)
+		return
+	}
+
+	link, _ := url.Parse(cfg.passwordResetURL) // checked by LoadConfig
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+	err = cfg.mailer.Send(ctx, internal.Mail{
+		To:      user.Email,
+		Subject: "Reset your Chirpy password",
+		Body: "Someone asked to reset the password of your Chirpy account. If it was you,\n" +
+			"choose a new one within the next hour here:\n\n" +
+			link.String() + "\n\n" +
+			"If it wasn't you, ignore this email; your password hasn't changed.\n",
+	})
+	if err != nil {
+		internal.Logger(ctx).Error("cannot send password reset email", "user_id", user.ID, "error", err)
+		return
+	}
+	internal.Logger(ctx).Info("sent password reset email", "user_id", user.ID)
+}
+
+// ResetPasswordHandler sets a new password with a token from a password
+// reset email. The token can only be used once, and the user is logged out
+// everywhere; access tokens already issued stay valid until they expire.
+func ResetPasswordHandler(w http.ResponseWriter, r *http.Request, db internal.Store, cfg *apiConfig) {
+	type parameters struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	type retError struct {
+		Error string `json:"error"`
+	}
+	if cfg.mailer == nil {
+		passwordResetDisabled(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		errMsg := retError{Error: err.Error()}
+		dat, _ := json.Marshal(errMsg)
+		w.WriteHeader(400)
+		w.Write(dat)
+		return
+	}
+
+	tokenHash := internal.HashToken(params.Token)
+	var user internal.User
+	reset, err := db.GetPasswordReset(r.Context(), tokenHash)
+	if err == nil {
+		var ok bool
+		if user, ok = db.GetSingleUser(r.Context(), reset.UserID); !ok {
+			err = internal.ErrResetTokenInvalid
+		}
+	}
+	if err == nil {
+		err = cfg.passwordPolicy.Check(user.Email, params.Password)
+	}
+	if err != nil {
+		errMsg := retError{Error: err.Error()}
+		dat, _ := json.Marshal(errMsg)
+		if errors.Is(err, internal.ErrResetTokenInvalid) || errors.Is(err, internal.ErrWeakPassword) {
+			w.WriteHeader(400)
+		} else {
+			internal.Logger(r.Context()).Error("cannot load password reset", "error", err)
+			w.WriteHeader(500)
+		}
+		w.Write(dat)
+		return
+	}
+
+	hash, err := cfg.passwords.Hash(params.Password)
+	if err == nil {
+		_, err = db.ResetPassword(r.Context(), tokenHash, hash)
+	}
+	if err != nil {
+		errMsg := retError{Error: err.Error()}
+		dat, _ := json.Marshal(errMsg)
+		if errors.Is(err, internal.ErrResetTokenInvalid) {
+			w.WriteHeader(400)
+		} else {
+			internal.Logger(r.Context()).Error("cannot reset password", "user_id", user.ID, "error", err)
+			w.WriteHeader(500)
+		}
+		w.Write(dat)
+		return
+	}
+
+	// Whoever locked the account out guessing passwords no longer matters
+	account := strings.ToLower(strings.TrimSpace(user.Email))
+	cfg.logins.Unlock(account)
+	_, err = db.AddAuditEntry(r.Context(), internal.AuditEntry{
+		Time: time.Now().UTC(), Action: internal.AuditPasswordReset, UserID: user.ID, Email: account, IP: clientIP(r),
+	})
+	if err != nil {
+		internal.Logger(r.Context()).Error("cannot write audit entry", "error", err)
+	}
+	internal.Logger(r.Context()).Info("reset password", "target_user_id", user.ID)
+	w.WriteHeader(204)
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net/http/httptest"
+	"server/internal"
+	"strings"
+	"testing"
+)
+
+func TestPasswordResetWithoutMailer(t *testing.T) {
+	cfg, db, users := newTestAPI(t)
+	forgot := httptest.NewRecorder()
+	ForgotPasswordHandler(forgot, httptest.NewRequest("POST", "/api/password/forgot", strings.NewReader(`{"email":"`+users[internal.RoleUser].Email+`"}`)), db, cfg)
+	if forgot.Code != 501 {
+		t.Errorf("forgot: status %d, want 501", forgot.Code)
+	}
+	reset := httptest.NewRecorder()
+	ResetPasswordHandler(reset, httptest.NewRequest("POST", "/api/password/reset", strings.NewReader(`{"token":"x","password":"correct horse battery"}`)), db, cfg)
+	if reset.Code != 501 {
+		t.Errorf("reset: status %d, want 501", reset.Code)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"server/internal"
+	"strconv"
+	"time"
+)
+
+// rateLimits applies a request limit to each route that has a policy. Clients
+// are told apart by user ID when they send a valid access token and by
+// address otherwise.
+type rateLimits struct {
+	limiter  internal.RateLimiter
+	policies map[string]internal.RatePolicy
+	tokens   *internal.Keyring
+	used     map[string]bool
+}
+
+func newRateLimits(limiter internal.RateLimiter, policies map[string]internal.RatePolicy, tokens *internal.Keyring) *rateLimits {
+	return &rateLimits{
+		limiter:  limiter,
+		policies: policies,
+		tokens:   tokens,
+		used:     map[string]bool{},
+	}
+}
+
+// unused returns the routes that have a policy but were never registered,
+// most likely from a typo in the config
+func (l *rateLimits) unused() []string {
+	routes := []string{}
+	for route := range l.policies {
+		if !l.used[route] {
+			routes = append(routes, route)
+		}
+	}
+	return routes
+}
+
+// middleware limits next, served on the route pattern, if it has a policy
+func (l *rateLimits) middleware(pattern string, next http.Handler) http.Handler {
+	policy, ok := l.policies[pattern]
+	if !ok {
+		return next
+	}
+	l.used[pattern] = true
+	window := strconv.Itoa(int((policy.Period + time.Second - 1) / time.Second))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type retError struct {
+			Error string `json:"error"`
+		}
+		client := l.client(r)
+		res, err := l.limiter.Allow(r.Context(), pattern+" "+client, policy)
+		if err != nil {
+			// A limiter that is down shouldn't take the API with it
+			internal.Logger(r.Context()).Error("cannot check rate limit", "error", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("RateLimit-Policy", strconv.Itoa(policy.Limit)+";w="+window)
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(policy.Limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		w.Header().Set("RateLimit-Reset", retryAfter(res.Reset))
+		if !res.Allowed {
+			errMsg := retError{Error: "Too many requests, try again later"}
+			dat, _ := json.Marshal(errMsg)
+			internal.Logger(r.Context()).Info("rate limited", "client", client, "retry_after", res.RetryAfter.String())
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After", retryAfter(res.RetryAfter))
+			w.WriteHeader(429)
+			w.Write(dat)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// client identifies who made the request. The token's signature is checked
+// but not whether it was revoked, which is left to the route's own
+// authentication; a revoked token only buys its user their own bucket.
+func (l *rateLimits) client(r *http.Request) string {
+	token, err := internal.AuthorizationCredentials(r.Header.Get("Authorization"), "Bearer")
+	if err == nil {
+		if claims, err := l.tokens.ParseJWT(token); err == nil {
+			if id, err := claims.UserID(); err == nil {
+				return "user:" + strconv.Itoa(id)
+			}
+		}
+	}
+	return "ip:" + clientIP(r)
+}
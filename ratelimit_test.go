@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"server/internal"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRateLimits(t *testing.T) {
+	cfg, _, users := newTestAPI(t)
+	limits := newRateLimits(internal.NewMemoryRateLimiter(), map[string]internal.RatePolicy{
+		"POST /api/chirps": {Limit: 2, Period: time.Minute},
+		"POST /api/typo":   {Limit: 1, Period: time.Minute},
+	}, cfg.tokens)
+	mux := newRouteMux(limits)
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	mux.HandleFunc("POST /api/chirps", ok)
+	mux.HandleFunc("GET /api/chirps", ok)
+
+	serve := func(method, remoteAddr, authorization string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/api/chirps", nil)
+		r.RemoteAddr = remoteAddr
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	for i, wantRemaining := range []string{"1", "0"} {
+		w := serve("POST", "1.2.3.4:1000", "")
+		if w.Code != 200 {
+			t.Fatalf("request %d: status %d, want 200", i+1, w.Code)
+		}
+		if got := w.Header().Get("RateLimit-Remaining"); got != wantRemaining {
+			t.Errorf("request %d: RateLimit-Remaining = %q, want %q", i+1, got, wantRemaining)
+		}
+		if got := w.Header().Get("RateLimit-Policy"); got != "2;w=60" {
+			t.Errorf("request %d: RateLimit-Policy = %q, want 2;w=60", i+1, got)
+		}
+	}
+
+	w := serve("POST", "1.2.3.4:1000", "")
+	if w.Code != 429 {
+		t.Fatalf("request over the limit: status %d, want 429", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" || w.Header().Get("RateLimit-Limit") != "2" || w.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("429 headers = %v", w.Header())
+	}
+
+	// Other addresses, and users with a token, have buckets of their own
+	if w := serve("POST", "5.6.7.8:1000", ""); w.Code != 200 {
+		t.Errorf("another address: status %d, want 200", w.Code)
+	}
+	token := newTestToken(t, cfg.tokens, users[internal.RoleUser].ID, time.Hour)
+	if w := serve("POST", "1.2.3.4:1000", "Bearer "+token); w.Code != 200 {
+		t.Errorf("authenticated user on a limited address: status %d, want 200", w.Code)
+	}
+
+	// Routes without a policy aren't limited
+	if w := serve("GET", "1.2.3.4:1000", ""); w.Code != 200 || w.Header().Get("RateLimit-Limit") != "" {
+		t.Errorf("unlimited route: status %d, headers %v", w.Code, w.Header())
+	}
+	if got := limits.unused(); !slices.Equal(got, []string{"POST /api/typo"}) {
+		t.Errorf("unused() = %v, want [POST /api/typo]", got)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"server/internal"
+	"time"
+)
+
+// sessionRes is a session as shown to its owner. Current marks the session
+// the request's access token was issued for.
+type sessionRes struct {
+	ID         int       `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+}
+
+// GetSessionsHandler lists the devices the user is logged in on
+func GetSessionsHandler(w http.ResponseWriter, r *http.Request, db internal.Store) {
+	type retError struct {
+		Error string `json:"error"`
+	}
+	w.Header().Set("Content-Type", "application/json")
+	user, _ := userFromContext(r.Context())
+	claims, _ := claimsFromContext(r.Context())
+	sessions, err := db.GetUserSessions(r.Context(), user.ID)
+	if err != nil {
+		errMsg := retError{Error: err.Error()}
+		dat, _ := json.Marshal(errMsg)
+		internal.Logger(r.Context()).Error("cannot load sessions", "user_id", user.ID, "error", err)
+		w.WriteHeader(500)
+		w.Write(dat)
+		return
+	}
+	res := make([]sessionRes, 0, len(sessions))
+	for _, s := range sessions {
+		res = append(res, sessionRes{
+			ID:         s.ID,
+			UserAgent:  s.UserAgent,
+			IP:         s.IP,
+			CreatedAt:  s.CreatedAt,
+			LastUsedAt: s.LastUsedAt,
+			ExpiresAt:  s.ExpiresAt,
+			Current:    s.ID == claims.SessionID,
+		})
+	}
+	dat, _ := json.Marshal(res)
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+// RevokeSessionHandler logs the user out on one of their devices. Access
+// tokens already issued for it stay valid until they expire.
+func RevokeSessionHandler(w http.ResponseWriter, r *http.Request, db internal.Store, sessionID int) {
+	type retError struct {
+		Error string `json:"error"`
+	}
+	user, _ := userFromContext(r.Context())
+	if err := db.RevokeSession(r.Context(), user.ID, sessionID); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		errMsg := retError{Error: err.Error()}
+		dat, _ := json.Marshal(errMsg)
+		if errors.Is(err, internal.ErrSessionNotFound) {
+			w.WriteHeader(404)
+		} else {
+			internal.Logger(r.Context()).Error("cannot revoke session", "session_id", sessionID, "error", err)
+			w.WriteHeader(500)
+		}
+		w.Write(dat)
+		return
+	}
+	internal.Logger(r.Context()).Info("revoked session", "session_id", sessionID)
+	w.WriteHeader(204)
+}
+
+// RevokeAllSessionsHandler logs the user out everywhere, including the
+// device making the request
+func RevokeAllSessionsHandler(w http.ResponseWriter, r *http.Request, db internal.Store) {
+	type retError struct {
+		Error string `json:"error"`
+	}
+	user, _ := userFromContext(r.Context())
+	if err := db.RevokeUserSessions(r.Context(), user.ID); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		errMsg := retError{Error: err.Error()}
+		dat, _ := json.Marshal(errMsg)
+		internal.Logger(r.Context()).Error("cannot revoke sessions", "user_id", user.ID, "error", err)
+		w.WriteHeader(500)
+		w.Write(dat)
+		return
+	}
+	internal.Logger(r.Context()).Info("revoked all sessions")
+	w.WriteHeader(204)
+}
+
+// LogoutHandler revokes the access token the request was made with and ends
+// the session it was issued for, so neither it nor the session's refresh
+// token works afterwards
+func LogoutHandler(w http.ResponseWriter, r *http.Request, db internal.Store) {
+	type retError struct {
+		Error string `json:"error"`
+	}
+	user, _ := userFromContext(r.Context())
+	claims, _ := claimsFromContext(r.Context())
+	if err := db.DenyToken(r.Context(), claims.ID, claims.ExpiresAt.Time); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		errMsg := retError{Error: err.Error()}
+		dat, _ := json.Marshal(errMsg)
+		internal.Logger(r.Context()).Error("cannot revoke access token", "error", err)
+		w.WriteHeader(500)
+		w.Write(dat)
+		return
+	}
+	err := db.RevokeSession(r.Context(), user.ID, claims.SessionID)
+	if err != nil && !errors.Is(err, internal.ErrSessionNotFound) {
+		w.Header().Set("Content-Type", "application/json")
+		errMsg := retError{Error: err.Error()}
+		dat, _ := json.Marshal(errMsg)
+		internal.Logger(r.Context()).Error("cannot revoke session", "session_id", claims.SessionID, "error", err)
+		w.WriteHeader(500)
+		w.Write(dat)
+		return
+	}
+	internal.Logger(r.Context()).Info("logged out", "session_id", claims.SessionID)
+	w.WriteHeader(204)
+}